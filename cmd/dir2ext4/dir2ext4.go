@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/ext4/dir2ext4"
+	"github.com/Microsoft/hcsshim/internal/ext4flags"
+)
+
+var (
+	output     = flag.String("o", "", "output file")
+	uidMap     = flag.String("uidmap", "", "comma-separated host:image:size user ID mappings")
+	gidMap     = flag.String("gidmap", "", "comma-separated host:image:size group ID mappings")
+	imageFlags = ext4flags.Register(flag.CommandLine)
+)
+
+// parseIDMap parses a comma-separated list of host:image:size mappings.
+func parseIDMap(flagName, value string) ([]dir2ext4.IDMapping, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var mappings []dir2ext4.IDMapping
+	for _, s := range strings.Split(value, ",") {
+		fields := strings.Split(s, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("-%s: invalid mapping %q", flagName, s)
+		}
+		var ids [3]uint32
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("-%s: invalid mapping %q", flagName, s)
+			}
+			ids[i] = uint32(n)
+		}
+		mappings = append(mappings, dir2ext4.IDMapping{HostID: ids[0], ImageID: ids[1], Size: ids[2]})
+	}
+	return mappings, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] -o output dir\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if len(*output) == 0 || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := func() error {
+		uids, err := parseIDMap("uidmap", *uidMap)
+		if err != nil {
+			return err
+		}
+		gids, err := parseIDMap("gidmap", *gidMap)
+		if err != nil {
+			return err
+		}
+
+		opts, err := imageFlags.Options()
+		if err != nil {
+			return err
+		}
+
+		out, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		// Close is checked below once the image is written; this only
+		// releases the file on failure.
+		defer out.Close()
+		err = dir2ext4.Convert(flag.Arg(0), out,
+			dir2ext4.UIDMap(uids...),
+			dir2ext4.GIDMap(gids...),
+			dir2ext4.ConvertOptions(opts...))
+		if err != nil {
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if h := imageFlags.RootHash(); h != nil {
+			fmt.Printf("%x\n", h)
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Microsoft/hcsshim/ext4/ext42tar"
+	"github.com/Microsoft/hcsshim/ext4/vhd"
+)
+
+var (
+	output   = flag.String("o", "", "output file; the default is standard output")
+	contents = flag.Bool("contents", false, "compare the contents of regular files whose metadata is unchanged")
+	overlay  = flag.Bool("overlay", false, "honor overlayfs-style opaque directories in the new image")
+)
+
+// openImage opens an ext4 image that is either raw or wrapped in a VHD or VHDX.
+func openImage(name string) (io.ReaderAt, io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if d, err := vhd.Open(f, fi.Size()); err == nil {
+		return d, f, nil
+	}
+	return f, f, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] base.img new.img\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Writes an OCI layer tar containing the changes from base.img to new.img.")
+		fmt.Fprintln(os.Stderr, "Images may be raw ext4 or wrapped in a VHD or VHDX.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := func() error {
+		base, baseCloser, err := openImage(flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer baseCloser.Close()
+		r, closer, err := openImage(flag.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+
+		out := os.Stdout
+		if *output != "" {
+			out, err = os.Create(*output)
+			if err != nil {
+				return err
+			}
+			// Close is checked below once the tar is written; this only
+			// releases the file on failure.
+			defer out.Close()
+		}
+
+		var opts []ext42tar.Option
+		if *contents {
+			opts = append(opts, ext42tar.CompareContents)
+		}
+		if *overlay {
+			opts = append(opts, ext42tar.ConvertWhiteout)
+		}
+		if err := ext42tar.Diff(base, r, out, opts...); err != nil {
+			return err
+		}
+		if out != os.Stdout {
+			return out.Close()
+		}
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/osversion"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// checkpointStateFile is the name of the VM saved state file in a checkpoint
+// image path.
+const checkpointStateFile = "vm.vmrs"
+
+var checkpointCommand = cli.Command{
+	Name:  "checkpoint",
+	Usage: "checkpoint a paused container's VM",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container to be
+checkpointed.`,
+	Description: `The checkpoint command stops a paused container, removes its resources from
+its utility VM, and then saves the state of the VM to the image path. Once the
+state is saved, the VM is stopped and the container is deleted, so its ID can
+be used again.
+
+Only containers that own their utility VM can be checkpointed. The checkpoint is
+a snapshot of a warm utility VM rather than of the container: the container's
+processes are not part of it. To continue, run
+
+       # runhcs checkpoint --image-path <path> <container-id>
+       # runhcs restore --image-path <path> <container-id>
+
+which creates the container again from its bundle in a VM restored from the
+checkpoint. If the state cannot be saved, the VM is resumed and the stopped
+container is kept; use runhcs delete to remove it.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "image-path",
+			Value: "",
+			Usage: "path for saving the checkpoint image",
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		imagePath, err := checkpointImagePath(context.String("image-path"))
+		if err != nil {
+			return err
+		}
+		c, err := getContainer(id, true)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return c.Checkpoint(imagePath)
+	},
+}
+
+// checkpointImagePath returns the absolute form of the --image-path value of
+// checkpoint and restore.
+func checkpointImagePath(imagePath string) (string, error) {
+	if imagePath == "" {
+		return "", errors.New("--image-path is required")
+	}
+	return filepath.Abs(imagePath)
+}
+
+// checkCheckpoint returns an error if a container cannot be checkpointed on
+// Windows build build. isHost is whether the container owns its VM, and status
+// is its current status.
+func checkCheckpoint(id string, build uint16, isHost bool, status containerStatus) error {
+	if build < osversion.RS5 {
+		return fmt.Errorf("checkpoint requires Windows build %d or later, but this is build %d", osversion.RS5, build)
+	}
+	if !isHost {
+		return fmt.Errorf("container %s does not own a VM and cannot be checkpointed", id)
+	}
+	if status != containerPaused {
+		return fmt.Errorf("container %s must be paused to be checkpointed, but is %s", id, status)
+	}
+	return nil
+}
+
+// Checkpoint stops the container and saves the state of its VM, without the
+// container, to imagePath. It then stops the VM and deletes the container. The
+// container must be paused.
+func (c *container) Checkpoint(imagePath string) error {
+	status, err := c.Status()
+	if err != nil {
+		return err
+	}
+	if err := checkCheckpoint(c.ID, osversion.Get().Build, c.IsHost, status); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(imagePath, 0700); err != nil {
+		return err
+	}
+
+	vm, err := hcs.OpenComputeSystem(vmID(c.ID))
+	if err != nil {
+		return err
+	}
+	defer vm.Close()
+
+	// Remove the container and its devices from the VM so that the saved VM
+	// matches the one that restore creates from the UVM options alone.
+	if err := c.Kill(); err != nil {
+		return err
+	}
+	if err := c.Unmount(true); err != nil {
+		return err
+	}
+
+	err = vm.PauseWithOptions(&hcsschema.PauseOptions{
+		SuspensionLevel: "Suspend",
+		HostedNotification: &hcsschema.PauseNotification{
+			Reason: "Save",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pause VM: %s", err)
+	}
+	err = vm.Save(&hcsschema.SaveOptions{
+		SaveType:          "ToFile",
+		SaveStateFilePath: filepath.Join(imagePath, checkpointStateFile),
+	})
+	if err != nil {
+		if rerr := vm.Resume(); rerr != nil {
+			logrus.Warnf("failed to resume VM %s after a failed save: %s", vm.ID(), rerr)
+		}
+		if hcs.IsNotSupported(err) {
+			return fmt.Errorf("saving the VM state is not supported on Windows build %d: %s", osversion.Get().Build, err)
+		}
+		return fmt.Errorf("failed to save VM state: %s", err)
+	}
+
+	// The checkpoint is complete, so the container and its VM are no longer
+	// needed, and restore may reuse the ID.
+	if err := vm.Terminate(); hcs.IsPending(err) {
+		vm.Wait()
+	}
+	return stateKey.Remove(c.ID)
+}
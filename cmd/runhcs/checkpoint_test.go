@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/osversion"
+)
+
+func TestCheckpointImagePath(t *testing.T) {
+	if _, err := checkpointImagePath(""); err == nil {
+		t.Fatal("expected an error without an image path")
+	}
+	p, err := checkpointImagePath("checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(p) || filepath.Base(p) != "checkpoint" {
+		t.Fatalf("expected an absolute path to checkpoint, got %s", p)
+	}
+}
+
+func TestCheckCheckpoint(t *testing.T) {
+	if err := checkCheckpoint("test", osversion.RS5, true, containerPaused); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		build  uint16
+		isHost bool
+		status containerStatus
+	}{
+		{"old build", osversion.RS4, true, containerPaused},
+		{"hosted container", osversion.RS5, false, containerPaused},
+		{"running container", osversion.RS5, true, containerRunning},
+		{"stopped container", osversion.RS5, true, containerStopped},
+	} {
+		if err := checkCheckpoint("test", c.build, c.isHost, c.status); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
@@ -15,8 +15,9 @@ import (
 	"github.com/Microsoft/hcsshim/internal/guid"
 	"github.com/Microsoft/hcsshim/internal/hcs"
 	"github.com/Microsoft/hcsshim/internal/hcsoci"
-	"github.com/Microsoft/hcsshim/internal/regstate"
 	"github.com/Microsoft/hcsshim/internal/runhcs"
+	"github.com/Microsoft/hcsshim/internal/schema1"
+	"github.com/Microsoft/hcsshim/internal/statestore"
 	"github.com/Microsoft/hcsshim/internal/uvm"
 	"github.com/Microsoft/hcsshim/osversion"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
@@ -135,7 +136,7 @@ func launchShim(cmd, pidFile, logFile string, args []string, data interface{}) (
 	}
 
 	var log *os.File
-	fullargs := []string{os.Args[0]}
+	fullargs := []string{os.Args[0], "--root", stateRoot}
 	if logFile != "" {
 		if !strings.HasPrefix(logFile, runhcs.SafePipePrefix) {
 			log, err = os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_SYNC, 0666)
@@ -326,6 +327,9 @@ type containerConfig struct {
 	ShimLogFile, VMLogFile string
 	Spec                   *specs.Spec
 	VMConsolePipe          string
+	// CheckpointPath is the image path of a checkpoint to restore the
+	// container's VM from.
+	CheckpointPath string
 }
 
 func createContainer(cfg *containerConfig) (_ *container, err error) {
@@ -386,6 +390,9 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		newvm = true
 		hostUniqueID = uniqueID
 	}
+	if cfg.CheckpointPath != "" && !newvm {
+		return nil, errors.New("only a container that owns its VM can be restored from a checkpoint")
+	}
 
 	// Make absolute the paths in Root.Path and Windows.LayerFolders.
 	rootfs := ""
@@ -411,7 +418,7 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 				// RS4 case
 				err = stateKey.Get(cfg.Spec.Windows.Network.NetworkSharedContainerName, keyNetNS, &netNS)
 				if err != nil {
-					if _, ok := err.(*regstate.NoStateError); !ok {
+					if _, ok := err.(*statestore.NoStateError); !ok {
 						return nil, err
 					}
 				}
@@ -450,14 +457,23 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 		}
 	}()
 	if isSandbox && vmisolated {
+		// The namespace map is kept in the registry whatever the state root,
+		// since it is looked up by namespace ID alone when hcn syncs a
+		// namespace.
+		var cnisk statestore.StateStore
+		cnisk, err = cni.OpenStateStore()
+		if err != nil {
+			return nil, err
+		}
+		defer cnisk.Close()
 		cnicfg := cni.NewPersistedNamespaceConfig(netNS, cfg.ID, hostUniqueID)
-		err = cnicfg.Store()
+		err = cnicfg.Store(cnisk)
 		if err != nil {
 			return nil, err
 		}
 		defer func() {
 			if err != nil {
-				cnicfg.Remove()
+				cnicfg.Remove(cnisk)
 			}
 		}()
 	}
@@ -484,6 +500,9 @@ func createContainer(cfg *containerConfig) (_ *container, err error) {
 			VPMemSizeBytes:       parseAnnotationsUint64(cfg.Spec.Annotations, annotationVPMemSize),
 			PreferredRootFSType:  parseAnnotationsPreferredRootFSType(cfg.Spec.Annotations, annotationPreferredRootFSType),
 		}
+		if cfg.CheckpointPath != "" {
+			opts.RestoreStatePath = filepath.Join(cfg.CheckpointPath, checkpointStateFile)
+		}
 
 		shim, err := c.startVMShim(cfg.VMLogFile, opts)
 		if err != nil {
@@ -539,7 +558,7 @@ func (c *container) VMIsolated() bool {
 func (c *container) unmountInHost(vm *uvm.UtilityVM, all bool) error {
 	resources := &hcsoci.Resources{}
 	err := stateKey.Get(c.ID, keyResources, resources)
-	if _, ok := err.(*regstate.NoStateError); ok {
+	if _, ok := err.(*statestore.NoStateError); ok {
 		return nil
 	}
 	if err != nil {
@@ -698,7 +717,7 @@ func getContainer(id string, notStopped bool) (*container, error) {
 	}
 	err = stateKey.Get(id, keyShimPid, &c.ShimPid)
 	if err != nil {
-		if _, ok := err.(*regstate.NoStateError); !ok {
+		if _, ok := err.(*statestore.NoStateError); !ok {
 			return nil, err
 		}
 		c.ShimPid = -1
@@ -777,3 +796,12 @@ func (c *container) Status() (containerStatus, error) {
 	}
 	return state, nil
 }
+
+// Stats returns the resource usage statistics of the container.
+func (c *container) Stats() (*schema1.Statistics, error) {
+	props, err := c.hc.Properties(schema1.PropertyTypeStatistics)
+	if err != nil {
+		return nil, err
+	}
+	return &props.Statistics, nil
+}
@@ -22,6 +22,10 @@ var createScratchCommand = cli.Command{
 			Name:  "destpath",
 			Usage: "Required: describes the destination vhd path",
 		},
+		cli.BoolFlag{
+			Name:  "host",
+			Usage: "create the scratch on the host without starting a utility VM; 'destpath' must have a .vhdx or .vhd extension",
+		},
 	},
 	Before: appargs.Validate(),
 	Action: func(context *cli.Context) error {
@@ -30,8 +34,12 @@ var createScratchCommand = cli.Command{
 			return errors.New("'destpath' is required")
 		}
 
-		// If we only have v1 lcow support do it the old way.
-		if osversion.Get().Build < osversion.RS5 {
+		if context.Bool("host") {
+			if err := lcow.CreateScratchOnHost(dest, lcow.DefaultScratchSizeGB); err != nil {
+				return errors.Wrapf(err, "failed to create ext4 scratch '%s'", dest)
+			}
+		} else if osversion.Get().Build < osversion.RS5 {
+			// If we only have v1 lcow support do it the old way.
 			cfg := gcsclient.Config{
 				Options: gcsclient.Options{
 					KirdPath:   filepath.Join(os.Getenv("ProgramFiles"), "Linux Containers"),
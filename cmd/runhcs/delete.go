@@ -5,7 +5,7 @@ import (
 	"os"
 
 	"github.com/Microsoft/hcsshim/internal/appargs"
-	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/statestore"
 	"github.com/urfave/cli"
 )
 
@@ -34,7 +34,7 @@ status of "ubuntu01" as "stopped" the following will delete resources held for
 		force := context.Bool("force")
 		container, err := getContainer(id, false)
 		if err != nil {
-			if _, ok := err.(*regstate.NoStateError); ok {
+			if _, ok := err.(*statestore.NoStateError); ok {
 				if e := stateKey.Remove(id); e != nil {
 					fmt.Fprintf(os.Stderr, "remove %s: %v\n", id, e)
 				}
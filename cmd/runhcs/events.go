@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/runhcs"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var eventsCommand = cli.Command{
+	Name:  "events",
+	Usage: "display container events such as exit, pause and resume notifications and resource usage statistics",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container.`,
+	Description: `The events command displays information about the container. By default the
+information is displayed once every 5 seconds. Each event is written to stdout
+as a single line of JSON. The command returns after the container exits.`,
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "interval",
+			Value: 5 * time.Second,
+			Usage: "set the stats collection interval",
+		},
+		cli.BoolFlag{
+			Name:  "stats",
+			Usage: "display the container's stats then exit",
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		interval := context.Duration("interval")
+		if interval <= 0 {
+			return errors.New("duration interval must be greater than 0")
+		}
+		c, err := getContainer(id, true)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		enc := json.NewEncoder(os.Stdout)
+		if context.Bool("stats") {
+			stats, err := c.Stats()
+			if err != nil {
+				return err
+			}
+			return enc.Encode(&runhcs.Event{Type: runhcs.EventStats, ID: id, Stats: stats})
+		}
+
+		exited := make(chan error, 1)
+		go func() {
+			exited <- c.hc.Wait()
+		}()
+		status, err := c.Status()
+		if err != nil {
+			return err
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case err := <-exited:
+				if err != nil {
+					return err
+				}
+				return enc.Encode(&runhcs.Event{Type: runhcs.EventExit, ID: id})
+			case <-ticker.C:
+			}
+
+			// HCS only notifies the caller that paused or resumed the
+			// container, so detect these by polling.
+			prev := status
+			status, err = c.Status()
+			if err != nil {
+				logrus.Errorf("events: failed to get status of container %s: %s", id, err)
+				continue
+			}
+			var e *runhcs.Event
+			switch {
+			case status == containerStopped:
+				return enc.Encode(&runhcs.Event{Type: runhcs.EventExit, ID: id})
+			case status == containerPaused && prev != containerPaused:
+				e = &runhcs.Event{Type: runhcs.EventPause, ID: id}
+			case status != containerPaused && prev == containerPaused:
+				e = &runhcs.Event{Type: runhcs.EventResume, ID: id}
+			}
+			if e != nil {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+			if status != containerRunning {
+				continue
+			}
+			stats, err := c.Stats()
+			if err != nil {
+				logrus.Errorf("events: failed to get stats of container %s: %s", id, err)
+				continue
+			}
+			if err := enc.Encode(&runhcs.Event{Type: runhcs.EventStats, ID: id, Stats: stats}); err != nil {
+				return err
+			}
+		}
+	},
+}
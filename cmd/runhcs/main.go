@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/Microsoft/go-winio"
 	"github.com/Microsoft/hcsshim/internal/regstate"
 	"github.com/Microsoft/hcsshim/internal/runhcs"
+	"github.com/Microsoft/hcsshim/internal/statestore"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -28,7 +30,10 @@ var version = ""
 // and will be populated by the Makefile
 var gitCommit = ""
 
-var stateKey *regstate.Key
+var stateKey statestore.StateStore
+
+// stateRoot is the value of the --root flag, which is passed on to the shims.
+var stateRoot string
 
 var logFormat string
 
@@ -87,26 +92,28 @@ func main() {
 		cli.StringFlag{
 			Name:  "root",
 			Value: "default",
-			Usage: "registry key for storage of container state",
+			Usage: "registry key, or absolute path of a directory, for storage of container state",
 		},
 	}
 	app.Commands = []cli.Command{
+		checkpointCommand,
 		createCommand,
 		createScratchCommand,
 		deleteCommand,
-		// eventsCommand,
+		eventsCommand,
 		execCommand,
 		killCommand,
 		listCommand,
 		pauseCommand,
 		psCommand,
 		resizeTtyCommand,
+		restoreCommand,
 		resumeCommand,
 		runCommand,
 		shimCommand,
 		startCommand,
 		stateCommand,
-		// updateCommand,
+		updateCommand,
 		vmshimCommand,
 	}
 	app.Before = func(context *cli.Context) error {
@@ -136,7 +143,8 @@ func main() {
 		}
 
 		var err error
-		stateKey, err = regstate.Open(context.GlobalString("root"), false)
+		stateRoot = context.GlobalString("root")
+		stateKey, err = openStateStore(stateRoot)
 		if err != nil {
 			return err
 		}
@@ -154,6 +162,18 @@ func main() {
 	}
 }
 
+// openStateStore opens the container state store for root. An absolute path
+// selects a directory of state files, which persist across reboots. Any other
+// value names a volatile registry key. The map of network namespaces to VMs is
+// not part of the container state and is always kept in the registry (see
+// cni.OpenStateStore).
+func openStateStore(root string) (statestore.StateStore, error) {
+	if filepath.IsAbs(root) {
+		return statestore.OpenDir(root)
+	}
+	return regstate.Open(root, false)
+}
+
 type logErrorWriter struct {
 	Writer io.Writer
 }
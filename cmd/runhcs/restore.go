@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/urfave/cli"
+)
+
+var restoreCommand = cli.Command{
+	Name:  "restore",
+	Usage: "restore a container from a previous checkpoint",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container to be
+restored.`,
+	Description: `The restore command creates and runs a container for a bundle, like runhcs
+run, in a utility VM restored from a checkpoint made by runhcs checkpoint
+instead of a newly booted one.
+
+The bundle's specification must describe the same utility VM as the one that
+was checkpointed: the same base layers and VM resources. The checkpoint deletes
+the container, so the container ID that was checkpointed can be used again:
+
+       # runhcs checkpoint --image-path <path> <container-id>
+       # runhcs restore --image-path <path> <container-id>`,
+	Flags: append(createRunFlags,
+		cli.StringFlag{
+			Name:  "image-path",
+			Value: "",
+			Usage: "path to the checkpoint image",
+		},
+		cli.BoolFlag{
+			Name:  "detach, d",
+			Usage: "detach from the container's process",
+		},
+	),
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		imagePath, err := checkpointImagePath(context.String("image-path"))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(imagePath, checkpointStateFile)); err != nil {
+			return err
+		}
+		cfg, err := containerConfigFromContext(context)
+		if err != nil {
+			return err
+		}
+		if cfg.HostID != "" {
+			return errors.New("--host cannot be used with a checkpoint")
+		}
+		cfg.CheckpointPath = imagePath
+		return runContainer(context, cfg)
+	},
+}
@@ -36,29 +36,33 @@ command(s) that get executed on start, edit the args parameter of the spec.`,
 		if err != nil {
 			return err
 		}
-		c, err := createContainer(cfg)
-		if err != nil {
-			return err
-		}
-		if err != nil {
-			return err
-		}
-		p, err := os.FindProcess(c.ShimPid)
-		if err != nil {
-			return err
-		}
-		err = c.Exec()
+		return runContainer(context, cfg)
+	},
+}
+
+// runContainer creates the container described by cfg and starts its init
+// process. Unless --detach is set, it waits for the process to exit, removes
+// the container and exits with the process's exit code.
+func runContainer(context *cli.Context, cfg *containerConfig) error {
+	c, err := createContainer(cfg)
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(c.ShimPid)
+	if err != nil {
+		return err
+	}
+	err = c.Exec()
+	if err != nil {
+		return err
+	}
+	if !context.Bool("detach") {
+		state, err := p.Wait()
 		if err != nil {
 			return err
 		}
-		if !context.Bool("detach") {
-			state, err := p.Wait()
-			if err != nil {
-				return err
-			}
-			c.Remove()
-			os.Exit(int(state.Sys().(syscall.WaitStatus).ExitCode))
-		}
-		return nil
-	},
+		c.Remove()
+		os.Exit(int(state.Sys().(syscall.WaitStatus).ExitCode))
+	}
+	return nil
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+
+	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcs"
+	"github.com/Microsoft/hcsshim/internal/requesttype"
+	"github.com/Microsoft/hcsshim/internal/schema2"
+	"github.com/Microsoft/hcsshim/osversion"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli"
+)
+
+var updateCommand = cli.Command{
+	Name:  "update",
+	Usage: "update container resource constraints",
+	ArgsUsage: `<container-id>
+
+Where "<container-id>" is the name for the instance of the container.`,
+	Description: `The update command changes the resource constraints of a running container.
+
+The resources can be read from a file, or from the standard input with
+"--resources -", in the format of the OCI WindowsResources for Windows
+containers or LinuxResources for Linux containers, for example:
+
+{
+  "memory": {
+    "limit": 1073741824
+  },
+  "cpu": {
+    "shares": 5000,
+    "maximum": 2500
+  },
+  "storage": {
+    "iops": 1000,
+    "bps": 10485760
+  }
+}
+
+Values given in flags override those read from the file.
+
+The processor and storage settings can only be changed for process isolated
+Windows containers. The memory limit of a VM isolated container is the memory
+size of its utility VM, and can only be changed through the container that
+created the VM. Linux containers only support changing the memory limit.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "resources, r",
+			Usage: `path to the file containing the resources to update or '-' to read from the standard input`,
+		},
+		cli.Uint64Flag{
+			Name:  "cpu-count",
+			Usage: "number of processors available to the container",
+		},
+		cli.Uint64Flag{
+			Name:  "cpu-shares",
+			Usage: "relative CPU weight of the container (1-10000)",
+		},
+		cli.Uint64Flag{
+			Name:  "cpu-maximum",
+			Usage: "portion of processor cycles the container can use as a percentage times 100 (1-10000)",
+		},
+		cli.Uint64Flag{
+			Name:  "memory",
+			Usage: "memory limit in bytes, in whole MBs",
+		},
+		cli.Uint64Flag{
+			Name:  "storage-iops",
+			Usage: "maximum storage IO operations per second",
+		},
+		cli.Uint64Flag{
+			Name:  "storage-bps",
+			Usage: "maximum storage bandwidth in bytes per second",
+		},
+	},
+	Before: appargs.Validate(argID),
+	Action: func(context *cli.Context) error {
+		id := context.Args().First()
+		c, err := getContainer(id, true)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		r := &resourceUpdate{}
+		if path := context.String("resources"); path != "" {
+			var f io.Reader = os.Stdin
+			if path != "-" {
+				file, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				f = file
+			}
+			r, err = readResources(f, c.Spec.Linux != nil)
+			if err != nil {
+				return err
+			}
+		}
+		for _, flag := range []struct {
+			name  string
+			field **uint64
+		}{
+			{"cpu-count", &r.CPUCount},
+			{"cpu-shares", &r.CPUWeight},
+			{"cpu-maximum", &r.CPUMaximum},
+			{"memory", &r.MemoryLimit},
+			{"storage-iops", &r.StorageIops},
+			{"storage-bps", &r.StorageBps},
+		} {
+			if context.IsSet(flag.name) {
+				v := context.Uint64(flag.name)
+				*flag.field = &v
+			}
+		}
+		return c.Update(r)
+	},
+}
+
+// resourceUpdate holds the resource constraints to change. Nil fields are
+// left unchanged.
+type resourceUpdate struct {
+	CPUCount    *uint64
+	CPUWeight   *uint64
+	CPUMaximum  *uint64
+	MemoryLimit *uint64 // in bytes
+	StorageIops *uint64
+	StorageBps  *uint64
+}
+
+// readResources reads a JSON encoded specs.LinuxResources if linux is true,
+// or a specs.WindowsResources otherwise.
+func readResources(r io.Reader, linux bool) (*resourceUpdate, error) {
+	dec := json.NewDecoder(r)
+	if linux {
+		var lr specs.LinuxResources
+		if err := dec.Decode(&lr); err != nil {
+			return nil, err
+		}
+		return linuxResourceUpdate(&lr)
+	}
+	var wr specs.WindowsResources
+	if err := dec.Decode(&wr); err != nil {
+		return nil, err
+	}
+	return windowsResourceUpdate(&wr)
+}
+
+func windowsResourceUpdate(wr *specs.WindowsResources) (*resourceUpdate, error) {
+	r := &resourceUpdate{}
+	if wr.CPU != nil {
+		r.CPUCount = wr.CPU.Count
+		if wr.CPU.Shares != nil {
+			v := uint64(*wr.CPU.Shares)
+			r.CPUWeight = &v
+		}
+		if wr.CPU.Maximum != nil {
+			v := uint64(*wr.CPU.Maximum)
+			r.CPUMaximum = &v
+		}
+	}
+	if wr.Memory != nil {
+		r.MemoryLimit = wr.Memory.Limit
+	}
+	if wr.Storage != nil {
+		if wr.Storage.SandboxSize != nil {
+			return nil, errors.New("storage.sandboxSize cannot be updated")
+		}
+		r.StorageIops = wr.Storage.Iops
+		r.StorageBps = wr.Storage.Bps
+	}
+	return r, nil
+}
+
+func linuxResourceUpdate(lr *specs.LinuxResources) (*resourceUpdate, error) {
+	r := &resourceUpdate{}
+	other := *lr
+	if lr.Memory != nil {
+		if lr.Memory.Limit != nil {
+			if *lr.Memory.Limit < 0 {
+				return nil, fmt.Errorf("invalid memory.limit %d", *lr.Memory.Limit)
+			}
+			v := uint64(*lr.Memory.Limit)
+			r.MemoryLimit = &v
+		}
+		memory := *lr.Memory
+		memory.Limit = nil
+		if !reflect.DeepEqual(memory, specs.LinuxMemory{}) {
+			return nil, errors.New("only memory.limit can be updated for a Linux container")
+		}
+		other.Memory = nil
+	}
+	if !reflect.DeepEqual(other, specs.LinuxResources{}) {
+		return nil, errors.New("only memory.limit can be updated for a Linux container")
+	}
+	return r, nil
+}
+
+// updateRequest is a request to modify a compute system, along with the
+// resource fields that it changes.
+type updateRequest struct {
+	fields  string
+	request *hcsschema.ModifySettingRequest
+}
+
+// updateRequests returns the requests that apply r to a process isolated
+// container, or to a utility VM if vm is true.
+func updateRequests(r *resourceUpdate, vm bool) ([]updateRequest, error) {
+	var requests []updateRequest
+	hasCPU := r.CPUCount != nil || r.CPUWeight != nil || r.CPUMaximum != nil
+	hasStorage := r.StorageIops != nil || r.StorageBps != nil
+	if vm && (hasCPU || hasStorage) {
+		return nil, errors.New("only the memory limit can be updated for a VM isolated container")
+	}
+	if hasCPU {
+		p := &hcsschema.Processor{}
+		if r.CPUCount != nil {
+			if *r.CPUCount > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid CPU count %d", *r.CPUCount)
+			}
+			p.Count = int32(*r.CPUCount)
+		}
+		if r.CPUWeight != nil {
+			if *r.CPUWeight < 1 || *r.CPUWeight > 10000 {
+				return nil, fmt.Errorf("invalid CPU shares %d", *r.CPUWeight)
+			}
+			p.Weight = int32(*r.CPUWeight)
+		}
+		if r.CPUMaximum != nil {
+			if *r.CPUMaximum < 1 || *r.CPUMaximum > 10000 {
+				return nil, fmt.Errorf("invalid CPU maximum %d", *r.CPUMaximum)
+			}
+			p.Maximum = int32(*r.CPUMaximum)
+		}
+		requests = append(requests, updateRequest{
+			fields: "the CPU limits",
+			request: &hcsschema.ModifySettingRequest{
+				ResourcePath: "Container/Processor",
+				RequestType:  requesttype.Update,
+				Settings:     p,
+			},
+		})
+	}
+	if r.MemoryLimit != nil {
+		// HCS sets the memory limit in MB, so rather than silently rounding
+		// the limit, only whole MBs are accepted.
+		mb := *r.MemoryLimit / 1024 / 1024
+		if mb == 0 || *r.MemoryLimit%(1024*1024) != 0 {
+			return nil, fmt.Errorf("invalid memory limit %d: must be a non-zero multiple of 1MB", *r.MemoryLimit)
+		}
+		path := "Container/Memory/SizeInMB"
+		if vm {
+			path = "VirtualMachine/ComputeTopology/Memory/SizeInMB"
+		}
+		requests = append(requests, updateRequest{
+			fields: "the memory limit",
+			request: &hcsschema.ModifySettingRequest{
+				ResourcePath: path,
+				RequestType:  requesttype.Update,
+				Settings:     mb,
+			},
+		})
+	}
+	if hasStorage {
+		qos := &hcsschema.StorageQoS{}
+		if r.StorageIops != nil {
+			if *r.StorageIops > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid storage IOPS %d", *r.StorageIops)
+			}
+			qos.IopsMaximum = int32(*r.StorageIops)
+		}
+		if r.StorageBps != nil {
+			if *r.StorageBps > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid storage bandwidth %d", *r.StorageBps)
+			}
+			qos.BandwidthMaximum = int32(*r.StorageBps)
+		}
+		requests = append(requests, updateRequest{
+			fields: "the storage limits",
+			request: &hcsschema.ModifySettingRequest{
+				ResourcePath: "Container/Storage/QoS",
+				RequestType:  requesttype.Update,
+				Settings:     qos,
+			},
+		})
+	}
+	return requests, nil
+}
+
+// Update applies r to the running container, or to the utility VM that it
+// created. The requests are applied in turn, so the changes before a failed
+// request remain in effect.
+func (c *container) Update(r *resourceUpdate) error {
+	build := osversion.Get().Build
+	if build < osversion.RS5 {
+		return fmt.Errorf("updating container resources requires Windows build %d or later, but this is build %d", osversion.RS5, build)
+	}
+	if c.HostID != "" && !c.IsHost {
+		return fmt.Errorf("container %s shares the resources of VM host %s, which must be updated instead", c.ID, c.HostID)
+	}
+	requests, err := updateRequests(r, c.IsHost)
+	if err != nil {
+		return err
+	}
+	system := c.hc
+	if c.IsHost {
+		vm, err := hcs.OpenComputeSystem(vmID(c.ID))
+		if err != nil {
+			return err
+		}
+		defer vm.Close()
+		system = vm
+	}
+	for _, req := range requests {
+		if err := system.Modify(req.request); err != nil {
+			if hcs.IsNotSupported(err) {
+				return fmt.Errorf("updating %s is not supported on Windows build %d: %s", req.fields, build, err)
+			}
+			return fmt.Errorf("failed to update %s: %s", req.fields, err)
+		}
+	}
+	return nil
+}
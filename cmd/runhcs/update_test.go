@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/internal/schema2"
+)
+
+func TestReadResourcesWindows(t *testing.T) {
+	r, err := readResources(strings.NewReader(`{"cpu":{"count":2,"shares":5000,"maximum":2500},"memory":{"limit":1073741824},"storage":{"iops":1000,"bps":4096}}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		v    *uint64
+		want uint64
+	}{
+		{"CPUCount", r.CPUCount, 2},
+		{"CPUWeight", r.CPUWeight, 5000},
+		{"CPUMaximum", r.CPUMaximum, 2500},
+		{"MemoryLimit", r.MemoryLimit, 1073741824},
+		{"StorageIops", r.StorageIops, 1000},
+		{"StorageBps", r.StorageBps, 4096},
+	} {
+		if c.v == nil || *c.v != c.want {
+			t.Errorf("%s: expected %d, got %v", c.name, c.want, c.v)
+		}
+	}
+
+	if _, err := readResources(strings.NewReader(`{"storage":{"sandboxSize":1}}`), false); err == nil {
+		t.Fatal("expected an error updating the sandbox size")
+	}
+}
+
+func TestReadResourcesLinux(t *testing.T) {
+	r, err := readResources(strings.NewReader(`{"memory":{"limit":1073741824}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MemoryLimit == nil || *r.MemoryLimit != 1073741824 {
+		t.Fatalf("expected memory limit 1073741824, got %v", r.MemoryLimit)
+	}
+
+	for _, s := range []string{
+		`{"memory":{"limit":-1}}`,
+		`{"memory":{"limit":1073741824,"swap":1073741824}}`,
+		`{"cpu":{"shares":1024}}`,
+	} {
+		if _, err := readResources(strings.NewReader(s), true); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestUpdateRequests(t *testing.T) {
+	count, weight, memory, iops := uint64(2), uint64(100), uint64(512*1024*1024), uint64(1000)
+	r := &resourceUpdate{CPUCount: &count, CPUWeight: &weight, MemoryLimit: &memory, StorageIops: &iops}
+	requests, err := updateRequests(r, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+	if p, ok := requests[0].request.Settings.(*hcsschema.Processor); !ok || p.Count != 2 || p.Weight != 100 || p.Maximum != 0 {
+		t.Errorf("unexpected processor settings %+v", requests[0].request.Settings)
+	}
+	if requests[1].request.ResourcePath != "Container/Memory/SizeInMB" || requests[1].request.Settings != uint64(512) {
+		t.Errorf("unexpected memory request %+v", requests[1].request)
+	}
+	if q, ok := requests[2].request.Settings.(*hcsschema.StorageQoS); !ok || q.IopsMaximum != 1000 || q.BandwidthMaximum != 0 {
+		t.Errorf("unexpected storage settings %+v", requests[2].request.Settings)
+	}
+
+	if _, err := updateRequests(r, true); err == nil {
+		t.Fatal("expected an error updating the CPU of a VM")
+	}
+	requests, err = updateRequests(&resourceUpdate{MemoryLimit: &memory}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].request.ResourcePath != "VirtualMachine/ComputeTopology/Memory/SizeInMB" {
+		t.Fatalf("unexpected VM requests %+v", requests)
+	}
+
+	weight = 0
+	if _, err := updateRequests(&resourceUpdate{CPUWeight: &weight}, false); err == nil {
+		t.Fatal("expected an error for CPU shares 0")
+	}
+	bps := uint64(4294967296)
+	if _, err := updateRequests(&resourceUpdate{StorageBps: &bps}, false); err == nil {
+		t.Fatal("expected an error for storage bandwidth that overflows int32")
+	}
+	count = math.MaxInt32 + 1
+	if _, err := updateRequests(&resourceUpdate{CPUCount: &count}, false); err == nil {
+		t.Fatal("expected an error for a CPU count that overflows int32")
+	}
+	memory = 512*1024*1024 + 1
+	if _, err := updateRequests(&resourceUpdate{MemoryLimit: &memory}, false); err == nil {
+		t.Fatal("expected an error for a memory limit that is not a multiple of 1MB")
+	}
+}
@@ -10,9 +10,10 @@ import (
 
 	winio "github.com/Microsoft/go-winio"
 	"github.com/Microsoft/hcsshim/internal/appargs"
+	"github.com/Microsoft/hcsshim/internal/hcsoci"
 	"github.com/Microsoft/hcsshim/internal/runhcs"
+	"github.com/Microsoft/hcsshim/internal/statestore"
 	"github.com/Microsoft/hcsshim/internal/uvm"
-	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -99,21 +100,22 @@ var vmshimCommand = cli.Command{
 			case <-exitCh:
 				return nil
 			case pipe := <-pipeCh:
-				err = processRequest(vm, pipe)
+				var req runhcs.VMRequest
+				err = json.NewDecoder(pipe).Decode(&req)
 				if err == nil {
-					_, err = pipe.Write(runhcs.ShimSuccess)
+					err = processRequest(vm, &req)
+				}
+				if err != nil {
+					logrus.Errorf("failed VM request %s for %s: %s", req.Op, req.ID, err)
+				}
+				werr := runhcs.WriteVMResponse(pipe, &req, err)
+				if err == nil && werr == nil {
 					// Wait until the pipe is closed before closing the
 					// container so that it is properly handed off to the other
 					// process.
-					if err == nil {
-						err = closeWritePipe(pipe)
-					}
-					if err == nil {
+					if closeWritePipe(pipe) == nil {
 						ioutil.ReadAll(pipe)
 					}
-				} else {
-					logrus.Error("failed creating container in VM: ", err)
-					fmt.Fprintf(pipe, "%v", err)
 				}
 				pipe.Close()
 			}
@@ -134,13 +136,14 @@ func startVM(opts *uvm.UVMOptions) (*uvm.UtilityVM, error) {
 	return vm, nil
 }
 
-func processRequest(vm *uvm.UtilityVM, pipe net.Conn) error {
-	var req runhcs.VMRequest
-	err := json.NewDecoder(pipe).Decode(&req)
-	if err != nil {
-		return err
+func processRequest(vm *uvm.UtilityVM, req *runhcs.VMRequest) error {
+	logrus.Debug("received operation ", req.Op, " for ", req.ID, " (version ", req.Version, ")")
+	if req.Version > runhcs.VMRequestVersion {
+		return &runhcs.VMError{
+			Code:    runhcs.VMErrorUnsupportedVersion,
+			Message: fmt.Sprintf("VM request version %d is newer than the supported version %d", req.Version, runhcs.VMRequestVersion),
+		}
 	}
-	logrus.Debug("received operation ", req.Op, " for ", req.ID)
 	c, err := getContainer(req.ID, false)
 	if err != nil {
 		return err
@@ -170,13 +173,44 @@ func processRequest(vm *uvm.UtilityVM, pipe net.Conn) error {
 		}
 
 	case runhcs.OpSyncNamespace:
-		return errors.New("Not implemented")
+		var data runhcs.SyncNamespaceRequest
+		if err := req.DecodeData(&data); err != nil {
+			return err
+		}
+		return c.syncNamespace(vm, data.NamespaceID)
+
 	default:
-		panic("unknown operation")
+		return &runhcs.VMError{
+			Code:    runhcs.VMErrorUnknownOp,
+			Message: fmt.Sprintf("unknown VM request operation %q", req.Op),
+		}
 	}
 	return nil
 }
 
+// syncNamespace reconciles the NICs in vm with the endpoints of the HNS network
+// namespace netNS, or of the container's network namespace if netNS is empty.
+func (c *container) syncNamespace(vm *uvm.UtilityVM, netNS string) error {
+	if netNS == "" {
+		err := stateKey.Get(c.ID, keyNetNS, &netNS)
+		if err != nil {
+			if _, ok := err.(*statestore.NoStateError); !ok {
+				return err
+			}
+			netNS = c.RequestedNetNS
+		}
+		if netNS == "" {
+			return fmt.Errorf("container %s does not have a network namespace", c.ID)
+		}
+	}
+	endpoints, err := hcsoci.GetNamespaceEndpoints(netNS)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("syncing network namespace %s of VM %s with %d endpoints", netNS, vm.ID(), len(endpoints))
+	return vm.SyncNetNS(netNS, endpoints)
+}
+
 type noVMError struct {
 	ID string
 }
@@ -186,11 +220,11 @@ func (err *noVMError) Error() string {
 }
 
 func (c *container) issueVMRequest(op runhcs.VMRequestOp) error {
-	req := runhcs.VMRequest{
-		ID: c.ID,
-		Op: op,
+	req, err := runhcs.NewVMRequest(c.ID, op, nil)
+	if err != nil {
+		return err
 	}
-	if err := runhcs.IssueVMRequest(c.VMPipePath(), &req); err != nil {
+	if err := runhcs.IssueVMRequest(c.VMPipePath(), req); err != nil {
 		if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ERROR_FILE_NOT_FOUND {
 			return &noVMError{c.HostID}
 		}
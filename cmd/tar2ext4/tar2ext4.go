@@ -1,26 +1,50 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
+	"github.com/Microsoft/hcsshim/internal/ext4flags"
 )
 
 var (
 	input      = flag.String("i", "", "input file")
 	output     = flag.String("o", "", "output file")
 	overlay    = flag.Bool("overlay", false, "produce overlayfs-compatible layer image")
-	vhd        = flag.Bool("vhd", false, "add a VHD footer to the end of the image")
-	inlineData = flag.Bool("inline", false, "write small file data into the inode; not compatible with DAX")
+	digests    = flag.String("digest", "", "comma-separated expected digests of the input layers as stored")
+	diffIDs    = flag.String("diffid", "", "comma-separated expected digests of the uncompressed input layers")
+	imageFlags = ext4flags.Register(flag.CommandLine)
 )
 
+// splitList splits a comma-separated flag value into n entries.
+func splitList(flagName, value string, n int) ([]string, error) {
+	if value == "" {
+		return make([]string, n), nil
+	}
+	list := strings.Split(value, ",")
+	if len(list) != n {
+		return nil, fmt.Errorf("-%s: expected %d values, got %d", flagName, n, len(list))
+	}
+	return list, nil
+}
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] -o output [layer.tar...]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Layer tars may be plain or compressed with gzip or zstd. When multiple")
+		fmt.Fprintln(os.Stderr, "layers are given, they are applied in order and flattened into a single")
+		fmt.Fprintln(os.Stderr, "file system.")
+		fmt.Fprintln(os.Stderr)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
-	if flag.NArg() != 0 || len(*output) == 0 {
+	if len(*output) == 0 || (*input != "" && flag.NArg() != 0) {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -28,33 +52,81 @@ func main() {
 	err := func() (err error) {
 		in := os.Stdin
 		if *input != "" {
-			in, err = os.Open(*input)
+			f, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		var layers []io.Reader
+		for _, name := range flag.Args() {
+			layer, err := os.Open(name)
 			if err != nil {
 				return err
 			}
+			defer layer.Close()
+			layers = append(layers, layer)
+		}
+		if len(layers) > 1 && *overlay {
+			return errors.New("-overlay cannot be used when flattening multiple layers")
 		}
 		out, err := os.Create(*output)
 		if err != nil {
 			return err
 		}
+		// Close is checked below once the image is written; this only
+		// releases the file on failure.
+		defer out.Close()
 
-		var opts []tar2ext4.Option
+		opts, err := imageFlags.Options()
+		if err != nil {
+			return err
+		}
 		if *overlay {
 			opts = append(opts, tar2ext4.ConvertWhiteout)
 		}
-		if *vhd {
-			opts = append(opts, tar2ext4.AppendVhdFooter)
+		if *digests != "" || *diffIDs != "" {
+			n := len(layers)
+			if n == 0 {
+				n = 1
+			}
+			compressed, err := splitList("digest", *digests, n)
+			if err != nil {
+				return err
+			}
+			uncompressed, err := splitList("diffid", *diffIDs, n)
+			if err != nil {
+				return err
+			}
+			expected := make([]tar2ext4.Digests, n)
+			for i := range expected {
+				expected[i] = tar2ext4.Digests{Compressed: compressed[i], Uncompressed: uncompressed[i]}
+			}
+			opts = append(opts, tar2ext4.DigestVerify(expected...))
 		}
-		if *inlineData {
-			opts = append(opts, tar2ext4.InlineData)
+		switch len(layers) {
+		case 0:
+			err = tar2ext4.Convert(in, out, opts...)
+			if err != nil {
+				return err
+			}
+			// Exhaust the tar stream.
+			io.Copy(ioutil.Discard, in)
+		case 1:
+			err = tar2ext4.Convert(layers[0], out, opts...)
+		default:
+			err = tar2ext4.ConvertLayers(layers, out, opts...)
 		}
-		err = tar2ext4.Convert(in, out, opts...)
 		if err != nil {
 			return err
 		}
-
-		// Exhaust the tar stream.
-		io.Copy(ioutil.Discard, in)
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if h := imageFlags.RootHash(); h != nil {
+			fmt.Printf("%x\n", h)
+		}
 		return nil
 	}()
 	if err != nil {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/hcsshim/ext4/vhd"
+	"github.com/Microsoft/hcsshim/internal/guid"
+)
+
+const (
+	ext4SuperBlockOffset = 1024
+	ext4MagicOffset      = 0x38
+	ext4Magic            = 0xef53
+)
+
+// hasExt4 reports whether the disk starts with an ext4 superblock.
+func hasExt4(d *vhd.Disk) (bool, error) {
+	var magic [2]byte
+	if _, err := d.ReadAt(magic[:], ext4SuperBlockOffset+ext4MagicOffset); err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint16(magic[:]) == ext4Magic, nil
+}
+
+func printInfo(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	d, err := vhd.Open(f, fi.Size())
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	fmt.Printf("%s:\n", name)
+	fmt.Printf("  format:      %s\n", d.Format)
+	fmt.Printf("  type:        %s\n", d.Type)
+	fmt.Printf("  size:        %d\n", d.Size)
+	if d.Type != vhd.Fixed {
+		fmt.Printf("  allocated:   %d\n", d.Allocated())
+		fmt.Printf("  block size:  %d\n", d.BlockSize)
+	}
+	fmt.Printf("  sector size: %d logical, %d physical\n", d.LogicalSectorSize, d.PhysicalSectorSize)
+	if d.Format == vhd.FormatVHD {
+		g := d.Geometry
+		fmt.Printf("  geometry:    %d/%d/%d (C/H/S)\n", g.Cylinders, g.Heads, g.SectorsPerTrack)
+	}
+	fmt.Printf("  uuid:        %s\n", guid.GUID(d.UUID))
+	fmt.Printf("  creator:     %q\n", d.Creator)
+	if ext4, err := hasExt4(d); err != nil {
+		fmt.Printf("  ext4:        unknown (%s)\n", err)
+	} else {
+		fmt.Printf("  ext4:        %t\n", ext4)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s file.vhd[x]...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, name := range flag.Args() {
+		if err := printInfo(name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,242 @@
+// Package dir2ext4 builds ext4 file system images from directory trees on the
+// host.
+package dir2ext4
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
+)
+
+// IDMapping maps a contiguous range of user or group IDs on the host to IDs
+// in the image.
+type IDMapping struct {
+	HostID  uint32
+	ImageID uint32
+	Size    uint32
+}
+
+type params struct {
+	uidMap   []IDMapping
+	gidMap   []IDMapping
+	convOpts []tar2ext4.Option
+}
+
+// Option is the type for optional parameters to Convert.
+type Option func(*params)
+
+// UIDMap instructs the converter to translate file owners on the host to
+// owners in the image using the given mappings. Files owned by an unmapped
+// user cause Convert to fail.
+func UIDMap(mappings ...IDMapping) Option {
+	return func(p *params) {
+		p.uidMap = append(p.uidMap, mappings...)
+	}
+}
+
+// GIDMap instructs the converter to translate file groups on the host to
+// groups in the image using the given mappings. Files owned by an unmapped
+// group cause Convert to fail.
+func GIDMap(mappings ...IDMapping) Option {
+	return func(p *params) {
+		p.gidMap = append(p.gidMap, mappings...)
+	}
+}
+
+// ConvertOptions passes options through to tar2ext4, which controls the
+// format of the image.
+func ConvertOptions(options ...tar2ext4.Option) Option {
+	return func(p *params) {
+		p.convOpts = append(p.convOpts, options...)
+	}
+}
+
+// mapID returns the image ID for host ID id. All IDs map to themselves if
+// there are no mappings.
+func mapID(mappings []IDMapping, id int) (int, bool) {
+	if len(mappings) == 0 {
+		return id, true
+	}
+	for _, m := range mappings {
+		if id >= int(m.HostID) && int64(id) < int64(m.HostID)+int64(m.Size) {
+			return id - int(m.HostID) + int(m.ImageID), true
+		}
+	}
+	return 0, false
+}
+
+// hostFile holds the properties of a file on the host that os.FileInfo does
+// not expose portably.
+type hostFile struct {
+	id                 fileID
+	nlink              uint64
+	uid, gid           int
+	devmajor, devminor uint32
+	atime, ctime       time.Time
+}
+
+// unixMode returns the permission bits of mode in their Unix form.
+func unixMode(mode os.FileMode) uint16 {
+	m := uint16(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// Convert writes a compact ext4 file system image containing the directory
+// tree rooted at dir. Modes, ownership, times, hard links, symbolic links,
+// device nodes and extended attributes are preserved where the host supports
+// them. Sockets are skipped.
+//
+// The files are written to the image as the tree is walked, so the tree must
+// not be modified while it is converted.
+func Convert(dir string, w io.ReadWriteSeeker, options ...Option) error {
+	var p params
+	for _, opt := range options {
+		opt(&p)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	return tar2ext4.ConvertFS(w, func(fs *compactext4.Writer) error {
+		wk := &walker{
+			p:     &p,
+			root:  dir,
+			fs:    fs,
+			links: make(map[fileID]string),
+		}
+		return wk.walk("", fi)
+	}, p.convOpts...)
+}
+
+type walker struct {
+	p     *params
+	root  string
+	fs    *compactext4.Writer
+	links map[fileID]string // first path seen for each file with multiple links
+}
+
+func (wk *walker) walk(name string, fi os.FileInfo) error {
+	if err := wk.addFile(name, fi); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	// ReadDir sorts the entries, which keeps the output deterministic.
+	entries, err := ioutil.ReadDir(filepath.Join(wk.root, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := wk.walk(path.Join(name, e.Name()), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wk *walker) addFile(name string, fi os.FileInfo) error {
+	mode := fi.Mode()
+	if mode&os.ModeSocket != 0 {
+		return nil
+	}
+	hostPath := filepath.Join(wk.root, filepath.FromSlash(name))
+	hf, err := statFile(hostPath, fi)
+	if err != nil {
+		return fmt.Errorf("%s: %s", hostPath, err)
+	}
+
+	if !fi.IsDir() && hf.nlink > 1 {
+		if target, seen := wk.links[hf.id]; seen {
+			return wk.fs.Link(target, name)
+		}
+		wk.links[hf.id] = name
+	}
+
+	uid, ok := mapID(wk.p.uidMap, hf.uid)
+	if !ok {
+		return fmt.Errorf("%s: uid %d is not mapped", hostPath, hf.uid)
+	}
+	gid, ok := mapID(wk.p.gidMap, hf.gid)
+	if !ok {
+		return fmt.Errorf("%s: gid %d is not mapped", hostPath, hf.gid)
+	}
+	xattrs, err := readXattrs(hostPath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", hostPath, err)
+	}
+	if xattrs == nil {
+		xattrs = make(map[string][]byte)
+	}
+	f := &compactext4.File{
+		Mode:   unixMode(mode),
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Atime:  hf.atime,
+		Mtime:  fi.ModTime(),
+		Ctime:  hf.ctime,
+		Crtime: fi.ModTime(),
+		Xattrs: xattrs,
+	}
+	switch {
+	case mode.IsRegular():
+		f.Mode |= compactext4.S_IFREG
+		f.Size = fi.Size()
+	case mode.IsDir():
+		f.Mode |= compactext4.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		f.Mode |= compactext4.S_IFLNK
+		f.Linkname, err = os.Readlink(hostPath)
+		if err != nil {
+			return err
+		}
+	case mode&os.ModeNamedPipe != 0:
+		f.Mode |= compactext4.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		f.Mode |= compactext4.S_IFCHR
+		f.Devmajor, f.Devminor = hf.devmajor, hf.devminor
+	case mode&os.ModeDevice != 0:
+		f.Mode |= compactext4.S_IFBLK
+		f.Devmajor, f.Devminor = hf.devmajor, hf.devminor
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", hostPath, mode&os.ModeType)
+	}
+	if err := wk.fs.Create(name, f); err != nil {
+		return fmt.Errorf("%s: %s", hostPath, err)
+	}
+	if !mode.IsRegular() {
+		return nil
+	}
+	r, err := os.Open(hostPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(wk.fs, r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", hostPath, err)
+	}
+	if n != f.Size {
+		return fmt.Errorf("%s: file changed size during conversion", hostPath)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package dir2ext4
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+	"golang.org/x/sys/unix"
+)
+
+func TestConvert(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to create device nodes and change ownership")
+	}
+	dir, err := ioutil.TempDir("", "dir2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	join := func(name string) string { return filepath.Join(dir, name) }
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2019, 3, 4, 5, 6, 7, 8000, time.UTC)
+	must(os.Mkdir(join("sub"), 0750))
+	must(ioutil.WriteFile(join("sub/file"), []byte("hello"), 0640))
+	must(os.Chmod(join("sub/file"), 0640|os.ModeSetuid))
+	must(os.Chtimes(join("sub/file"), mtime, mtime))
+	must(os.Link(join("sub/file"), join("hardlink")))
+	must(os.Symlink("sub/file", join("symlink")))
+	must(unix.Mkfifo(join("fifo"), 0600))
+	must(unix.Mknod(join("null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))))
+	must(os.Chmod(join("null"), 0666))
+	must(os.Lchown(join("sub"), 1000, 1001))
+	must(os.Lchown(join("symlink"), 1000, 1001))
+	xattrs := true
+	if err := unix.Lsetxattr(join("sub/file"), "user.test", []byte("value\x00"), 0); err == unix.ENOTSUP {
+		xattrs = false
+	} else {
+		must(err)
+	}
+
+	f, err := ioutil.TempFile("", "dir2ext4")
+	must(err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	err = Convert(dir, f,
+		UIDMap(IDMapping{HostID: 0, ImageID: 0, Size: 1}, IDMapping{HostID: 1000, ImageID: 2000, Size: 10}),
+		GIDMap(IDMapping{HostID: 0, ImageID: 0, Size: 1}, IDMapping{HostID: 1001, ImageID: 3000, Size: 1}))
+	must(err)
+
+	r, err := compactext4.NewReader(f)
+	must(err)
+	stat := func(name string) *compactext4.File {
+		f, err := r.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	if st := stat("sub"); st.Mode != compactext4.S_IFDIR|0750 || st.Uid != 2000 || st.Gid != 3000 {
+		t.Errorf("sub: unexpected mode %o or owner %d:%d", st.Mode, st.Uid, st.Gid)
+	}
+	st := stat("sub/file")
+	if st.Mode != compactext4.S_IFREG|04640 || st.Uid != 0 || st.Gid != 0 {
+		t.Errorf("sub/file: unexpected mode %o or owner %d:%d", st.Mode, st.Uid, st.Gid)
+	}
+	if !st.Mtime.Equal(mtime) {
+		t.Errorf("sub/file: mtime %s, expected %s", st.Mtime, mtime)
+	}
+	if xattrs && !bytes.Equal(st.Xattrs["user.test"], []byte("value\x00")) {
+		t.Errorf("sub/file: unexpected xattrs %q", st.Xattrs)
+	}
+	fr, err := r.Open("sub/file")
+	must(err)
+	if b, _ := ioutil.ReadAll(fr); string(b) != "hello" {
+		t.Errorf("sub/file: unexpected contents %q", b)
+	}
+	if st := stat("symlink"); st.Linkname != "sub/file" || st.Uid != 2000 {
+		t.Errorf("symlink: unexpected target %q or owner %d", st.Linkname, st.Uid)
+	}
+	if st := stat("fifo"); st.Mode != compactext4.S_IFIFO|0600 {
+		t.Errorf("fifo: unexpected mode %o", st.Mode)
+	}
+	if st := stat("null"); st.Mode != compactext4.S_IFCHR|0666 || st.Devmajor != 1 || st.Devminor != 3 {
+		t.Errorf("null: unexpected mode %o or device %d:%d", st.Mode, st.Devmajor, st.Devminor)
+	}
+
+	inodes := make(map[string]uint32)
+	for _, dir := range []string{"", "sub"} {
+		entries, err := r.ReadDir(dir)
+		must(err)
+		for _, e := range entries {
+			inodes[filepath.Join(dir, e.Name)] = e.Inode
+		}
+	}
+	if inodes["hardlink"] != inodes["sub/file"] {
+		t.Error("hard link was not preserved")
+	}
+}
+
+func TestConvertUnmappedID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dir2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "dir2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	uid := uint32(os.Getuid())
+	err = Convert(dir, f, UIDMap(IDMapping{HostID: uid + 1, ImageID: 0, Size: 1}))
+	if err == nil {
+		t.Fatal("expected error for unmapped uid")
+	}
+}
@@ -0,0 +1,35 @@
+// +build !windows
+
+package dir2ext4
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file on the host.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// statFile returns the host properties of the file at path, which fi
+// describes.
+func statFile(path string, fi os.FileInfo) (*hostFile, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return nil, err
+	}
+	return &hostFile{
+		id:       fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)},
+		nlink:    uint64(st.Nlink),
+		uid:      int(st.Uid),
+		gid:      int(st.Gid),
+		devmajor: unix.Major(uint64(st.Rdev)),
+		devminor: unix.Minor(uint64(st.Rdev)),
+		atime:    time.Unix(st.Atim.Unix()),
+		ctime:    time.Unix(st.Ctim.Unix()),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package dir2ext4
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileID identifies a file on the host.
+type fileID struct {
+	volume uint32
+	index  uint64
+}
+
+// statFile returns the host properties of the file at path, which fi
+// describes. Files are owned by root, and the change time is the modification
+// time, since Windows has no equivalents.
+func statFile(path string, fi os.FileInfo) (*hostFile, error) {
+	hf := &hostFile{
+		atime: fi.ModTime(),
+		ctime: fi.ModTime(),
+	}
+	if d, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		hf.atime = time.Unix(0, d.LastAccessTime.Nanoseconds())
+	}
+	if fi.IsDir() {
+		return hf, nil
+	}
+
+	// os.FileInfo does not expose the file index on Windows, so it is read
+	// from the file itself to find hard links.
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(p,
+		windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OPEN_REPARSE_POINT,
+		0)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(h)
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+		return nil, err
+	}
+	hf.id = fileID{
+		volume: info.VolumeSerialNumber,
+		index:  uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow),
+	}
+	hf.nlink = uint64(info.NumberOfLinks)
+	return hf, nil
+}
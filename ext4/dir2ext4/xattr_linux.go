@@ -0,0 +1,63 @@
+package dir2ext4
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file at path, without
+// following symbolic links.
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := llistxattr(path)
+	if err != nil {
+		if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range names {
+		value, err := lgetxattr(path, name)
+		if err == unix.ENODATA {
+			// The attribute was removed after it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+func llistxattr(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	b := make([]byte, size)
+	size, err = unix.Llistxattr(path, b)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(b[:size], []byte{0}) {
+		if len(name) != 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func lgetxattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	b := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:size], nil
+}
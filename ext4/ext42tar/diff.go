@@ -0,0 +1,273 @@
+package ext42tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"path"
+	"time"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+)
+
+// CompareContents instructs Diff to compare the contents of regular files
+// whose metadata and size are unchanged, by hash. Without it, such files are
+// assumed to be unchanged.
+func CompareContents(p *params) {
+	p.compareContents = true
+}
+
+// Diff writes a tar stream to w that contains the changes from the ext4 file
+// system image read from base to the one read from r, in the form of an OCI
+// layer. Paths that were added or changed are written in full, paths that
+// were removed are written as .wh. whiteouts, and directories whose contents
+// were entirely replaced are written with an opaque whiteout.
+//
+// Changes are detected by comparing file type, mode, ownership, mtime, size,
+// link target, device numbers and extended attributes. Applying the layer to
+// base produces the tree in r.
+func Diff(base, r io.ReaderAt, w io.Writer, options ...Option) error {
+	var p params
+	for _, opt := range options {
+		opt(&p)
+	}
+	baseFS, err := compactext4.NewReader(base)
+	if err != nil {
+		return err
+	}
+	fs, err := compactext4.NewReader(r)
+	if err != nil {
+		return err
+	}
+	c := &converter{
+		p:      &p,
+		fs:     fs,
+		base:   baseFS,
+		tw:     tar.NewWriter(w),
+		inodes: make(map[uint32]string),
+	}
+	root, err := fs.Stat("")
+	if err != nil {
+		return err
+	}
+	baseEntries, entries, err := c.readDirs("")
+	if err != nil {
+		return err
+	}
+	if err := c.diffDirectory("", root.Mtime, baseEntries, entries); err != nil {
+		return err
+	}
+	return c.tw.Close()
+}
+
+// readDir returns the entries of dir in fs, excluding an empty lost+found.
+func readDir(fs *compactext4.Reader, dir string) ([]compactext4.DirEntry, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	filtered := entries[:0]
+	for _, e := range entries {
+		if !isEmptyLostAndFound(fs, path.Join(dir, e.Name)) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered, nil
+}
+
+// readDirs returns the entries of dir in the base and new images.
+func (c *converter) readDirs(dir string) ([]compactext4.DirEntry, []compactext4.DirEntry, error) {
+	baseEntries, err := readDir(c.base, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := readDir(c.fs, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return baseEntries, entries, nil
+}
+
+// diffDirectory writes the changes to the entries of dir, whose mtime in the
+// new image is mtime. Both entry lists are sorted by name.
+func (c *converter) diffDirectory(dir string, mtime time.Time, baseEntries, entries []compactext4.DirEntry) error {
+	i, j := 0, 0
+	for i < len(baseEntries) || j < len(entries) {
+		var err error
+		switch {
+		case j == len(entries) || (i < len(baseEntries) && baseEntries[i].Name < entries[j].Name):
+			err = c.writeWhiteout(path.Join(dir, baseEntries[i].Name), mtime)
+			i++
+		case i == len(baseEntries) || entries[j].Name < baseEntries[i].Name:
+			err = c.writeTree(path.Join(dir, entries[j].Name), entries[j])
+			j++
+		default:
+			err = c.diffEntry(path.Join(dir, entries[j].Name), entries[j])
+			i++
+			j++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntry writes the changes to name, which exists in both images.
+func (c *converter) diffEntry(name string, e compactext4.DirEntry) error {
+	bf, err := c.base.Stat(name)
+	if err != nil {
+		return err
+	}
+	f, err := c.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	changed, err := c.changed(name, bf, f)
+	if err != nil {
+		return err
+	}
+	if bf.Mode&compactext4.TypeMask != compactext4.S_IFDIR || f.Mode&compactext4.TypeMask != compactext4.S_IFDIR {
+		if !changed {
+			if _, ok := c.inodes[e.Inode]; !ok {
+				// Later links to this file can refer to this path, which
+				// already exists in the base.
+				c.inodes[e.Inode] = name
+			}
+			return nil
+		}
+		// Writing the new entry replaces the old one, whatever its type.
+		return c.writeTree(name, e)
+	}
+
+	baseEntries, entries, err := c.readDirs(name)
+	if err != nil {
+		return err
+	}
+	xattrOpaque := c.p.convertWhiteout && bytes.Equal(f.Xattrs[opaqueXattr], []byte("y"))
+	if xattrOpaque || replaced(baseEntries, entries) {
+		// writeEntry writes the opaque whiteout itself for overlay-style
+		// opaque directories.
+		if err := c.writeEntry(name, e); err != nil {
+			return err
+		}
+		if !xattrOpaque {
+			if err := c.tw.WriteHeader(&tar.Header{
+				Name:     path.Join(name, opaqueWhiteout),
+				Typeflag: tar.TypeReg,
+				ModTime:  f.Mtime,
+				Format:   tar.FormatPAX,
+			}); err != nil {
+				return err
+			}
+		}
+		return c.writeDirectory(name)
+	}
+	if changed {
+		if err := c.writeEntry(name, e); err != nil {
+			return err
+		}
+	}
+	return c.diffDirectory(name, f.Mtime, baseEntries, entries)
+}
+
+// replaced reports whether none of the entries of a non-empty base directory
+// remain in the new one, in which case an opaque whiteout is smaller than
+// whiting out each entry.
+func replaced(baseEntries, entries []compactext4.DirEntry) bool {
+	if len(baseEntries) == 0 {
+		return false
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	for _, e := range baseEntries {
+		if names[e.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTree writes name and, if it is a directory, everything beneath it.
+func (c *converter) writeTree(name string, e compactext4.DirEntry) error {
+	if err := c.writeEntry(name, e); err != nil {
+		return err
+	}
+	if e.Mode == compactext4.S_IFDIR {
+		return c.writeDirectory(name)
+	}
+	return nil
+}
+
+// writeWhiteout writes a whiteout for the deleted path name.
+func (c *converter) writeWhiteout(name string, mtime time.Time) error {
+	dir, base := path.Split(name)
+	return c.tw.WriteHeader(&tar.Header{
+		Name:     path.Join(dir, whiteoutPrefix+base),
+		Typeflag: tar.TypeReg,
+		ModTime:  mtime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+// changed reports whether name differs between the base image, where it is
+// described by bf, and the new image, where it is described by f. The
+// contents of directories are not considered.
+func (c *converter) changed(name string, bf, f *compactext4.File) (bool, error) {
+	if bf.Mode != f.Mode ||
+		bf.Uid != f.Uid ||
+		bf.Gid != f.Gid ||
+		!bf.Mtime.Equal(f.Mtime) ||
+		bf.Linkname != f.Linkname ||
+		bf.Devmajor != f.Devmajor ||
+		bf.Devminor != f.Devminor ||
+		!xattrsEqual(bf.Xattrs, f.Xattrs) {
+		return true, nil
+	}
+	if f.Mode&compactext4.TypeMask != compactext4.S_IFREG {
+		return false, nil
+	}
+	if bf.Size != f.Size {
+		return true, nil
+	}
+	if !c.p.compareContents {
+		return false, nil
+	}
+	baseHash, err := hashFile(c.base, name)
+	if err != nil {
+		return false, err
+	}
+	hash, err := hashFile(c.fs, name)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(baseHash, hash), nil
+}
+
+func xattrsEqual(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func hashFile(fs *compactext4.Reader, name string) ([]byte, error) {
+	r, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
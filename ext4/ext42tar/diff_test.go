@@ -0,0 +1,133 @@
+package ext42tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
+)
+
+func makeImage(t *testing.T, entries []testEntry) *os.File {
+	mtime := time.Unix(1500000000, 0)
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.ModTime = mtime
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "ext42tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tar2ext4.Convert(&in, f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestDiff(t *testing.T) {
+	dir := tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}
+	base := makeImage(t, []testEntry{
+		{hdr: dir},
+		{hdr: tar.Header{Name: "dir/deleted", Typeflag: tar.TypeReg, Mode: 0644}, data: "deleted"},
+		{hdr: tar.Header{Name: "dir/modified", Typeflag: tar.TypeReg, Mode: 0644}, data: "old"},
+		{hdr: tar.Header{Name: "dir/chmod", Typeflag: tar.TypeReg, Mode: 0644}, data: "chmod"},
+		{hdr: tar.Header{Name: "dir/same", Typeflag: tar.TypeReg, Mode: 0644}, data: "same"},
+		{hdr: tar.Header{Name: "dir/samesize", Typeflag: tar.TypeReg, Mode: 0644}, data: "abc"},
+		{hdr: tar.Header{Name: "replaced/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "replaced/x", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: tar.Header{Name: "replaced/y", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: tar.Header{Name: "typechange", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: tar.Header{Name: "unchanged/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "unchanged/file", Typeflag: tar.TypeReg, Mode: 0644}, data: "file"},
+	})
+	defer os.Remove(base.Name())
+	defer base.Close()
+	upper := makeImage(t, []testEntry{
+		{hdr: dir},
+		{hdr: tar.Header{Name: "dir/added", Typeflag: tar.TypeReg, Mode: 0644}, data: "added"},
+		{hdr: tar.Header{Name: "dir/modified", Typeflag: tar.TypeReg, Mode: 0644}, data: "new data"},
+		{hdr: tar.Header{Name: "dir/chmod", Typeflag: tar.TypeReg, Mode: 0600}, data: "chmod"},
+		{hdr: tar.Header{Name: "dir/same", Typeflag: tar.TypeReg, Mode: 0644}, data: "same"},
+		{hdr: tar.Header{Name: "dir/samesize", Typeflag: tar.TypeReg, Mode: 0644}, data: "xyz"},
+		{hdr: tar.Header{Name: "dir/zlink", Typeflag: tar.TypeLink, Linkname: "dir/same"}},
+		{hdr: tar.Header{Name: "replaced/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "replaced/z", Typeflag: tar.TypeReg, Mode: 0644}},
+		{hdr: tar.Header{Name: "typechange/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "typechange/child", Typeflag: tar.TypeSymlink, Linkname: "x", Mode: 0777}},
+		{hdr: tar.Header{Name: "unchanged/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "unchanged/file", Typeflag: tar.TypeReg, Mode: 0644}, data: "file"},
+	})
+	defer os.Remove(upper.Name())
+	defer upper.Close()
+
+	expected := []tar.Header{
+		{Name: "dir/added", Typeflag: tar.TypeReg},
+		{Name: "dir/chmod", Typeflag: tar.TypeReg},
+		{Name: "dir/.wh.deleted", Typeflag: tar.TypeReg},
+		{Name: "dir/modified", Typeflag: tar.TypeReg},
+		{Name: "dir/zlink", Typeflag: tar.TypeLink, Linkname: "dir/same"},
+		{Name: "replaced/", Typeflag: tar.TypeDir},
+		{Name: "replaced/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "replaced/z", Typeflag: tar.TypeReg},
+		{Name: "typechange/", Typeflag: tar.TypeDir},
+		{Name: "typechange/child", Typeflag: tar.TypeSymlink, Linkname: "x"},
+	}
+	withContents := append(expected[:4:4], append([]tar.Header{{Name: "dir/samesize", Typeflag: tar.TypeReg}}, expected[4:]...)...)
+
+	tests := []struct {
+		name     string
+		options  []Option
+		expected []tar.Header
+	}{
+		{"metadata", nil, expected},
+		{"contents", []Option{CompareContents}, withContents},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := Diff(base, upper, &out, test.options...); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		tr := tar.NewReader(&out)
+		var got []*tar.Header
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, hdr)
+		}
+		if len(got) != len(test.expected) {
+			for _, hdr := range got {
+				t.Logf("%s: got %s", test.name, hdr.Name)
+			}
+			t.Errorf("%s: expected %d entries, got %d", test.name, len(test.expected), len(got))
+			continue
+		}
+		for i, e := range test.expected {
+			if got[i].Name != e.Name || got[i].Typeflag != e.Typeflag || got[i].Linkname != e.Linkname {
+				t.Errorf("%s: entry %d: expected %s (%c), got %s (%c)", test.name, i, e.Name, e.Typeflag, got[i].Name, got[i].Typeflag)
+			}
+		}
+	}
+}
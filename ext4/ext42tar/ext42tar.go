@@ -0,0 +1,207 @@
+package ext42tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+)
+
+type params struct {
+	convertWhiteout bool
+	compareContents bool
+}
+
+// Option is the type for optional parameters to Convert and Diff.
+type Option func(*params)
+
+// ConvertWhiteout instructs the converter to convert overlay-style whiteouts
+// (0/0 character devices and directories with the trusted.overlay.opaque
+// xattr) to OCI-style whiteouts (beginning with .wh.).
+func ConvertWhiteout(p *params) {
+	p.convertWhiteout = true
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+	xattrPrefix    = "SCHILY.xattr."
+	lostAndFound   = "lost+found"
+
+	vhdFooterSize  = 512
+	vhdCookieMagic = "conectix"
+)
+
+// StripVhdFooter returns a reader over the first size bytes of r, excluding
+// the fixed VHD footer if one is present.
+func StripVhdFooter(r io.ReaderAt, size int64) *io.SectionReader {
+	if size >= vhdFooterSize {
+		var cookie [len(vhdCookieMagic)]byte
+		if _, err := r.ReadAt(cookie[:], size-vhdFooterSize); err == nil && string(cookie[:]) == vhdCookieMagic {
+			size -= vhdFooterSize
+		}
+	}
+	return io.NewSectionReader(r, 0, size)
+}
+
+type converter struct {
+	p      *params
+	fs     *compactext4.Reader
+	base   *compactext4.Reader // for Diff only
+	tw     *tar.Writer
+	inodes map[uint32]string // paths of files with multiple links, by inode
+}
+
+// Convert writes a tar stream to w that contains the files in the ext4 file
+// system image read from r.
+func Convert(r io.ReaderAt, w io.Writer, options ...Option) error {
+	var p params
+	for _, opt := range options {
+		opt(&p)
+	}
+	fs, err := compactext4.NewReader(r)
+	if err != nil {
+		return err
+	}
+	c := &converter{
+		p:      &p,
+		fs:     fs,
+		tw:     tar.NewWriter(w),
+		inodes: make(map[uint32]string),
+	}
+	if err := c.writeDirectory(""); err != nil {
+		return err
+	}
+	return c.tw.Close()
+}
+
+func (c *converter) writeDirectory(dir string) error {
+	entries, err := c.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name)
+		if isEmptyLostAndFound(c.fs, name) {
+			continue
+		}
+		if err := c.writeEntry(name, e); err != nil {
+			return err
+		}
+		if e.Mode == compactext4.S_IFDIR {
+			if err := c.writeDirectory(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isEmptyLostAndFound reports whether name is an empty lost+found directory in
+// the root of fs. These are created by mkfs or tar2ext4 rather than being part
+// of the layer.
+func isEmptyLostAndFound(fs *compactext4.Reader, name string) bool {
+	if name != lostAndFound {
+		return false
+	}
+	children, err := fs.ReadDir(name)
+	return err == nil && len(children) == 0
+}
+
+func (c *converter) writeEntry(name string, e compactext4.DirEntry) error {
+	f, err := c.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	typ := f.Mode & compactext4.TypeMask
+	hdr := &tar.Header{
+		Name:       name,
+		Mode:       int64(f.Mode &^ compactext4.TypeMask),
+		Uid:        int(f.Uid),
+		Gid:        int(f.Gid),
+		ModTime:    f.Mtime,
+		AccessTime: f.Atime,
+		ChangeTime: f.Ctime,
+		Format:     tar.FormatPAX,
+	}
+
+	if c.p.convertWhiteout && typ == compactext4.S_IFCHR && f.Devmajor == 0 && f.Devminor == 0 {
+		dir, base := path.Split(name)
+		hdr.Name = path.Join(dir, whiteoutPrefix+base)
+		hdr.Typeflag = tar.TypeReg
+		return c.tw.WriteHeader(hdr)
+	}
+
+	if typ != compactext4.S_IFDIR {
+		if target, ok := c.inodes[e.Inode]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = target
+			hdr.Mode = 0
+			return c.tw.WriteHeader(hdr)
+		}
+		c.inodes[e.Inode] = name
+	}
+
+	opaque := false
+	for xname, value := range f.Xattrs {
+		if c.p.convertWhiteout && xname == opaqueXattr {
+			opaque = typ == compactext4.S_IFDIR && bytes.Equal(value, []byte("y"))
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[xattrPrefix+xname] = string(value)
+	}
+
+	var data io.Reader
+	switch typ {
+	case compactext4.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = f.Size
+		data, err = c.fs.Open(name)
+		if err != nil {
+			return err
+		}
+	case compactext4.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case compactext4.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = f.Linkname
+	case compactext4.S_IFCHR:
+		hdr.Typeflag = tar.TypeChar
+		hdr.Devmajor = int64(f.Devmajor)
+		hdr.Devminor = int64(f.Devminor)
+	case compactext4.S_IFBLK:
+		hdr.Typeflag = tar.TypeBlock
+		hdr.Devmajor = int64(f.Devmajor)
+		hdr.Devminor = int64(f.Devminor)
+	case compactext4.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		// Sockets cannot be represented in a tar stream.
+		return nil
+	}
+
+	if err := c.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if data != nil {
+		if _, err := io.Copy(c.tw, data); err != nil {
+			return err
+		}
+	}
+	if opaque {
+		return c.tw.WriteHeader(&tar.Header{
+			Name:     path.Join(name, opaqueWhiteout),
+			Typeflag: tar.TypeReg,
+			ModTime:  f.Mtime,
+			Format:   tar.FormatPAX,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package ext42tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
+)
+
+type testEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func TestRoundTrip(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000}, data: "hello"},
+		{hdr: tar.Header{Name: "dir/large", Typeflag: tar.TypeReg, Mode: 0600}, data: string(bytes.Repeat([]byte("0123456789"), 1000))},
+		{hdr: tar.Header{Name: "dir/link", Typeflag: tar.TypeLink, Linkname: "dir/file"}},
+		{hdr: tar.Header{Name: "dir/symlink", Typeflag: tar.TypeSymlink, Linkname: "file", Mode: 0777}},
+		{hdr: tar.Header{Name: "dir/.wh.deleted", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "opaque/", Typeflag: tar.TypeDir, Mode: 0700}},
+		{hdr: tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "xattr", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}}},
+		{hdr: tar.Header{Name: "chr", Typeflag: tar.TypeChar, Mode: 0600, Devmajor: 1, Devminor: 3}},
+	}
+
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.ModTime = mtime
+		hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "ext42tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := tar2ext4.Convert(&in, f, tar2ext4.ConvertWhiteout, tar2ext4.AppendVhdFooter); err != nil {
+		t.Fatal(err)
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Convert(StripVhdFooter(f, size), &out, ConvertWhiteout); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&out)
+	got := make(map[string]testEntry)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = testEntry{hdr: *hdr, data: string(data)}
+	}
+
+	if len(got) != len(entries) {
+		t.Errorf("expected %d entries, got %d", len(entries), len(got))
+	}
+	for _, e := range entries {
+		g, ok := got[e.hdr.Name]
+		if !ok {
+			t.Errorf("%s: missing", e.hdr.Name)
+			continue
+		}
+		if g.hdr.Typeflag != e.hdr.Typeflag ||
+			g.hdr.Linkname != e.hdr.Linkname ||
+			g.hdr.Mode != e.hdr.Mode ||
+			g.hdr.Devmajor != e.hdr.Devmajor ||
+			g.hdr.Devminor != e.hdr.Devminor ||
+			g.data != e.data {
+			t.Errorf("%s: mismatch, expected %+v got %+v", e.hdr.Name, e.hdr, g.hdr)
+		}
+		if strings.Contains(e.hdr.Name, whiteoutPrefix) || e.hdr.Typeflag == tar.TypeLink {
+			// Whiteouts and hard links do not carry their own metadata.
+			continue
+		}
+		if g.hdr.Uid != e.hdr.Uid || g.hdr.Gid != e.hdr.Gid || !g.hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: metadata mismatch, expected %+v got %+v", e.hdr.Name, e.hdr, g.hdr)
+		}
+		for key, value := range e.hdr.PAXRecords {
+			if g.hdr.PAXRecords[key] != value {
+				t.Errorf("%s: missing PAX record %s", e.hdr.Name, key)
+			}
+		}
+	}
+}
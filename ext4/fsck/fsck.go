@@ -0,0 +1,39 @@
+// Package fsck checks the consistency of ext4 file system images without
+// mounting them or running e2fsck.
+package fsck
+
+import (
+	"io"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+)
+
+// A Finding describes one inconsistency found by Verify.
+type Finding = compactext4.Finding
+
+// FindingKind classifies the problems reported by Verify.
+type FindingKind = compactext4.FindingKind
+
+const (
+	FindingSuperBlock      = compactext4.FindingSuperBlock
+	FindingGroupDescriptor = compactext4.FindingGroupDescriptor
+	FindingBitmap          = compactext4.FindingBitmap
+	FindingInode           = compactext4.FindingInode
+	FindingLinkCount       = compactext4.FindingLinkCount
+	FindingDirectory       = compactext4.FindingDirectory
+	FindingXattr           = compactext4.FindingXattr
+	FindingChecksum        = compactext4.FindingChecksum
+)
+
+// Verify checks the ext4 file system image read from r. It cross-checks the
+// superblock and group descriptor counts, the block and inode bitmaps against
+// the blocks and inodes actually in use, inode link counts against directory
+// references, directory entries and indexes, extended attribute hashes and
+// metadata checksums.
+//
+// A file system with no findings is consistent. An error is returned only if
+// the image cannot be read or is not a supported ext4 file system. To check a
+// file system inside a VHD or VHDX, open the disk with ext4/vhd.Open first.
+func Verify(r io.ReaderAt) ([]Finding, error) {
+	return compactext4.Verify(r)
+}
@@ -0,0 +1,89 @@
+package compactext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+// Linux passes POSIX ACLs to and from user space in a generic xattr format,
+// which is what getxattr(2) returns and what tar stores in SCHILY.xattr PAX
+// records. ext4 stores them in a more compact format. File.Xattrs always uses
+// the generic format.
+
+const (
+	aclXattrVersion   uint32 = 2 // POSIX_ACL_XATTR_VERSION
+	aclUndefinedID    uint32 = 0xffffffff
+	aclXattrEntrySize        = 8
+)
+
+func isACLXattr(name string) bool {
+	return name == "system.posix_acl_access" || name == "system.posix_acl_default"
+}
+
+// encodeACL converts an ACL from the generic xattr format to the ext4 format.
+func encodeACL(b []byte) ([]byte, error) {
+	if len(b) < 4 || (len(b)-4)%aclXattrEntrySize != 0 {
+		return nil, errors.New("invalid ACL size")
+	}
+	if v := binary.LittleEndian.Uint32(b); v != aclXattrVersion {
+		return nil, fmt.Errorf("unsupported ACL version %d", v)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, format.ACLVersion)
+	for e := b[4:]; len(e) != 0; e = e[aclXattrEntrySize:] {
+		tag := format.ACLTag(binary.LittleEndian.Uint16(e))
+		perm := binary.LittleEndian.Uint16(e[2:])
+		switch tag {
+		case format.ACLUser, format.ACLGroup:
+			id := binary.LittleEndian.Uint32(e[4:])
+			binary.Write(&buf, binary.LittleEndian, format.ACLEntry{Tag: tag, Perm: perm, ID: id})
+		case format.ACLUserObj, format.ACLGroupObj, format.ACLMask, format.ACLOther:
+			binary.Write(&buf, binary.LittleEndian, format.ACLEntryShort{Tag: tag, Perm: perm})
+		default:
+			return nil, fmt.Errorf("invalid ACL tag %#x", tag)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeACL converts an ACL from the ext4 format to the generic xattr format.
+func decodeACL(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, errors.New("invalid ACL size")
+	}
+	if v := binary.LittleEndian.Uint32(b); v != format.ACLVersion {
+		return nil, fmt.Errorf("unsupported ACL version %d", v)
+	}
+	out := make([]byte, 4, len(b)*2)
+	binary.LittleEndian.PutUint32(out, aclXattrVersion)
+	for e := b[4:]; len(e) != 0; {
+		if len(e) < 4 {
+			return nil, errors.New("truncated ACL entry")
+		}
+		tag := format.ACLTag(binary.LittleEndian.Uint16(e))
+		perm := binary.LittleEndian.Uint16(e[2:])
+		id := aclUndefinedID
+		switch tag {
+		case format.ACLUser, format.ACLGroup:
+			if len(e) < 8 {
+				return nil, errors.New("truncated ACL entry")
+			}
+			id = binary.LittleEndian.Uint32(e[4:])
+			e = e[8:]
+		case format.ACLUserObj, format.ACLGroupObj, format.ACLMask, format.ACLOther:
+			e = e[4:]
+		default:
+			return nil, fmt.Errorf("invalid ACL tag %#x", tag)
+		}
+		var entry [aclXattrEntrySize]byte
+		binary.LittleEndian.PutUint16(entry[:], uint16(tag))
+		binary.LittleEndian.PutUint16(entry[2:], perm)
+		binary.LittleEndian.PutUint32(entry[4:], id)
+		out = append(out, entry[:]...)
+	}
+	return out, nil
+}
@@ -0,0 +1,62 @@
+package compactext4
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c continues a CRC32C computation the way the Linux kernel does, without
+// the pre- and post-inversion that hash/crc32 applies.
+func crc32c(crc uint32, b []byte) uint32 {
+	return ^crc32.Update(^crc, crc32cTable, b)
+}
+
+// Offsets of checksum fields within on-disk structures.
+const (
+	superBlockChecksumOffset      = 0x3fc
+	groupDescriptorChecksumOffset = 0x1e
+	inodeChecksumLowOffset        = 0x7c
+	inodeChecksumHighOffset       = 0x82
+	xattrBlockChecksumOffset      = 0x10
+	directoryTailSize             = 12
+	directoryTailFileType         = 0xde
+)
+
+// superBlockChecksum returns the checksum of the encoded superblock b.
+func superBlockChecksum(b []byte) uint32 {
+	return crc32c(^uint32(0), b[:superBlockChecksumOffset])
+}
+
+// groupDescriptorChecksum returns the checksum of the encoded group descriptor
+// b for group g. The checksum field in b must be zero.
+func (w *Writer) groupDescriptorChecksum(g uint32, b []byte) uint16 {
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], g)
+	return uint16(crc32c(crc32c(w.csumSeed, n[:]), b))
+}
+
+// bitmapChecksum returns the checksum of a block or inode bitmap.
+func (w *Writer) bitmapChecksum(b []byte) uint32 {
+	return crc32c(w.csumSeed, b)
+}
+
+// inodeChecksumSeed returns the seed used for the checksums of an inode and of
+// the blocks that belong to it.
+func (w *Writer) inodeChecksumSeed(ino format.InodeNumber) uint32 {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(ino))
+	// The generation number in b[4:] is always zero.
+	return crc32c(w.csumSeed, b[:])
+}
+
+// xattrBlockChecksum returns the checksum of the xattr block b written at the
+// given block number. The checksum field in b must be zero.
+func (w *Writer) xattrBlockChecksum(block uint32, b []byte) uint32 {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(block))
+	return crc32c(crc32c(w.csumSeed, n[:]), b)
+}
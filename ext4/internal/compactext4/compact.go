@@ -3,6 +3,7 @@ package compactext4
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -22,13 +23,39 @@ type Writer struct {
 	inodes               []*inode
 	curName              string
 	curInode             *inode
+	curBlocks            uint32   // logical blocks of curInode's data written so far
+	curExtents           []extent // data extents of curInode
+	partialBlock         []byte
+	partial              int // bytes buffered in partialBlock
 	pos                  int64
 	dataWritten, dataMax int64
 	err                  error
 	initialized          bool
 	supportInlineData    bool
+	expandDisk           bool
+	deterministic        bool
+	sparse               bool
+	metadataCsum         bool
+	is64Bit              bool
 	maxDiskSize          int64
+	blockSize            uint32
+	blocksPerGroup       uint32
+	firstDataBlock       uint32 // 1 for 1K blocks, where the superblock fills block 1
+	inodeSize            uint32
+	bytesPerInode        int64
+	minInodes            uint32
+	reservedPercent      int
+	journal              bool
+	journalSize          int64
 	gdBlocks             uint32
+	uuid                 [16]byte
+	csumSeed             uint32
+	free                 []blockRange // freed data blocks, sorted by Start
+	resumeBlock          uint32       // where to continue after writing into a freed range, or 0
+}
+
+type blockRange struct {
+	Start, Count uint32
 }
 
 // Mode flags for Linux files.
@@ -65,6 +92,7 @@ type inode struct {
 	LinkCount                   uint32
 	XattrBlock                  uint32
 	BlockCount                  uint32
+	DataBlock, DataBlockCount   uint32 // data and extent tree blocks
 	Devmajor, Devminor          uint32
 	Flags                       format.InodeFlag
 	Data                        []byte
@@ -95,28 +123,27 @@ const (
 	inodeFirst        = 11
 	inodeLostAndFound = inodeFirst
 
-	blockSize               = 4096
-	blocksPerGroup          = blockSize * 8
-	inodeSize               = 256
-	maxInodesPerGroup       = blockSize * 8 // Limited by the inode bitmap
-	inodesPerGroupIncrement = blockSize / inodeSize
+	defaultBlockSize     = 4096
+	maxBlockSize         = 4096
+	defaultInodeSize     = 256
+	smallInodeSize       = 128       // inodes without the extra fields
+	defaultBytesPerInode = 16 * 1024 // inode density for expanded disks, matching mke2fs
+	maxReservedPercent   = 50
 
 	defaultMaxDiskSize = 16 * 1024 * 1024 * 1024        // 16GB
 	maxMaxDiskSize     = 16 * 1024 * 1024 * 1024 * 1024 // 16TB
 
-	groupDescriptorSize      = 32 // Use the small group descriptor
-	groupsPerDescriptorBlock = blockSize / groupDescriptorSize
+	groupDescriptorSize   = 32 // The small group descriptor
+	groupDescriptorSize64 = 64 // The group descriptor used with the 64bit feature
 
 	maxFileSize             = 128 * 1024 * 1024 * 1024 // 128GB file size maximum for now
 	smallSymlinkSize        = 59                       // max symlink size that goes directly in the inode
 	maxBlocksPerExtent      = 0x8000                   // maximum number of blocks in an extent
 	inodeDataSize           = 60
-	inodeUsedSize           = 152 // fields through CrtimeExtra
-	inodeExtraSize          = inodeSize - inodeUsedSize
+	inodeUsedSize           = 152                         // fields through CrtimeExtra
 	xattrInodeOverhead      = 4 + 4                       // magic number + empty next entry value
 	xattrBlockOverhead      = 32 + 4                      // header + empty next entry value
 	inlineDataXattrOverhead = xattrInodeOverhead + 16 + 4 // entry + "data"
-	inlineDataSize          = inodeDataSize + inodeExtraSize - inlineDataXattrOverhead
 )
 
 type exceededMaxSizeError struct {
@@ -128,7 +155,7 @@ func (err exceededMaxSizeError) Error() string {
 }
 
 var directoryEntrySize = binary.Size(format.DirectoryEntry{})
-var extraIsize = uint16(inodeUsedSize - 128)
+var extraIsize = uint16(inodeUsedSize - smallInodeSize)
 
 type directory map[string]*inode
 
@@ -250,8 +277,10 @@ type xattrState struct {
 	inodeLeft, blockLeft int
 }
 
-func (s *xattrState) init() {
-	s.inodeLeft = inodeExtraSize - xattrInodeOverhead
+func (s *xattrState) init(inodeExtraSize, blockSize int) {
+	if inodeExtraSize > 0 {
+		s.inodeLeft = inodeExtraSize - xattrInodeOverhead
+	}
 	s.blockLeft = blockSize - xattrBlockOverhead
 }
 
@@ -294,30 +323,50 @@ func putXattrs(xattrs []xattr, b []byte, offsetDelta uint16) {
 	}
 }
 
-func getXattrs(b []byte, xattrs map[string][]byte, offsetDelta uint16) {
+func getXattrs(b []byte, xattrs map[string][]byte, offsetDelta uint16) error {
 	eb := b
-	for len(eb) != 0 {
+	// The list ends with four zero bytes. The name alone may be empty, as for
+	// system.posix_acl_access.
+	for len(eb) >= 4 && binary.LittleEndian.Uint32(eb) != 0 {
 		nameLen := eb[0]
-		if nameLen == 0 {
-			break
+		if len(eb) < 16+int(nameLen) {
+			return errors.New("xattr entry out of bounds")
 		}
 		index := eb[1]
-		offset := binary.LittleEndian.Uint16(eb[2:]) - offsetDelta
+		offset := uint32(binary.LittleEndian.Uint16(eb[2:])) - uint32(offsetDelta)
+		if binary.LittleEndian.Uint32(eb[4:]) != 0 {
+			return errors.New("xattr values stored in inodes are not supported")
+		}
 		valueLen := binary.LittleEndian.Uint32(eb[8:])
+		if offset > uint32(len(b)) || valueLen > uint32(len(b))-offset {
+			return errors.New("xattr value out of bounds")
+		}
 		attr := xattr{
 			Index: index,
 			Name:  string(eb[16 : 16+nameLen]),
-			Value: b[offset : uint32(offset)+valueLen],
+			Value: b[offset : offset+valueLen],
+		}
+		name := decompressXattrName(index, attr.Name)
+		value := attr.Value
+		if isACLXattr(name) {
+			var err error
+			if value, err = decodeACL(value); err != nil {
+				return fmt.Errorf("xattr %s: %s", name, err)
+			}
+		}
+		xattrs[name] = value
+		if attr.EntryLen() > len(eb) {
+			break
 		}
-		xattrs[decompressXattrName(index, attr.Name)] = attr.Value
 		eb = eb[attr.EntryLen():]
 	}
+	return nil
 }
 
 func (w *Writer) writeXattrs(inode *inode, state *xattrState) error {
 	// Write the inline attributes.
 	if len(state.inode) != 0 {
-		inode.XattrInline = make([]byte, inodeExtraSize)
+		inode.XattrInline = make([]byte, w.inodeExtraSize())
 		binary.LittleEndian.PutUint32(inode.XattrInline[0:], format.XAttrHeaderMagic) // Magic
 		putXattrs(state.inode, inode.XattrInline[4:], 0)
 	}
@@ -331,7 +380,7 @@ func (w *Writer) writeXattrs(inode *inode, state *xattrState) error {
 				state.block[i].Name < state.block[j].Name
 		})
 
-		var b [blockSize]byte
+		b := make([]byte, w.blockSize)
 		binary.LittleEndian.PutUint32(b[0:], format.XAttrHeaderMagic) // Magic
 		binary.LittleEndian.PutUint32(b[4:], 1)                       // ReferenceCount
 		binary.LittleEndian.PutUint32(b[8:], 1)                       // Blocks
@@ -346,6 +395,10 @@ func (w *Writer) writeXattrs(inode *inode, state *xattrState) error {
 			w.seekBlock(inode.XattrBlock)
 			defer w.seekBlock(orig)
 		}
+		if w.metadataCsum {
+			csum := w.xattrBlockChecksum(inode.XattrBlock, b[:])
+			binary.LittleEndian.PutUint32(b[xattrBlockChecksumOffset:], csum)
+		}
 
 		if _, err := w.write(b[:]); err != nil {
 			return err
@@ -383,6 +436,34 @@ func (w *Writer) zero(n int64) (int64, error) {
 	return n, err
 }
 
+// skip advances past n bytes that should read as zero. If the underlying file
+// has been truncated, this seeks rather than writing zeros so that the
+// skipped region is left sparse.
+func (w *Writer) skip(n int64) error {
+	if !w.sparse {
+		_, err := w.zero(n)
+		return err
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.pos+n > w.maxDiskSize {
+		w.err = exceededMaxSizeError{w.maxDiskSize}
+		return w.err
+	}
+	w.err = w.bw.Flush()
+	if w.err != nil {
+		return w.err
+	}
+	w.pos += n
+	_, w.err = w.f.Seek(w.pos, io.SeekStart)
+	return w.err
+}
+
+type truncater interface {
+	Truncate(size int64) error
+}
+
 func (w *Writer) makeInode(f *File, node *inode) (*inode, error) {
 	mode := f.Mode
 	if mode&format.TypeMask == 0 {
@@ -399,9 +480,10 @@ func (w *Writer) makeInode(f *File, node *inode) (*inode, error) {
 			node.LinkCount = 1 // A directory is linked to itself.
 		}
 	} else if node.Flags&format.InodeFlagExtents != 0 {
-		// Since we cannot deallocate or reuse blocks, don't allow updates that
-		// would invalidate data that has already been written.
-		return nil, errors.New("cannot overwrite file with non-inline data")
+		// Release the old data so that its blocks can be reused.
+		w.freeBlocks(node.DataBlock, node.DataBlockCount)
+		node.BlockCount -= node.DataBlockCount
+		node.DataBlock, node.DataBlockCount = 0, 0
 	}
 	node.Mode = mode
 	node.Uid = f.Uid
@@ -417,7 +499,7 @@ func (w *Writer) makeInode(f *File, node *inode) (*inode, error) {
 	node.XattrInline = nil
 
 	var xstate xattrState
-	xstate.init()
+	xstate.init(w.inodeExtraSize(), int(w.blockSize))
 
 	var size int64
 	switch typ {
@@ -426,7 +508,7 @@ func (w *Writer) makeInode(f *File, node *inode) (*inode, error) {
 		if f.Size > maxFileSize {
 			return nil, fmt.Errorf("file too big: %d > %d", f.Size, int64(maxFileSize))
 		}
-		if f.Size <= inlineDataSize && w.supportInlineData {
+		if f.Size <= w.inlineDataSize() && w.supportInlineData {
 			node.Data = make([]byte, f.Size)
 			extra := 0
 			if f.Size > inodeDataSize {
@@ -461,7 +543,14 @@ func (w *Writer) makeInode(f *File, node *inode) (*inode, error) {
 		}
 		sort.Strings(xattrs)
 		for _, name := range xattrs {
-			if !xstate.addXattr(name, f.Xattrs[name]) {
+			value := f.Xattrs[name]
+			if isACLXattr(name) {
+				var err error
+				if value, err = encodeACL(value); err != nil {
+					return nil, fmt.Errorf("xattr %s: %s", name, err)
+				}
+			}
+			if !xstate.addXattr(name, value) {
 				return nil, fmt.Errorf("could not fit xattr %s", name)
 			}
 		}
@@ -556,6 +645,9 @@ func (w *Writer) Create(name string, f *File) error {
 	}
 	if child.Mode&format.TypeMask == format.S_IFREG {
 		w.startInode(name, child, f.Size)
+		if child.Flags&format.InodeFlagInlineData == 0 {
+			w.useFreeBlocks(f.Size)
+		}
 	}
 	return nil
 }
@@ -618,33 +710,110 @@ func (w *Writer) Stat(name string) (*File, error) {
 	f.Xattrs = make(map[string][]byte)
 	if node.XattrBlock != 0 || len(node.XattrInline) != 0 {
 		if node.XattrBlock != 0 {
-			orig := w.block()
-			w.seekBlock(node.XattrBlock)
-			if w.err != nil {
-				return nil, w.err
+			b := make([]byte, w.blockSize)
+			if err := w.readBlocks(node.XattrBlock, b); err != nil {
+				return nil, err
 			}
-			var b [blockSize]byte
-			_, err := w.f.Read(b[:])
-			w.seekBlock(orig)
-			if err != nil {
+			if err := getXattrs(b[32:], f.Xattrs, 32); err != nil {
 				return nil, err
 			}
-			getXattrs(b[32:], f.Xattrs, 32)
 		}
 		if len(node.XattrInline) != 0 {
-			getXattrs(node.XattrInline[4:], f.Xattrs, 0)
+			if err := getXattrs(node.XattrInline[4:], f.Xattrs, 0); err != nil {
+				return nil, err
+			}
 			delete(f.Xattrs, "system.data")
 		}
 	}
 	if node.FileType() == S_IFLNK {
 		if node.Size > smallSymlinkSize {
-			return nil, fmt.Errorf("%s: cannot retrieve link information", name)
+			b := make([]byte, node.Size)
+			if err := w.readBlocks(node.DataBlock, b); err != nil {
+				return nil, err
+			}
+			f.Linkname = string(b)
+		} else {
+			f.Linkname = string(node.Data)
 		}
-		f.Linkname = string(node.Data)
 	}
 	return f, nil
 }
 
+// ReadDir returns the entries of a directory that has been written, sorted by
+// name.
+func (w *Writer) ReadDir(name string) ([]DirEntry, error) {
+	if err := w.finishInode(); err != nil {
+		return nil, err
+	}
+	_, node, _, err := w.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", name)
+	}
+	entries := make([]DirEntry, 0, len(node.Children))
+	for childname, child := range node.Children {
+		entries = append(entries, DirEntry{
+			Name:  childname,
+			Inode: uint32(child.Number),
+			Mode:  child.FileType(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// RemoveAll removes a file or directory and any children it contains. The
+// space used by files that no longer have any links is reused for subsequent
+// files where possible. Like os.RemoveAll, it returns nil if the file does not
+// exist.
+func (w *Writer) RemoveAll(name string) error {
+	if err := w.finishInode(); err != nil {
+		return err
+	}
+	if path.Clean("/"+name) == "/" {
+		return fmt.Errorf("%s: cannot remove the root directory", name)
+	}
+	dir, node, childname, err := w.lookup(name, false)
+	if err != nil || node == nil {
+		return nil
+	}
+	delete(dir.Children, childname)
+	if node.IsDir() {
+		dir.LinkCount--
+	}
+	w.unlink(node)
+	return w.err
+}
+
+// unlink drops a link to node, recursively unlinking the children of
+// directories, and releases node once nothing links to it.
+func (w *Writer) unlink(node *inode) {
+	node.LinkCount--
+	if node.IsDir() {
+		for _, child := range node.Children {
+			if child.IsDir() {
+				node.LinkCount--
+			}
+			w.unlink(child)
+		}
+		node.Children = nil
+		node.LinkCount-- // A directory is linked to itself.
+	}
+	if node.LinkCount == 0 {
+		if node.Flags&format.InodeFlagExtents != 0 {
+			w.freeBlocks(node.DataBlock, node.DataBlockCount)
+		}
+		if node.XattrBlock != 0 {
+			w.freeBlocks(node.XattrBlock, 1)
+		}
+		w.inodes[node.Number-1] = nil
+	}
+}
+
 func (w *Writer) Write(b []byte) (int, error) {
 	if len(b) == 0 {
 		return 0, nil
@@ -659,9 +828,58 @@ func (w *Writer) Write(b []byte) (int, error) {
 		return len(b), nil
 	}
 
-	n, err := w.write(b)
-	w.dataWritten += int64(n)
-	return n, err
+	// Data is written a block at a time so that blocks of zeros can be left
+	// as holes.
+	bs := int(w.blockSize)
+	n := 0
+	for n < len(b) {
+		if w.partial == 0 && len(b)-n >= bs {
+			if err := w.writeDataBlock(b[n : n+bs]); err != nil {
+				return n, err
+			}
+			n += bs
+			w.dataWritten += int64(bs)
+			continue
+		}
+		c := copy(w.partialBlock[w.partial:], b[n:])
+		w.partial += c
+		n += c
+		w.dataWritten += int64(c)
+		if w.partial == bs {
+			w.partial = 0
+			if err := w.writeDataBlock(w.partialBlock[:]); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+var zeroBlock [maxBlockSize]byte
+
+// writeDataBlock writes the next block of the current inode's data, adding it
+// to the inode's extents. Blocks of zeros in regular files are skipped,
+// leaving a hole, unless the data is being written into a freed range whose
+// size was reserved for contiguous data.
+func (w *Writer) writeDataBlock(b []byte) error {
+	logical := w.curBlocks
+	w.curBlocks++
+	if w.curInode.FileType() == S_IFREG && w.resumeBlock == 0 && bytes.Equal(b, zeroBlock[:len(b)]) {
+		return nil
+	}
+	phys := w.block()
+	if _, err := w.write(b); err != nil {
+		return err
+	}
+	if n := len(w.curExtents); n != 0 {
+		e := &w.curExtents[n-1]
+		if e.Block+e.Length == logical && e.Start+uint64(e.Length) == uint64(phys) && e.Length < maxBlocksPerExtent {
+			e.Length++
+			return nil
+		}
+	}
+	w.curExtents = append(w.curExtents, extent{Block: logical, Length: 1, Start: uint64(phys)})
+	return nil
 }
 
 func (w *Writer) startInode(name string, inode *inode, size int64) {
@@ -672,14 +890,78 @@ func (w *Writer) startInode(name string, inode *inode, size int64) {
 	w.curInode = inode
 	w.dataWritten = 0
 	w.dataMax = size
+	w.curBlocks = 0
+	w.curExtents = w.curExtents[:0]
+}
+
+// freeBlocks marks a range of blocks as no longer in use.
+func (w *Writer) freeBlocks(start, count uint32) {
+	if count == 0 {
+		return
+	}
+	w.free = append(w.free, blockRange{start, count})
+	sort.Slice(w.free, func(i, j int) bool {
+		return w.free[i].Start < w.free[j].Start
+	})
+	// Merge adjacent ranges.
+	merged := w.free[:1]
+	for _, r := range w.free[1:] {
+		last := &merged[len(merged)-1]
+		if last.Start+last.Count == r.Start {
+			last.Count += r.Count
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	w.free = merged
+}
+
+// useFreeBlocks positions the writer at the start of the first freed range
+// that can hold size bytes of file data and its extent tree. The position is
+// restored by finishInode.
+func (w *Writer) useFreeBlocks(size int64) {
+	if size == 0 {
+		return
+	}
+	blocks := uint32((size-1)/int64(w.blockSize) + 1)
+	needed := blocks + w.extentTreeBlocks(blocks)
+	for i := range w.free {
+		r := &w.free[i]
+		if r.Count >= needed {
+			w.resumeBlock = w.block()
+			w.seekBlock(r.Start)
+			r.Start += needed
+			r.Count -= needed
+			if r.Count == 0 {
+				w.free = append(w.free[:i], w.free[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// readBlocks reads data that has already been written, starting at the given
+// block.
+func (w *Writer) readBlocks(block uint32, b []byte) error {
+	orig := w.block()
+	w.seekBlock(block)
+	if w.err != nil {
+		return w.err
+	}
+	_, err := io.ReadFull(w.f, b)
+	w.seekBlock(orig)
+	if err != nil {
+		return err
+	}
+	return w.err
 }
 
 func (w *Writer) block() uint32 {
-	return uint32(w.pos / blockSize)
+	return uint32(w.pos / int64(w.blockSize))
 }
 
 func (w *Writer) seekBlock(block uint32) {
-	w.pos = int64(block) * blockSize
+	w.pos = int64(block) * int64(w.blockSize)
 	if w.err != nil {
 		return
 	}
@@ -690,107 +972,129 @@ func (w *Writer) seekBlock(block uint32) {
 	_, w.err = w.f.Seek(w.pos, io.SeekStart)
 }
 
-func (w *Writer) nextBlock() {
-	if w.pos%blockSize != 0 {
-		// Simplify callers; w.err is updated on failure.
-		w.zero(blockSize - w.pos%blockSize)
+const extentNodeSize = 12
+
+// extentsPerBlock returns the number of entries that fit in a non-root node of
+// the extent tree.
+func (w *Writer) extentsPerBlock() uint32 {
+	return w.blockSize/extentNodeSize - 1
+}
+
+// extentTreeBlocks returns the number of extent tree blocks needed to map the
+// given number of contiguous data blocks.
+func (w *Writer) extentTreeBlocks(blocks uint32) uint32 {
+	extents := (blocks + maxBlocksPerExtent - 1) / maxBlocksPerExtent
+	if extents <= 4 {
+		return 0
 	}
+	return (extents-1)/w.extentsPerBlock() + 1
 }
 
-func fillExtents(hdr *format.ExtentHeader, extents []format.ExtentLeafNode, startBlock, offset, inodeSize uint32) {
-	*hdr = format.ExtentHeader{
+// writeExtentBlock writes a non-root node of the extent tree containing
+// count entries.
+func (w *Writer) writeExtentBlock(inode *inode, depth uint16, count int, entries interface{}) error {
+	var b bytes.Buffer
+	hdr := format.ExtentHeader{
 		Magic:   format.ExtentHeaderMagic,
-		Entries: uint16(len(extents)),
-		Max:     uint16(cap(extents)),
-		Depth:   0,
-	}
-	for i := range extents {
-		block := offset + uint32(i)*maxBlocksPerExtent
-		length := inodeSize - block
-		if length > maxBlocksPerExtent {
-			length = maxBlocksPerExtent
-		}
-		start := startBlock + block
-		extents[i] = format.ExtentLeafNode{
-			Block:    block,
-			Length:   uint16(length),
-			StartLow: start,
-		}
-	}
+		Entries: uint16(count),
+		Max:     uint16(w.extentsPerBlock()),
+		Depth:   depth,
+	}
+	binary.Write(&b, binary.LittleEndian, hdr)
+	binary.Write(&b, binary.LittleEndian, entries)
+	nb := make([]byte, w.blockSize)
+	copy(nb, b.Bytes())
+	if w.metadataCsum {
+		// The tail follows room for the maximum number of entries.
+		tailOffset := (w.extentsPerBlock() + 1) * extentNodeSize
+		csum := crc32c(w.inodeChecksumSeed(inode.Number), nb[:tailOffset])
+		binary.LittleEndian.PutUint32(nb[tailOffset:], csum)
+	}
+	_, err := w.write(nb)
+	return err
 }
 
 func (w *Writer) writeExtents(inode *inode) error {
-	start := w.pos - w.dataWritten
-	if start%blockSize != 0 {
-		panic("unaligned")
+	leaves := make([]format.ExtentLeafNode, len(w.curExtents))
+	for i, e := range w.curExtents {
+		leaves[i] = format.ExtentLeafNode{
+			Block:     e.Block,
+			Length:    uint16(e.Length),
+			StartLow:  uint32(e.Start),
+			StartHigh: uint16(e.Start >> 32),
+		}
+	}
+	var startBlock uint32
+	if len(leaves) != 0 {
+		startBlock = leaves[0].StartLow
 	}
-	w.nextBlock()
-
-	startBlock := uint32(start / blockSize)
-	blocks := w.block() - startBlock
-	usedBlocks := blocks
-
-	const extentNodeSize = 12
-	const extentsPerBlock = blockSize/extentNodeSize - 1
 
-	extents := (blocks + maxBlocksPerExtent - 1) / maxBlocksPerExtent
 	var b bytes.Buffer
-	if extents == 0 {
-		// Nothing to do.
-	} else if extents <= 4 {
-		var root struct {
-			hdr     format.ExtentHeader
-			extents [4]format.ExtentLeafNode
-		}
-		fillExtents(&root.hdr, root.extents[:extents], startBlock, 0, blocks)
-		binary.Write(&b, binary.LittleEndian, root)
-	} else if extents <= 4*extentsPerBlock {
-		const extentsPerBlock = blockSize/extentNodeSize - 1
-		extentBlocks := extents/extentsPerBlock + 1
-		usedBlocks += extentBlocks
-		var b2 bytes.Buffer
-
-		var root struct {
-			hdr   format.ExtentHeader
-			nodes [4]format.ExtentIndexNode
-		}
-		root.hdr = format.ExtentHeader{
+	if len(leaves) <= 4 {
+		hdr := format.ExtentHeader{
 			Magic:   format.ExtentHeaderMagic,
-			Entries: uint16(extentBlocks),
+			Entries: uint16(len(leaves)),
 			Max:     4,
-			Depth:   1,
 		}
-		for i := uint32(0); i < extentBlocks; i++ {
-			root.nodes[i] = format.ExtentIndexNode{
-				Block:   i * extentsPerBlock * maxBlocksPerExtent,
-				LeafLow: w.block(),
-			}
-			extentsInBlock := extents - i*extentBlocks
-			if extentsInBlock > extentsPerBlock {
-				extentsInBlock = extentsPerBlock
-			}
-
-			var node struct {
-				hdr     format.ExtentHeader
-				extents [extentsPerBlock]format.ExtentLeafNode
-				_       [blockSize - (extentsPerBlock+1)*extentNodeSize]byte
+		binary.Write(&b, binary.LittleEndian, hdr)
+		binary.Write(&b, binary.LittleEndian, leaves)
+	} else {
+		// Write the tree from the leaves up until the top level fits in the
+		// inode.
+		perBlock := int(w.extentsPerBlock())
+		var index []format.ExtentIndexNode
+		for i := 0; i < len(leaves); i += perBlock {
+			chunk := leaves[i:]
+			if len(chunk) > perBlock {
+				chunk = chunk[:perBlock]
 			}
-
-			offset := i * extentsPerBlock * maxBlocksPerExtent
-			fillExtents(&node.hdr, node.extents[:extentsInBlock], startBlock+offset, offset, blocks)
-			binary.Write(&b2, binary.LittleEndian, node)
-			if _, err := w.write(b2.Next(blockSize)); err != nil {
+			index = append(index, format.ExtentIndexNode{
+				Block:   chunk[0].Block,
+				LeafLow: w.block(),
+			})
+			if err := w.writeExtentBlock(inode, 0, len(chunk), chunk); err != nil {
 				return err
 			}
 		}
-		binary.Write(&b, binary.LittleEndian, root)
-	} else {
-		panic("file too big")
+		depth := uint16(1)
+		for len(index) > 4 {
+			var next []format.ExtentIndexNode
+			for i := 0; i < len(index); i += perBlock {
+				chunk := index[i:]
+				if len(chunk) > perBlock {
+					chunk = chunk[:perBlock]
+				}
+				next = append(next, format.ExtentIndexNode{
+					Block:   chunk[0].Block,
+					LeafLow: w.block(),
+				})
+				if err := w.writeExtentBlock(inode, depth, len(chunk), chunk); err != nil {
+					return err
+				}
+			}
+			index = next
+			depth++
+		}
+		hdr := format.ExtentHeader{
+			Magic:   format.ExtentHeaderMagic,
+			Entries: uint16(len(index)),
+			Max:     4,
+			Depth:   depth,
+		}
+		binary.Write(&b, binary.LittleEndian, hdr)
+		binary.Write(&b, binary.LittleEndian, index)
 	}
 
+	// The data and tree blocks are contiguous, apart from the holes.
+	usedBlocks := uint32(0)
+	if len(leaves) != 0 {
+		usedBlocks = w.block() - startBlock
+	}
 	inode.Data = b.Bytes()
 	inode.Flags |= format.InodeFlagExtents
 	inode.BlockCount += usedBlocks
+	inode.DataBlock = startBlock
+	inode.DataBlockCount = usedBlocks
 	return w.err
 }
 
@@ -808,10 +1112,24 @@ func (w *Writer) finishInode() error {
 	}
 
 	if w.dataMax != 0 && w.curInode.Flags&format.InodeFlagInlineData == 0 {
+		if w.partial != 0 {
+			// Pad the last block with zeros.
+			copy(w.partialBlock[w.partial:], zeroBlock[:])
+			w.partial = 0
+			if err := w.writeDataBlock(w.partialBlock[:]); err != nil {
+				return err
+			}
+		}
 		if err := w.writeExtents(w.curInode); err != nil {
 			return err
 		}
 	}
+	if w.resumeBlock != 0 {
+		// The data was written into a freed range, so continue from the end
+		// of the previously written data.
+		w.seekBlock(w.resumeBlock)
+		w.resumeBlock = 0
+	}
 
 	w.dataWritten = 0
 	w.dataMax = 0
@@ -851,70 +1169,201 @@ func (r constReader) Read(b []byte) (int, error) {
 	return len(b), nil
 }
 
-func (w *Writer) writeDirectory(dir, parent *inode) error {
-	if err := w.finishInode(); err != nil {
-		return err
-	}
+type dirEntry struct {
+	Inode           format.InodeNumber
+	Name            string
+	Hash, MinorHash uint32
+}
 
-	// The size of the directory is not known yet.
-	w.startInode("", dir, 0x7fffffffffffffff)
-	left := blockSize
-	finishBlock := func() error {
+// packDirectoryBlocks packs directory entries into linear directory blocks. It
+// returns the blocks and the index of the first entry in each block.
+func (w *Writer) packDirectoryBlocks(dir *inode, entries []dirEntry) ([][]byte, []int) {
+	var (
+		blocks [][]byte
+		starts []int
+		b      bytes.Buffer
+	)
+	blockLeft := int(w.blockSize)
+	if w.metadataCsum {
+		blockLeft -= directoryTailSize
+	}
+	left := blockLeft
+	finishBlock := func() {
 		if left > 0 {
 			e := format.DirectoryEntry{
 				RecordLength: uint16(left),
 			}
-			err := binary.Write(w, binary.LittleEndian, e)
-			if err != nil {
-				return err
-			}
+			binary.Write(&b, binary.LittleEndian, e)
 			left -= directoryEntrySize
 			if left < 4 {
 				panic("not enough space for trailing entry")
 			}
-			_, err = io.CopyN(w, zero, int64(left))
-			if err != nil {
-				return err
+			io.CopyN(&b, zero, int64(left))
+		}
+		if w.metadataCsum {
+			tail := format.DirectoryEntryTail{
+				RecordLength: directoryTailSize,
+				FileType:     directoryTailFileType,
+				Checksum:     crc32c(w.inodeChecksumSeed(dir.Number), b.Bytes()),
 			}
+			binary.Write(&b, binary.LittleEndian, tail)
 		}
-		left = blockSize
-		return nil
+		blocks = append(blocks, append([]byte(nil), b.Bytes()...))
+		b.Reset()
+		left = blockLeft
 	}
 
-	writeEntry := func(ino format.InodeNumber, name string) error {
-		rlb := directoryEntrySize + len(name)
+	for i, de := range entries {
+		rlb := directoryEntrySize + len(de.Name)
 		rl := (rlb + 3) & ^3
 		if left < rl+12 {
-			if err := finishBlock(); err != nil {
-				return err
-			}
+			finishBlock()
+		}
+		if left == blockLeft {
+			starts = append(starts, i)
 		}
 		e := format.DirectoryEntry{
-			Inode:        ino,
+			Inode:        de.Inode,
 			RecordLength: uint16(rl),
-			NameLength:   uint8(len(name)),
-			FileType:     modeToFileType(w.getInode(ino).Mode),
+			NameLength:   uint8(len(de.Name)),
+			FileType:     modeToFileType(w.getInode(de.Inode).Mode),
 		}
-		err := binary.Write(w, binary.LittleEndian, e)
-		if err != nil {
-			return err
+		binary.Write(&b, binary.LittleEndian, e)
+		b.WriteString(de.Name)
+		var zero [4]byte
+		b.Write(zero[:rl-rlb])
+		left -= rl
+	}
+	finishBlock()
+	return blocks, starts
+}
+
+const (
+	dxRootCountOffset = 32 // "." and ".." entries plus the root info
+	dxNodeCountOffset = 8  // the fake directory entry
+	dxEntrySize       = 8
+	dxTailSize        = 8
+)
+
+type dxEntry struct {
+	Hash, Block uint32
+}
+
+func (w *Writer) dxLimit(countOffset int) int {
+	limit := (int(w.blockSize) - countOffset) / dxEntrySize
+	if w.metadataCsum {
+		limit -= dxTailSize / dxEntrySize
+	}
+	return limit
+}
+
+// makeDxBlock returns an index block consisting of header, which ends with the
+// count, limit and first block fields, followed by the remaining entries.
+func (w *Writer) makeDxBlock(dir *inode, header interface{}, countOffset int, entries []dxEntry) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, header)
+	binary.Write(&b, binary.LittleEndian, entries[1:])
+	blk := make([]byte, w.blockSize)
+	copy(blk, b.Bytes())
+	if w.metadataCsum {
+		tailOffset := countOffset + w.dxLimit(countOffset)*dxEntrySize
+		csum := crc32c(w.inodeChecksumSeed(dir.Number), blk[:countOffset+len(entries)*dxEntrySize])
+		csum = crc32c(csum, blk[tailOffset:tailOffset+dxTailSize])
+		binary.LittleEndian.PutUint32(blk[tailOffset+4:], csum)
+	}
+	return blk
+}
+
+// indexDirectory returns the blocks of a hashed (htree) directory containing
+// entries, which must not include "." or "..".
+func (w *Writer) indexDirectory(dir, parent *inode, entries []dirEntry) ([][]byte, error) {
+	// The superblock hash seed is zero, which selects the default seed.
+	for i := range entries {
+		entries[i].Hash, entries[i].MinorHash = dirHashHalfMD4(entries[i].Name, [4]uint32{})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := &entries[i], &entries[j]
+		if a.Hash != b.Hash {
+			return a.Hash < b.Hash
 		}
-		_, err = w.Write([]byte(name))
-		if err != nil {
-			return err
+		if a.MinorHash != b.MinorHash {
+			return a.MinorHash < b.MinorHash
 		}
-		var zero [4]byte
-		_, err = w.Write(zero[:rl-rlb])
-		if err != nil {
-			return err
+		return a.Name < b.Name
+	})
+	leaves, starts := w.packDirectoryBlocks(dir, entries)
+
+	rootLimit := w.dxLimit(dxRootCountOffset)
+	nodeLimit := w.dxLimit(dxNodeCountOffset)
+	var levels uint8
+	nodeCount := 0
+	if len(leaves) > rootLimit {
+		levels = 1
+		nodeCount = (len(leaves)-1)/nodeLimit + 1
+		if nodeCount > rootLimit {
+			return nil, errors.New("directory too large")
 		}
-		left -= rl
-		return nil
 	}
-	if err := writeEntry(dir.Number, "."); err != nil {
-		return err
+
+	// The root is block 0, followed by the index nodes and then the leaves.
+	leafEntries := make([]dxEntry, len(leaves))
+	for i, s := range starts {
+		hash := entries[s].Hash
+		if s > 0 && entries[s-1].Hash == hash {
+			// Mark that entries with this hash continue from the previous
+			// block.
+			hash |= 1
+		}
+		leafEntries[i] = dxEntry{Hash: hash, Block: uint32(1 + nodeCount + i)}
 	}
-	if err := writeEntry(parent.Number, ".."); err != nil {
+
+	var blocks [][]byte
+	rootEntries := leafEntries
+	if levels != 0 {
+		rootEntries = nil
+		for i := 0; i < nodeCount; i++ {
+			children := leafEntries[i*nodeLimit:]
+			if len(children) > nodeLimit {
+				children = children[:nodeLimit]
+			}
+			node := format.DirectoryTreeNode{
+				FakeRecordLength: uint16(w.blockSize),
+				Limit:            uint16(nodeLimit),
+				Count:            uint16(len(children)),
+				Block:            children[0].Block,
+			}
+			blocks = append(blocks, w.makeDxBlock(dir, node, dxNodeCountOffset, children))
+			rootEntries = append(rootEntries, dxEntry{Hash: children[0].Hash, Block: uint32(1 + i)})
+		}
+	}
+	root := format.DirectoryTreeRoot{
+		Dot: format.DirectoryEntry{
+			Inode:        dir.Number,
+			RecordLength: 12,
+			NameLength:   1,
+			FileType:     format.FileTypeDirectory,
+		},
+		DotName: [4]byte{'.'},
+		DotDot: format.DirectoryEntry{
+			Inode:        parent.Number,
+			RecordLength: uint16(w.blockSize - 12),
+			NameLength:   2,
+			FileType:     format.FileTypeDirectory,
+		},
+		DotDotName:     [4]byte{'.', '.'},
+		HashVersion:    format.DirectoryHashHalfMD4,
+		InfoLength:     8,
+		IndirectLevels: levels,
+		Limit:          uint16(rootLimit),
+		Count:          uint16(len(rootEntries)),
+		Block:          rootEntries[0].Block,
+	}
+	blocks = append([][]byte{w.makeDxBlock(dir, root, dxRootCountOffset, rootEntries)}, blocks...)
+	return append(blocks, leaves...), nil
+}
+
+func (w *Writer) writeDirectory(dir, parent *inode) error {
+	if err := w.finishInode(); err != nil {
 		return err
 	}
 
@@ -927,14 +1376,28 @@ func (w *Writer) writeDirectory(dir, parent *inode) error {
 		return dir.Children[children[i]].Number < dir.Children[children[j]].Number
 	})
 
+	entries := []dirEntry{{Inode: dir.Number, Name: "."}, {Inode: parent.Number, Name: ".."}}
 	for _, name := range children {
-		child := dir.Children[name]
-		if err := writeEntry(child.Number, name); err != nil {
+		entries = append(entries, dirEntry{Inode: dir.Children[name].Number, Name: name})
+	}
+	blocks, _ := w.packDirectoryBlocks(dir, entries)
+	if len(blocks) > 1 {
+		// Index the directory so that lookups do not need to scan every
+		// block.
+		var err error
+		blocks, err = w.indexDirectory(dir, parent, entries[2:])
+		if err != nil {
 			return err
 		}
+		dir.Flags |= format.InodeFlagHashedIndex
 	}
-	if err := finishBlock(); err != nil {
-		return err
+
+	// The size of the directory is not known yet.
+	w.startInode("", dir, 0x7fffffffffffffff)
+	for _, b := range blocks {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
 	}
 	w.curInode.Size = w.dataWritten
 	w.dataMax = w.dataWritten
@@ -945,11 +1408,20 @@ func (w *Writer) writeDirectoryRecursive(dir, parent *inode) error {
 	if err := w.writeDirectory(dir, parent); err != nil {
 		return err
 	}
+	// Visit the children in inode order so that the layout does not depend on
+	// map iteration order.
+	var children []*inode
 	for _, child := range dir.Children {
 		if child.IsDir() {
-			if err := w.writeDirectoryRecursive(child, dir); err != nil {
-				return err
-			}
+			children = append(children, child)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Number < children[j].Number
+	})
+	for _, child := range children {
+		if err := w.writeDirectoryRecursive(child, dir); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -971,7 +1443,7 @@ func (w *Writer) writeInodeTable(tableSize uint32) error {
 				XattrBlockLow: inode.XattrBlock,
 				UidHigh:       uint16(inode.Uid >> 16),
 				GidHigh:       uint16(inode.Gid >> 16),
-				ExtraIsize:    uint16(inodeUsedSize - 128),
+				ExtraIsize:    extraIsize,
 				Atime:         uint32(inode.Atime),
 				AtimeExtra:    uint32(inode.Atime >> 32),
 				Ctime:         uint32(inode.Ctime),
@@ -999,30 +1471,39 @@ func (w *Writer) writeInodeTable(tableSize uint32) error {
 			}
 
 			binary.Write(&b, binary.LittleEndian, binode)
-			b.Truncate(inodeUsedSize)
+			// Small inodes end before the extra fields.
+			b.Truncate(int(w.inodeSize) - w.inodeExtraSize())
 			n, _ := b.Write(inode.XattrInline)
-			io.CopyN(&b, zero, int64(inodeExtraSize-n))
+			io.CopyN(&b, zero, int64(w.inodeExtraSize()-n))
 		} else {
-			io.CopyN(&b, zero, inodeSize)
+			io.CopyN(&b, zero, int64(w.inodeSize))
+		}
+		ib := b.Next(int(w.inodeSize))
+		if inode != nil && w.metadataCsum {
+			csum := crc32c(w.inodeChecksumSeed(inode.Number), ib)
+			binary.LittleEndian.PutUint16(ib[inodeChecksumLowOffset:], uint16(csum))
+			if w.inodeSize > smallInodeSize {
+				binary.LittleEndian.PutUint16(ib[inodeChecksumHighOffset:], uint16(csum>>16))
+			}
 		}
-		if _, err := w.write(b.Next(inodeSize)); err != nil {
+		if _, err := w.write(ib); err != nil {
 			return err
 		}
 	}
-	rest := tableSize - uint32(len(w.inodes)*inodeSize)
-	if _, err := w.zero(int64(rest)); err != nil {
-		return err
-	}
-	return nil
+	rest := tableSize - uint32(len(w.inodes))*w.inodeSize
+	return w.skip(int64(rest))
 }
 
 // NewWriter returns a Writer that writes an ext4 file system to the provided
 // WriteSeeker.
 func NewWriter(f io.ReadWriteSeeker, opts ...Option) *Writer {
 	w := &Writer{
-		f:           f,
-		bw:          bufio.NewWriterSize(f, 65536*8),
-		maxDiskSize: defaultMaxDiskSize,
+		f:             f,
+		bw:            bufio.NewWriterSize(f, 65536*8),
+		maxDiskSize:   defaultMaxDiskSize,
+		blockSize:     defaultBlockSize,
+		inodeSize:     defaultInodeSize,
+		bytesPerInode: defaultBytesPerInode,
 	}
 	for _, opt := range opts {
 		opt(w)
@@ -1040,6 +1521,35 @@ func InlineData(w *Writer) {
 	w.supportInlineData = true
 }
 
+// ExpandDisk instructs the writer to size the file system to the maximum disk
+// size (see MaximumDiskSize) rather than to the minimum size needed for its
+// contents. The remaining space is left free so that the file system can be
+// mounted read-write, for example as a scratch disk. If the underlying file
+// supports truncation, unused regions are left sparse.
+func ExpandDisk(w *Writer) {
+	w.expandDisk = true
+}
+
+// Deterministic instructs the writer to derive the file system UUID from a hash
+// of the image contents, so that identical input produces identical images
+// while images of different contents have different UUIDs. Otherwise the UUID
+// is left zero. The superblock times are never set.
+func Deterministic(w *Writer) {
+	w.deterministic = true
+}
+
+// MetadataChecksum instructs the writer to protect the file system metadata
+// with CRC32C checksums (the metadata_csum feature).
+func MetadataChecksum(w *Writer) {
+	w.metadataCsum = true
+}
+
+// Use64Bit instructs the writer to enable the 64bit feature, which uses 64-byte
+// group descriptors.
+func Use64Bit(w *Writer) {
+	w.is64Bit = true
+}
+
 // MaximumDiskSize instructs the writer to reserve enough metadata space for the
 // specified disk size. If not provided, then 16GB is the default.
 func MaximumDiskSize(size int64) Option {
@@ -1049,12 +1559,123 @@ func MaximumDiskSize(size int64) Option {
 		} else if size == 0 {
 			w.maxDiskSize = defaultMaxDiskSize
 		} else {
-			w.maxDiskSize = (size + blockSize - 1) &^ (blockSize - 1)
+			w.maxDiskSize = size
 		}
 	}
 }
 
+// BlockSize instructs the writer to use the specified file system block size,
+// which must be 1024, 2048 or 4096 bytes. If not provided, then 4096 is the
+// default.
+func BlockSize(size int) Option {
+	return func(w *Writer) {
+		w.blockSize = uint32(size)
+	}
+}
+
+// InodeSize instructs the writer to use the specified inode size, which must
+// be 128 or 256 bytes. If not provided, then 256 is the default. 128-byte
+// inodes have no room for inline data or extended attributes, which are then
+// always stored in a separate block, and only store times to the second.
+func InodeSize(size int) Option {
+	return func(w *Writer) {
+		w.inodeSize = uint32(size)
+	}
+}
+
+// InodeRatio instructs the writer to create one inode for every bytesPerInode
+// bytes of an expanded disk (see ExpandDisk), like the -i option of mke2fs. If
+// not provided, then 16KB is the default.
+func InodeRatio(bytesPerInode int64) Option {
+	return func(w *Writer) {
+		w.bytesPerInode = bytesPerInode
+	}
+}
+
+// InodeCount instructs the writer to create at least n inodes, including the
+// reserved inodes and those used by the files that are written, so that files
+// can be created once the file system is mounted.
+func InodeCount(n uint32) Option {
+	return func(w *Writer) {
+		w.minInodes = n
+	}
+}
+
+// ReservedBlocksPercentage instructs the writer to reserve the specified
+// percentage of the file system blocks for the root user, like the -m option
+// of mke2fs. If not provided, then no blocks are reserved.
+func ReservedBlocksPercentage(percent int) Option {
+	return func(w *Writer) {
+		w.reservedPercent = percent
+	}
+}
+
+func (w *Writer) descriptorSize() uint32 {
+	if w.is64Bit {
+		return groupDescriptorSize64
+	}
+	return groupDescriptorSize
+}
+
+// inodeExtraSize returns the space in each inode past the fields that the
+// writer uses, which holds extended attributes.
+func (w *Writer) inodeExtraSize() int {
+	if w.inodeSize <= inodeUsedSize {
+		return 0
+	}
+	return int(w.inodeSize) - inodeUsedSize
+}
+
+// inlineDataSize returns the largest file whose data fits in its inode.
+func (w *Writer) inlineDataSize() int64 {
+	return int64(inodeDataSize + w.inodeExtraSize() - inlineDataXattrOverhead)
+}
+
+// checkGeometry validates the block and inode options and derives the group
+// layout from them.
+func (w *Writer) checkGeometry() error {
+	switch w.blockSize {
+	case 1024, 2048, 4096:
+	default:
+		return fmt.Errorf("invalid block size %d", w.blockSize)
+	}
+	switch w.inodeSize {
+	case smallInodeSize:
+		// There is no room for the system.data attribute.
+		w.supportInlineData = false
+	case defaultInodeSize:
+	default:
+		return fmt.Errorf("invalid inode size %d", w.inodeSize)
+	}
+	if w.bytesPerInode < 1024 || w.bytesPerInode > 64*1024*1024 {
+		return fmt.Errorf("invalid inode ratio %d", w.bytesPerInode)
+	}
+	if w.reservedPercent < 0 || w.reservedPercent > maxReservedPercent {
+		return fmt.Errorf("invalid reserved blocks percentage %d", w.reservedPercent)
+	}
+	w.blocksPerGroup = w.blockSize * 8
+	if w.blockSize == 1024 {
+		w.firstDataBlock = 1
+	}
+	// The block count is limited to 32 bits.
+	bs := int64(w.blockSize)
+	if max := bs << 32; w.maxDiskSize > max {
+		w.maxDiskSize = max
+	}
+	w.maxDiskSize = (w.maxDiskSize + bs - 1) &^ (bs - 1)
+	w.partialBlock = make([]byte, w.blockSize)
+	return nil
+}
+
 func (w *Writer) init() error {
+	if err := w.checkGeometry(); err != nil {
+		return err
+	}
+	// The checksums depend on the UUID, so they are seeded from the zero UUID.
+	// In deterministic mode the UUID is only known once the image is
+	// complete, and the seed is recorded in the superblock.
+	w.csumSeed = crc32c(^uint32(0), w.uuid[:])
+
 	// Skip the defective block inode.
 	w.inodes = make([]*inode, 1, 32)
 	// Create the root directory.
@@ -1064,12 +1685,13 @@ func (w *Writer) init() error {
 	root.LinkCount++ // The root is linked to itself.
 	// Skip until the first non-reserved inode.
 	w.inodes = append(w.inodes, make([]*inode, inodeFirst-len(w.inodes)-1)...)
-	maxBlocks := (w.maxDiskSize-1)/blockSize + 1
-	maxGroups := (maxBlocks-1)/blocksPerGroup + 1
+	maxBlocks := (w.maxDiskSize-1)/int64(w.blockSize) + 1
+	maxGroups := (maxBlocks-int64(w.firstDataBlock)-1)/int64(w.blocksPerGroup) + 1
+	groupsPerDescriptorBlock := int64(w.blockSize / w.descriptorSize())
 	w.gdBlocks = uint32((maxGroups-1)/groupsPerDescriptorBlock + 1)
 
 	// Skip past the superblock and block descriptor table.
-	w.seekBlock(1 + w.gdBlocks)
+	w.seekBlock(w.firstDataBlock + 1 + w.gdBlocks)
 	w.initialized = true
 
 	// The lost+found directory is required to exist for e2fsck to pass.
@@ -1079,9 +1701,9 @@ func (w *Writer) init() error {
 	return w.err
 }
 
-func groupCount(blocks uint32, inodes uint32, inodesPerGroup uint32) uint32 {
-	inodeBlocksPerGroup := inodesPerGroup * inodeSize / blockSize
-	dataBlocksPerGroup := blocksPerGroup - inodeBlocksPerGroup - 2 // save room for the bitmaps
+func (w *Writer) groupCount(blocks uint32, inodes uint32, inodesPerGroup uint32) uint32 {
+	inodeBlocksPerGroup := inodesPerGroup * w.inodeSize / w.blockSize
+	dataBlocksPerGroup := w.blocksPerGroup - inodeBlocksPerGroup - 2 // save room for the bitmaps
 
 	// Increase the block count to ensure there are enough groups for all the
 	// inodes.
@@ -1093,10 +1715,26 @@ func groupCount(blocks uint32, inodes uint32, inodesPerGroup uint32) uint32 {
 	return (blocks + dataBlocksPerGroup - 1) / dataBlocksPerGroup
 }
 
-func bestGroupCount(blocks uint32, inodes uint32) (groups uint32, inodesPerGroup uint32) {
+// inodesPerGroupIncrement returns the granularity of the inodes per group,
+// which fill whole inode table blocks and whole bytes of the inode bitmap.
+func (w *Writer) inodesPerGroupIncrement() uint32 {
+	if n := w.blockSize / w.inodeSize; n > 8 {
+		return n
+	}
+	return 8
+}
+
+// maxInodesPerGroup returns the number of inodes that the inode bitmap can
+// track.
+func (w *Writer) maxInodesPerGroup() uint32 {
+	return w.blockSize * 8
+}
+
+func (w *Writer) bestGroupCount(blocks uint32, inodes uint32) (groups uint32, inodesPerGroup uint32) {
 	groups = 0xffffffff
-	for ipg := uint32(inodesPerGroupIncrement); ipg <= maxInodesPerGroup; ipg += inodesPerGroupIncrement {
-		g := groupCount(blocks, inodes, ipg)
+	inc := w.inodesPerGroupIncrement()
+	for ipg := inc; ipg <= w.maxInodesPerGroup(); ipg += inc {
+		g := w.groupCount(blocks, inodes, ipg)
 		if g < groups {
 			groups = g
 			inodesPerGroup = ipg
@@ -1105,6 +1743,22 @@ func bestGroupCount(blocks uint32, inodes uint32) (groups uint32, inodesPerGroup
 	return
 }
 
+// expandedGroupCount returns the number of groups and inodes per group for a
+// file system that spans the given number of blocks.
+func (w *Writer) expandedGroupCount(blocks uint32, inodes uint32) (groups uint32, inodesPerGroup uint32) {
+	groups = (blocks-w.firstDataBlock-1)/w.blocksPerGroup + 1
+	inodesPerGroup = uint32(int64(w.blocksPerGroup) * int64(w.blockSize) / w.bytesPerInode)
+	if min := (inodes-1)/groups + 1; inodesPerGroup < min {
+		inodesPerGroup = min
+	}
+	inc := w.inodesPerGroupIncrement()
+	inodesPerGroup = (inodesPerGroup + inc - 1) &^ (inc - 1)
+	if inodesPerGroup > w.maxInodesPerGroup() {
+		inodesPerGroup = w.maxInodesPerGroup()
+	}
+	return
+}
+
 func (w *Writer) Close() error {
 	if err := w.finishInode(); err != nil {
 		return err
@@ -1117,11 +1771,47 @@ func (w *Writer) Close() error {
 	if err := w.finishInode(); err != nil {
 		return err
 	}
+	if err := w.releaseFreeBlocks(); err != nil {
+		return err
+	}
+
+	if w.expandDisk {
+		if t, ok := w.f.(truncater); ok {
+			// Discard any existing contents so that skipped regions read as
+			// zero.
+			w.err = w.bw.Flush()
+			if w.err != nil {
+				return w.err
+			}
+			if err := t.Truncate(w.pos); err != nil {
+				return err
+			}
+			w.sparse = true
+		}
+	}
+	if w.journal {
+		if err := w.writeJournal(); err != nil {
+			return err
+		}
+	}
 
 	// Write the inode table
 	inodeTableOffset := w.block()
-	groups, inodesPerGroup := bestGroupCount(inodeTableOffset, uint32(len(w.inodes)))
-	err := w.writeInodeTable(groups * inodesPerGroup * inodeSize)
+	var groups, inodesPerGroup, expandedSize uint32
+	inodes := uint32(len(w.inodes))
+	if w.minInodes > inodes {
+		inodes = w.minInodes
+	}
+	if w.expandDisk {
+		expandedSize = uint32(w.maxDiskSize / int64(w.blockSize))
+		groups, inodesPerGroup = w.expandedGroupCount(expandedSize, inodes)
+		if groups*inodesPerGroup < inodes {
+			return exceededMaxSizeError{w.maxDiskSize}
+		}
+	} else {
+		groups, inodesPerGroup = w.bestGroupCount(inodeTableOffset, inodes)
+	}
+	err := w.writeInodeTable(groups * inodesPerGroup * w.inodeSize)
 	if err != nil {
 		return err
 	}
@@ -1131,74 +1821,115 @@ func (w *Writer) Close() error {
 	bitmapSize := groups * 2
 	validDataSize := bitmapOffset + bitmapSize
 	diskSize := validDataSize
-	minSize := (groups-1)*blocksPerGroup + 1
+	bpg := w.blocksPerGroup
+	minSize := w.firstDataBlock + (groups-1)*bpg + 1
 	if diskSize < minSize {
 		diskSize = minSize
 	}
+	if w.expandDisk {
+		if diskSize > expandedSize {
+			return exceededMaxSizeError{w.maxDiskSize}
+		}
+		diskSize = expandedSize
+	}
 
-	usedGdBlocks := (groups-1)/groupDescriptorSize + 1
+	descSize := w.descriptorSize()
+	usedGdBlocks := (groups-1)/(w.blockSize/descSize) + 1
 	if usedGdBlocks > w.gdBlocks {
 		return exceededMaxSizeError{w.maxDiskSize}
 	}
 
-	gds := make([]format.GroupDescriptor, w.gdBlocks*groupsPerDescriptorBlock)
-	inodeTableSizePerGroup := inodesPerGroup * inodeSize / blockSize
+	gds := make([]format.GroupDescriptor64, groups)
+	inodeTableSizePerGroup := inodesPerGroup * w.inodeSize / w.blockSize
 	var totalUsedBlocks, totalUsedInodes uint32
 	for g := uint32(0); g < groups; g++ {
-		var b [blockSize * 2]byte
+		// The block bitmap is followed by the inode bitmap.
+		b := make([]byte, 2*w.blockSize)
+		ib := b[w.blockSize:]
 		var dirCount, usedInodeCount, usedBlockCount uint16
 
-		// Block bitmap
-		if (g+1)*blocksPerGroup <= validDataSize {
+		// Block bitmap. Bit j tracks block base+j.
+		base := w.firstDataBlock + g*bpg
+		if base+bpg <= validDataSize {
 			// This group is fully allocated.
-			for j := range b[:blockSize] {
+			for j := range b[:w.blockSize] {
 				b[j] = 0xff
 			}
-			usedBlockCount = blocksPerGroup
-		} else if g*blocksPerGroup < validDataSize {
-			for j := uint32(0); j < validDataSize-g*blocksPerGroup; j++ {
+			usedBlockCount = uint16(bpg)
+		} else if base < validDataSize {
+			for j := uint32(0); j < validDataSize-base; j++ {
 				b[j/8] |= 1 << (j % 8)
 				usedBlockCount++
 			}
 		}
+		for _, r := range w.free {
+			// Freed data blocks should be cleared.
+			start, end := r.Start, r.Start+r.Count
+			if start < base {
+				start = base
+			}
+			if end > base+bpg {
+				end = base + bpg
+			}
+			for j := start; j < end; j++ {
+				k := j - base
+				b[k/8] &^= 1 << (k % 8)
+				usedBlockCount--
+			}
+		}
 		if g == 0 {
-			// Unused group descriptor blocks should be cleared.
+			// Unused group descriptor blocks should be cleared. They follow
+			// the superblock, which is the first block of the group.
 			for j := 1 + usedGdBlocks; j < 1+w.gdBlocks; j++ {
 				b[j/8] &^= 1 << (j % 8)
 				usedBlockCount--
 			}
 		}
-		if g == groups-1 && diskSize%blocksPerGroup != 0 {
+		if last := (diskSize - w.firstDataBlock) % bpg; g == groups-1 && last != 0 {
 			// Blocks that aren't present in the disk should be marked as
 			// allocated.
-			for j := diskSize % blocksPerGroup; j < blocksPerGroup; j++ {
+			for j := last; j < bpg; j++ {
 				b[j/8] |= 1 << (j % 8)
 				usedBlockCount++
 			}
 		}
-		// Inode bitmap
+		// Inode bitmap. The padding past the end of the group's inodes must
+		// be marked as in use.
+		for j := inodesPerGroup; j < w.blockSize*8; j++ {
+			ib[j/8] |= 1 << (j % 8)
+		}
 		for j := uint32(0); j < inodesPerGroup; j++ {
 			ino := format.InodeNumber(1 + g*inodesPerGroup + j)
 			inode := w.getInode(ino)
 			if ino < inodeFirst || inode != nil {
-				b[blockSize+j/8] |= 1 << (j % 8)
+				ib[j/8] |= 1 << (j % 8)
 				usedInodeCount++
 			}
 			if inode != nil && inode.Mode&format.TypeMask == format.S_IFDIR {
 				dirCount++
 			}
 		}
-		_, err := w.write(b[:])
+		_, err := w.write(b)
 		if err != nil {
 			return err
 		}
-		gds[g] = format.GroupDescriptor{
+		gds[g].GroupDescriptor = format.GroupDescriptor{
 			BlockBitmapLow:     bitmapOffset + 2*g,
 			InodeBitmapLow:     bitmapOffset + 2*g + 1,
 			InodeTableLow:      inodeTableOffset + g*inodeTableSizePerGroup,
 			UsedDirsCountLow:   dirCount,
 			FreeInodesCountLow: uint16(inodesPerGroup) - usedInodeCount,
-			FreeBlocksCountLow: blocksPerGroup - usedBlockCount,
+			FreeBlocksCountLow: uint16(bpg) - usedBlockCount,
+		}
+		if w.metadataCsum {
+			blockCsum := w.bitmapChecksum(b[:bpg/8])
+			inodeCsum := w.bitmapChecksum(ib[:inodesPerGroup/8])
+			gds[g].BlockBitmapCsumLow = uint16(blockCsum)
+			gds[g].InodeBitmapCsumLow = uint16(inodeCsum)
+			if w.is64Bit {
+				gds[g].BlockBitmapCsumHigh = uint16(blockCsum >> 16)
+				gds[g].InodeBitmapCsumHigh = uint16(inodeCsum >> 16)
+			}
 		}
 
 		totalUsedBlocks += uint32(usedBlockCount)
@@ -1206,34 +1937,50 @@ func (w *Writer) Close() error {
 	}
 
 	// Zero up to the disk size.
-	_, err = w.zero(int64(diskSize-bitmapOffset-bitmapSize) * blockSize)
+	err = w.skip(int64(diskSize-bitmapOffset-bitmapSize) * int64(w.blockSize))
 	if err != nil {
 		return err
 	}
+	if w.sparse {
+		// Extend the file to cover any skipped region at the end.
+		if err := w.f.(truncater).Truncate(w.pos); err != nil {
+			return err
+		}
+	}
 
 	// Write the block descriptors
-	w.seekBlock(1)
-	if w.err != nil {
-		return w.err
+	gdb := make([]byte, w.gdBlocks*w.blockSize)
+	var b bytes.Buffer
+	for g := range gds {
+		binary.Write(&b, binary.LittleEndian, &gds[g])
+		d := gdb[uint32(g)*descSize : uint32(g+1)*descSize]
+		copy(d, b.Next(groupDescriptorSize64))
+		if w.metadataCsum {
+			csum := w.groupDescriptorChecksum(uint32(g), d)
+			binary.LittleEndian.PutUint16(d[groupDescriptorChecksumOffset:], csum)
+		}
 	}
-	err = binary.Write(w.bw, binary.LittleEndian, gds)
-	if err != nil {
+	w.seekBlock(w.firstDataBlock + 1)
+	if _, err := w.write(gdb); err != nil {
 		return err
 	}
 
 	// Write the super block
-	var blk [blockSize]byte
-	b := bytes.NewBuffer(blk[:1024])
+	logBlockSize := uint32(0)
+	for 1024<<logBlockSize < w.blockSize {
+		logBlockSize++
+	}
 	sb := &format.SuperBlock{
 		InodesCount:        inodesPerGroup * groups,
 		BlocksCountLow:     diskSize,
-		FreeBlocksCountLow: blocksPerGroup*groups - totalUsedBlocks,
+		RootBlocksCountLow: uint32(uint64(diskSize) * uint64(w.reservedPercent) / 100),
+		FreeBlocksCountLow: bpg*groups - totalUsedBlocks,
 		FreeInodesCount:    inodesPerGroup*groups - totalUsedInodes,
-		FirstDataBlock:     0,
-		LogBlockSize:       2, // 2^(10 + 2)
-		LogClusterSize:     2,
-		BlocksPerGroup:     blocksPerGroup,
-		ClustersPerGroup:   blocksPerGroup,
+		FirstDataBlock:     w.firstDataBlock,
+		LogBlockSize:       logBlockSize, // 2^(10 + logBlockSize)
+		LogClusterSize:     logBlockSize,
+		BlocksPerGroup:     bpg,
+		ClustersPerGroup:   bpg,
 		InodesPerGroup:     inodesPerGroup,
 		Magic:              format.SuperBlockMagic,
 		State:              1, // cleanly unmounted
@@ -1242,22 +1989,126 @@ func (w *Writer) Close() error {
 		RevisionLevel:      1, // dynamic inode sizes
 		FirstInode:         inodeFirst,
 		LpfInode:           inodeLostAndFound,
-		InodeSize:          inodeSize,
-		FeatureCompat:      format.CompatSparseSuper2 | format.CompatExtAttr,
+		InodeSize:          uint16(w.inodeSize),
+		FeatureCompat:      format.CompatSparseSuper2 | format.CompatExtAttr | format.CompatDirIndex,
 		FeatureIncompat:    format.IncompatFiletype | format.IncompatExtents | format.IncompatFlexBg,
-		FeatureRoCompat:    format.RoCompatLargeFile | format.RoCompatHugeFile | format.RoCompatExtraIsize | format.RoCompatReadonly,
-		MinExtraIsize:      extraIsize,
-		WantExtraIsize:     extraIsize,
+		FeatureRoCompat:    format.RoCompatLargeFile | format.RoCompatHugeFile,
 		LogGroupsPerFlex:   31,
+		DefHashVersion:     format.DirectoryHashHalfMD4,
+		Flags:              format.SuperBlockFlagUnsignedHash,
+	}
+	if w.inodeSize > smallInodeSize {
+		sb.FeatureRoCompat |= format.RoCompatExtraIsize
+		sb.MinExtraIsize = extraIsize
+		sb.WantExtraIsize = extraIsize
 	}
 	if w.supportInlineData {
 		sb.FeatureIncompat |= format.IncompatInlineData
 	}
-	binary.Write(b, binary.LittleEndian, sb)
-	w.seekBlock(0)
-	if _, err := w.write(blk[:]); err != nil {
+	if !w.expandDisk {
+		// There is no free space, so the file system is only useful
+		// read-only.
+		sb.FeatureRoCompat |= format.RoCompatReadonly
+	}
+	if w.is64Bit {
+		sb.FeatureIncompat |= format.Incompat_64Bit
+		sb.DescSize = groupDescriptorSize64
+	}
+	if w.metadataCsum {
+		sb.FeatureRoCompat |= format.RoCompatMetadataCsum
+		sb.ChecksumType = 1 // crc32c
+		if w.deterministic {
+			// The UUID is not known yet, so record the seed that was used.
+			sb.FeatureIncompat |= format.IncompatCsumSeed
+			sb.ChecksumSeed = w.csumSeed
+		}
+	}
+	if w.journal {
+		w.setJournalFields(sb)
+	}
+	if w.deterministic {
+		// Write the superblock without a UUID, then derive the UUID from the
+		// resulting image.
+		if err := w.writeSuperBlock(sb); err != nil {
+			return err
+		}
+		sum, err := w.hashImage(int64(diskSize) * int64(w.blockSize))
+		if err != nil {
+			return err
+		}
+		w.uuid = UUIDFromHash(sum)
+	}
+	sb.UUID = w.uuid
+	if err := w.writeSuperBlock(sb); err != nil {
 		return err
 	}
+	if w.journal {
+		if err := w.writeJournalSuperBlock(); err != nil {
+			return err
+		}
+	}
 	w.seekBlock(diskSize)
 	return w.err
 }
+
+// releaseFreeBlocks prepares the remaining freed ranges to be left free in the
+// final image. A range at the end of the data is discarded, and the others are
+// zeroed so that replaced file contents do not remain in the image.
+func (w *Writer) releaseFreeBlocks() error {
+	if n := len(w.free); n != 0 && w.free[n-1].Start+w.free[n-1].Count == w.block() {
+		w.seekBlock(w.free[n-1].Start)
+		w.free = w.free[:n-1]
+	}
+	end := w.block()
+	for _, r := range w.free {
+		w.seekBlock(r.Start)
+		if _, err := w.zero(int64(r.Count) * int64(w.blockSize)); err != nil {
+			return err
+		}
+	}
+	w.seekBlock(end)
+	return w.err
+}
+
+func (w *Writer) writeSuperBlock(sb *format.SuperBlock) error {
+	// The superblock follows 1024 bytes of boot sector. With 1K blocks, it
+	// fills block 1.
+	blk := make([]byte, (w.firstDataBlock+1)*w.blockSize)
+	b := bytes.NewBuffer(blk[:1024])
+	binary.Write(b, binary.LittleEndian, sb)
+	if sb.FeatureRoCompat&format.RoCompatMetadataCsum != 0 {
+		csum := superBlockChecksum(blk[1024:])
+		binary.LittleEndian.PutUint32(blk[1024+superBlockChecksumOffset:], csum)
+	}
+	w.seekBlock(0)
+	_, err := w.write(blk)
+	return err
+}
+
+// hashImage returns the SHA-256 hash of the first size bytes of the image.
+func (w *Writer) hashImage(size int64) ([]byte, error) {
+	w.seekBlock(0)
+	if w.err != nil {
+		return nil, w.err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, w.f, size); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// UUIDFromHash returns a name-based (version 5 style) UUID derived from sum.
+func UUIDFromHash(sum []byte) [16]byte {
+	var uuid [16]byte
+	copy(uuid[:], sum)
+	uuid[6] = uuid[6]&0x0f | 0x50
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return uuid
+}
+
+// UUID returns the file system UUID. It is only valid after Close has
+// returned successfully.
+func (w *Writer) UUID() [16]byte {
+	return w.uuid
+}
@@ -5,8 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"strings"
 	"testing"
 	"time"
 
@@ -28,7 +28,7 @@ var (
 )
 
 func init() {
-	data = make([]byte, blockSize*2)
+	data = make([]byte, defaultBlockSize*2)
 	for i := range data {
 		data[i] = uint8(i)
 	}
@@ -51,7 +51,7 @@ func (d *largeData) Read(b []byte) (int, error) {
 		binary.LittleEndian.PutUint64(pb[:], uint64(p+int64(i)))
 		b[i] = pb[i%8]
 	}
-	p += int64(len(b))
+	d.pos += int64(len(b))
 	return len(b), nil
 }
 
@@ -107,6 +107,46 @@ func expectedSize(f *File) int64 {
 	}
 }
 
+func expectedDevice(f *File) uint64 {
+	return uint64(f.Devminor&0xff | f.Devmajor<<8 | (f.Devminor&0xffffff00)<<12)
+}
+
+func streamEqual(r1, r2 io.Reader) (bool, error) {
+	var b [4096]byte
+	var b2 [4096]byte
+	for {
+		n, err := r1.Read(b[:])
+		if n == 0 {
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				continue
+			}
+			return false, err
+		}
+		_, err = io.ReadFull(r2, b2[:n])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(b[:n], b2[:n]) {
+			return false, nil
+		}
+	}
+	// Check the tail of r2
+	_, err := r2.Read(b[:1])
+	if err == nil {
+		return false, nil
+	}
+	if err != io.EOF {
+		return false, err
+	}
+	return true, nil
+}
+
 func xattrsEqual(x1, x2 map[string][]byte) bool {
 	if len(x1) != len(x2) {
 		return false
@@ -149,9 +189,7 @@ func runTestsOnFiles(t *testing.T, testFiles []testFile, opts ...Option) {
 		if !tf.ExpectError && tf.File != nil {
 			f, err := w.Stat(tf.Path)
 			if err != nil {
-				if !strings.Contains(err.Error(), "cannot retrieve") {
-					t.Error(err)
-				}
+				t.Error(err)
 			} else if !fileEqual(f, tf.File) {
 				t.Errorf("%s: stat mismatch: %#v %#v", tf.Path, tf.File, f)
 			}
@@ -168,30 +206,48 @@ func runTestsOnFiles(t *testing.T, testFiles []testFile, opts ...Option) {
 
 	fsck(t, image)
 
+	r, err := NewReader(imagef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tf := range finalTestFiles(testFiles) {
+		verifyTestFileReader(t, r, tf)
+	}
+
 	mountPath := "testmnt"
 
 	if mountImage(t, image, mountPath) {
 		defer unmountImage(t, mountPath)
-		validated := make(map[string]*testFile)
-		for i := range testFiles {
-			tf := testFiles[len(testFiles)-i-1]
-			if validated[tf.Link] != nil {
-				// The link target was subsequently replaced. Find the
-				// earlier instance.
-				for j := range testFiles[:len(testFiles)-i-1] {
-					otf := testFiles[j]
-					if otf.Path == tf.Link && !otf.ExpectError {
-						tf = otf
-						break
-					}
+		for _, tf := range finalTestFiles(testFiles) {
+			verifyTestFile(t, mountPath, tf)
+		}
+	}
+}
+
+// finalTestFiles returns the test files that should be present in the final
+// image, taking into account files that were subsequently replaced.
+func finalTestFiles(testFiles []testFile) []testFile {
+	var final []testFile
+	validated := make(map[string]*testFile)
+	for i := range testFiles {
+		tf := testFiles[len(testFiles)-i-1]
+		if validated[tf.Link] != nil {
+			// The link target was subsequently replaced. Find the
+			// earlier instance.
+			for j := range testFiles[:len(testFiles)-i-1] {
+				otf := testFiles[j]
+				if otf.Path == tf.Link && !otf.ExpectError {
+					tf = otf
+					break
 				}
 			}
-			if !tf.ExpectError && validated[tf.Path] == nil {
-				verifyTestFile(t, mountPath, tf)
-				validated[tf.Path] = &tf
-			}
+		}
+		if !tf.ExpectError && validated[tf.Path] == nil {
+			final = append(final, tf)
+			validated[tf.Path] = &tf
 		}
 	}
+	return final
 }
 
 func TestBasic(t *testing.T) {
@@ -200,8 +256,8 @@ func TestBasic(t *testing.T) {
 		{Path: "empty", File: &File{Mode: 0644}},
 		{Path: "small", File: &File{Mode: 0644}, Data: data[:40]},
 		{Path: "time", File: &File{Atime: now, Ctime: now.Add(time.Second), Mtime: now.Add(time.Hour)}},
-		{Path: "block_1", File: &File{Mode: 0644}, Data: data[:blockSize]},
-		{Path: "block_2", File: &File{Mode: 0644}, Data: data[:blockSize*2]},
+		{Path: "block_1", File: &File{Mode: 0644}, Data: data[:defaultBlockSize]},
+		{Path: "block_2", File: &File{Mode: 0644}, Data: data[:defaultBlockSize*2]},
 		{Path: "symlink", File: &File{Linkname: "block_1", Mode: format.S_IFLNK}},
 		{Path: "symlink_59", File: &File{Linkname: name[:59], Mode: format.S_IFLNK}},
 		{Path: "symlink_60", File: &File{Linkname: name[:60], Mode: format.S_IFLNK}},
@@ -231,7 +287,23 @@ func TestLargeDirectory(t *testing.T) {
 	runTestsOnFiles(t, testFiles)
 }
 
+func TestIndexedDirectory(t *testing.T) {
+	// Long names need enough leaf blocks for a second level of index nodes.
+	testFiles := []testFile{
+		{Path: "bigdir", File: &File{Mode: format.S_IFDIR | 0755}},
+	}
+	for i := 0; i < 10000; i++ {
+		testFiles = append(testFiles, testFile{
+			Path: fmt.Sprintf("bigdir/%d%s", i, name[:200]), File: &File{Mode: 0644},
+		})
+	}
+
+	runTestsOnFiles(t, testFiles)
+	runTestsOnFiles(t, testFiles, MetadataChecksum)
+}
+
 func TestInlineData(t *testing.T) {
+	inlineDataSize := NewWriter(nil).inlineDataSize()
 	testFiles := []testFile{
 		{Path: "inline_30", File: &File{Mode: 0644}, Data: data[:30]},
 		{Path: "inline_60", File: &File{Mode: 0644}, Data: data[:60]},
@@ -267,6 +339,62 @@ func TestXattrs(t *testing.T) {
 	runTestsOnFiles(t, testFiles)
 }
 
+// makeACL returns an ACL in the xattr format from tag, permission and ID
+// triples.
+func makeACL(entries ...uint32) []byte {
+	b := make([]byte, 4, 4+len(entries)/3*8)
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for i := 0; i < len(entries); i += 3 {
+		var e [8]byte
+		binary.LittleEndian.PutUint16(e[:], uint16(entries[i]))
+		binary.LittleEndian.PutUint16(e[2:], uint16(entries[i+1]))
+		binary.LittleEndian.PutUint32(e[4:], entries[i+2])
+		b = append(b, e[:]...)
+	}
+	return b
+}
+
+func TestACLs(t *testing.T) {
+	access := makeACL(
+		uint32(format.ACLUserObj), 6, aclUndefinedID,
+		uint32(format.ACLUser), 4, 1000,
+		uint32(format.ACLGroupObj), 4, aclUndefinedID,
+		uint32(format.ACLGroup), 6, 2000,
+		uint32(format.ACLMask), 6, aclUndefinedID,
+		uint32(format.ACLOther), 0, aclUndefinedID,
+	)
+	def := makeACL(
+		uint32(format.ACLUserObj), 7, aclUndefinedID,
+		uint32(format.ACLGroupObj), 5, aclUndefinedID,
+		uint32(format.ACLOther), 5, aclUndefinedID,
+	)
+	testFiles := []testFile{
+		{Path: "file", File: &File{Mode: format.S_IFREG | 0660, Xattrs: map[string][]byte{"system.posix_acl_access": access}}},
+		{Path: "dir", File: &File{Mode: format.S_IFDIR | 0775, Xattrs: map[string][]byte{
+			"system.posix_acl_access":  access,
+			"system.posix_acl_default": def,
+		}}},
+	}
+	runTestsOnFiles(t, testFiles)
+	runTestsOnFiles(t, testFiles, InodeSize(128), MetadataChecksum)
+
+	// The ACL must be in the xattr format, not the ext4 format.
+	encoded, err := encodeACL(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := NewWriter(f)
+	if err := w.Create("bad", &File{Mode: format.S_IFREG | 0644, Xattrs: map[string][]byte{"system.posix_acl_access": encoded}}); err == nil {
+		t.Error("expected error for an ext4-encoded ACL")
+	}
+}
+
 func TestReplace(t *testing.T) {
 	testFiles := []testFile{
 		{Path: "lost+found", ExpectError: true, File: &File{}}, // can't change type
@@ -304,10 +432,143 @@ func TestReplace(t *testing.T) {
 
 		{Path: "largexattr", File: &File{Xattrs: map[string][]byte{"user.foo": data[:200]}}},
 		{Path: "largexattr_delete", File: &File{}},
+
+		{Path: "blocks", File: &File{}, Data: data},
+		{Path: "blocks", File: &File{}, Data: data[1 : defaultBlockSize+1]}, // fits in the freed blocks
+		{Path: "blocks_grow", File: &File{}, Data: data[:defaultBlockSize]},
+		{Path: "blocks_grow", File: &File{}, Data: data[1:]},
+		{Path: "blocks_empty", File: &File{}, Data: data},
+		{Path: "blocks_empty", File: &File{}},
+		{Path: "symlink_long", File: &File{Mode: format.S_IFLNK, Linkname: name[:300]}},
+		{Path: "symlink_long", File: &File{Mode: format.S_IFLNK, Linkname: name[1:200]}},
 	}
 	runTestsOnFiles(t, testFiles)
 }
 
+func TestReplaceReusesBlocks(t *testing.T) {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewWriter(f)
+	const size = 1024 * 1024
+	for i := 0; i < 10; i++ {
+		for _, name := range []string{"a", "b"} {
+			if err := w.Create(name, &File{Mode: S_IFREG | 0644, Size: size}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(w, io.LimitReader(&largeData{pos: int64(i)}, size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only space for two copies of the data should be needed.
+	if fi.Size() > 3*size {
+		t.Errorf("image too large: %d bytes", fi.Size())
+	}
+	fsck(t, f.Name())
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		fr, err := r.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		same, err := streamEqual(fr, io.LimitReader(&largeData{pos: 9}, size))
+		if err != nil {
+			t.Fatal(err)
+		} else if !same {
+			t.Errorf("%s: data mismatch", name)
+		}
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewWriter(f)
+	create := func(name string, file *File, data []byte) {
+		file.Size = int64(len(data))
+		if err := w.Create(name, file); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("keep", &File{Mode: S_IFREG | 0644}, data)
+	create("dir", &File{Mode: S_IFDIR | 0755}, nil)
+	create("dir/file", &File{Mode: S_IFREG | 0644}, data)
+	create("dir/sub", &File{Mode: S_IFDIR | 0755}, nil)
+	create("dir/sub/xattrs", &File{Mode: S_IFREG | 0644, Xattrs: map[string][]byte{"user.foo": data[:400]}}, nil)
+	create("dir/sub/symlink", &File{Mode: S_IFLNK, Linkname: name[:100]}, nil)
+	if err := w.Link("keep", "dir/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.RemoveAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RemoveAll("dir/missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RemoveAll(""); err == nil {
+		t.Fatal("expected error removing the root")
+	}
+	create("new", &File{Mode: S_IFREG | 0644}, data[1:])
+
+	entries, err := w.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if fmt.Sprint(names) != "[keep lost+found new]" {
+		t.Errorf("unexpected entries %v", names)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f.Name())
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][]byte{"keep": data, "new": data[1:]} {
+		fr, err := r.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		same, err := streamEqual(fr, bytes.NewReader(expected))
+		if err != nil {
+			t.Fatal(err)
+		} else if !same {
+			t.Errorf("%s: data mismatch", name)
+		}
+	}
+}
+
 func TestTime(t *testing.T) {
 	now := time.Now()
 	now2 := fsTimeToTime(timeToFsTime(now))
@@ -353,3 +614,327 @@ func TestLargeDisk(t *testing.T) {
 	}
 	runTestsOnFiles(t, testFiles, MaximumDiskSize(maxMaxDiskSize))
 }
+
+func TestMetadataChecksum(t *testing.T) {
+	testFiles := []testFile{
+		{Path: "small", File: &File{Mode: 0644}, Data: data[:40]},
+		{Path: "block_2", File: &File{Mode: 0644}, Data: data[:defaultBlockSize*2]},
+		{Path: "large", File: &File{}, DataSize: 600 * 1024 * 1024}, // uses an extent block
+		{Path: "symlink_300", File: &File{Linkname: name[:300], Mode: format.S_IFLNK}},
+		{Path: "xattrs", File: &File{Mode: 0644, Xattrs: map[string][]byte{"user.foo": data[:100], "user.bar": data[:50]}}},
+		{Path: "dir", File: &File{Mode: format.S_IFDIR | 0755}},
+	}
+	for i := 0; i < 500; i++ {
+		testFiles = append(testFiles, testFile{
+			Path: fmt.Sprintf("dir/%d", i), File: &File{Mode: 0644},
+		})
+	}
+	runTestsOnFiles(t, testFiles, MetadataChecksum, Use64Bit, InlineData)
+	runTestsOnFiles(t, testFiles, MetadataChecksum, Deterministic)
+}
+
+func TestSparseFile(t *testing.T) {
+	sparse := make([]byte, defaultBlockSize*6+100)
+	copy(sparse, data[:defaultBlockSize+10])
+	copy(sparse[defaultBlockSize*4:], data[:defaultBlockSize])
+	// Alternate data blocks and holes so that the extents need a tree of
+	// depth 2.
+	fragmented := make([]byte, defaultBlockSize*3000)
+	for i := 0; i < len(fragmented); i += defaultBlockSize * 2 {
+		copy(fragmented[i:], data[:defaultBlockSize])
+	}
+	testFiles := []testFile{
+		{Path: "zero", File: &File{}, Data: make([]byte, defaultBlockSize*10)},
+		{Path: "sparse", File: &File{}, Data: sparse},
+		{Path: "fragmented", File: &File{}, Data: fragmented},
+	}
+	runTestsOnFiles(t, testFiles)
+	runTestsOnFiles(t, testFiles, MetadataChecksum)
+}
+
+func TestSparseFileSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewWriter(f)
+	const size = 64 * 1024 * 1024
+	if err := w.Create("zero", &File{Mode: S_IFREG | 0644, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(w, io.LimitReader(zeroReader{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 1024*1024 {
+		t.Errorf("image too large: %d bytes", fi.Size())
+	}
+	fsck(t, f.Name())
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestExpandDisk(t *testing.T) {
+	testFiles := []testFile{
+		{Path: "file", File: &File{}, Data: data},
+		{Path: "dir", File: &File{Mode: S_IFDIR | 0755}},
+	}
+	runTestsOnFiles(t, testFiles, MaximumDiskSize(256*1024*1024), ExpandDisk)
+}
+
+func TestExpandDiskSize(t *testing.T) {
+	const size = 100 * 1024 * 1024
+	image := "testfs.img"
+	imagef, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(image)
+	defer imagef.Close()
+
+	w := NewWriter(imagef, MaximumDiskSize(size), ExpandDisk)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := imagef.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Fatalf("expected size %d, got %d", size, fi.Size())
+	}
+	r, err := NewReader(imagef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != size {
+		t.Fatalf("expected file system size %d, got %d", size, r.Size())
+	}
+	fsck(t, image)
+}
+
+func TestBlockSize(t *testing.T) {
+	testFiles := []testFile{
+		{Path: "small", File: &File{Mode: 0644}, Data: data[:40]},
+		{Path: "block_2", File: &File{Mode: 0644}, Data: data[:defaultBlockSize*2]},
+		{Path: "large", File: &File{}, DataSize: 200 * 1024 * 1024}, // uses an extent block
+		{Path: "xattrs", File: &File{Mode: 0644, Xattrs: map[string][]byte{"user.foo": data[:500]}}},
+		{Path: "dir", File: &File{Mode: format.S_IFDIR | 0755}},
+	}
+	for i := 0; i < 500; i++ {
+		testFiles = append(testFiles, testFile{
+			Path: fmt.Sprintf("dir/%d", i), File: &File{Mode: 0644},
+		})
+	}
+	for _, size := range []int{1024, 2048} {
+		runTestsOnFiles(t, testFiles, BlockSize(size), MetadataChecksum, InlineData)
+		runTestsOnFiles(t, testFiles, BlockSize(size), ExpandDisk, MaximumDiskSize(512*1024*1024))
+	}
+}
+
+func TestSmallInodes(t *testing.T) {
+	testFiles := []testFile{
+		{Path: "small", File: &File{Mode: 0644}, Data: data[:40]},
+		{Path: "xattrs", File: &File{Mode: 0644, Xattrs: map[string][]byte{"user.foo": data[:10]}}},
+		{Path: "dir", File: &File{Mode: format.S_IFDIR | 0755}},
+	}
+	// Inline data is not possible without room for the system.data
+	// attribute, so it is ignored.
+	runTestsOnFiles(t, testFiles, InodeSize(128), MetadataChecksum, InlineData)
+}
+
+func TestInvalidGeometry(t *testing.T) {
+	for _, opt := range []Option{BlockSize(8192), InodeSize(512), InodeRatio(512), ReservedBlocksPercentage(60), Journal(4096)} {
+		f, err := ioutil.TempFile("", "compactext4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := NewWriter(f, opt).Close(); err == nil {
+			t.Error("expected error for invalid option")
+		}
+	}
+}
+
+func TestInodeCount(t *testing.T) {
+	tests := []struct {
+		opts      []Option
+		minInodes uint32
+	}{
+		{[]Option{InodeCount(5000)}, 5000},
+		{[]Option{InodeCount(5000), ExpandDisk, MaximumDiskSize(16 * 1024 * 1024)}, 5000},
+		{[]Option{InodeRatio(4096), ExpandDisk, MaximumDiskSize(64 * 1024 * 1024)}, 64 * 1024 * 1024 / 4096},
+	}
+	for _, test := range tests {
+		image := "testfs.img"
+		imagef, err := os.Create(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(image)
+		defer imagef.Close()
+
+		w := NewWriter(imagef, append(test.opts, ReservedBlocksPercentage(5))...)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(imagef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.sb.InodesCount < test.minInodes {
+			t.Errorf("expected at least %d inodes, got %d", test.minInodes, r.sb.InodesCount)
+		}
+		if reserved := r.sb.BlocksCountLow * 5 / 100; r.sb.RootBlocksCountLow != reserved {
+			t.Errorf("expected %d reserved blocks, got %d", reserved, r.sb.RootBlocksCountLow)
+		}
+		fsck(t, image)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	testFiles := []testFile{
+		{Path: "file", File: &File{}, Data: data},
+		{Path: "dir", File: &File{Mode: S_IFDIR | 0755}},
+	}
+	runTestsOnFiles(t, testFiles, Journal(0), ExpandDisk, MaximumDiskSize(256*1024*1024))
+	runTestsOnFiles(t, testFiles, Journal(8*1024*1024), MetadataChecksum, Use64Bit, Deterministic)
+	// A journal of more than four extents needs an extent tree block.
+	runTestsOnFiles(t, testFiles, Journal(160*1024*1024), BlockSize(1024), MetadataChecksum, ExpandDisk, MaximumDiskSize(512*1024*1024))
+
+	image := "testfs.img"
+	imagef, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(image)
+	defer imagef.Close()
+	w := NewWriter(imagef, Journal(0), ExpandDisk, MaximumDiskSize(256*1024*1024))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(imagef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.sb.FeatureCompat&format.CompatHasJournal == 0 || r.sb.JournalInum != format.InodeJournal {
+		t.Fatal("journal not recorded in the superblock")
+	}
+	node, err := r.readInode(format.InodeJournal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mke2fs uses 4096 blocks for a 65536-block file system.
+	if size := int64(4096 * defaultBlockSize); node.Size != size {
+		t.Errorf("expected journal size %d, got %d", size, node.Size)
+	}
+	var hdr format.JournalHeader
+	if _, err := imagef.Seek(int64(node.Extents[0].Start)*defaultBlockSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Read(imagef, binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Magic != format.JournalMagic || hdr.BlockType != format.JournalBlockTypeSuperBlockV2 {
+		t.Errorf("bad journal superblock header %+v", hdr)
+	}
+}
+
+// writeTestImage writes an image containing files and returns its contents and
+// UUID.
+func writeTestImage(t *testing.T, files []testFile, opts ...Option) ([]byte, [16]byte) {
+	f, err := ioutil.TempFile("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewWriter(f, opts...)
+	for _, tf := range files {
+		createTestFile(t, w, tf)
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, w.UUID()
+}
+
+// deterministicTestFiles returns the files of the images compared by
+// TestDeterministic.
+func deterministicTestFiles() []testFile {
+	mtime := time.Unix(1500000000, 0)
+	var files []testFile
+	for i := 0; i < 20; i++ {
+		dir := fmt.Sprintf("dir%d", i)
+		files = append(files,
+			testFile{Path: dir, File: &File{Mode: S_IFDIR | 0755, Mtime: mtime}},
+			testFile{Path: dir + "/file", File: &File{Mode: S_IFREG | 0644, Mtime: mtime}, Data: data},
+		)
+	}
+	return files
+}
+
+func TestDeterministic(t *testing.T) {
+	b1, uuid1 := writeTestImage(t, deterministicTestFiles(), Deterministic)
+	b2, uuid2 := writeTestImage(t, deterministicTestFiles(), Deterministic)
+	if uuid1 != uuid2 {
+		t.Errorf("UUID mismatch: %x != %x", uuid1, uuid2)
+	}
+	if uuid1 == [16]byte{} {
+		t.Error("UUID was not set")
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Error("images differ")
+	}
+
+	b3, uuid3 := writeTestImage(t, deterministicTestFiles())
+	b4, _ := writeTestImage(t, deterministicTestFiles())
+	if uuid3 != [16]byte{} {
+		t.Errorf("expected the zero UUID by default, got %x", uuid3)
+	}
+	if !bytes.Equal(b3, b4) {
+		t.Error("images differ without Deterministic")
+	}
+}
+
+// verifyImage runs Verify on image and fails the test if it reports any
+// findings.
+func verifyImage(t *testing.T, image string) {
+	f, err := os.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	findings, err := Verify(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, finding := range findings {
+		t.Error(finding)
+	}
+}
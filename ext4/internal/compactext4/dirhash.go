@@ -0,0 +1,109 @@
+package compactext4
+
+// This file implements the half-MD4 directory hash used by ext4 hashed
+// directory indexes, following fs/ext4/hash.c in the Linux kernel.
+
+var defaultHashSeed = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+
+func rol32(x uint32, s uint) uint32 {
+	return x<<s | x>>(32-s)
+}
+
+func halfMD4Transform(buf *[4]uint32, in *[8]uint32) {
+	const (
+		k1 = 0
+		k2 = 0x5a827999
+		k3 = 0x6ed9eba1
+	)
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+
+	// Round 1
+	a = rol32(a+f(b, c, d)+in[0]+k1, 3)
+	d = rol32(d+f(a, b, c)+in[1]+k1, 7)
+	c = rol32(c+f(d, a, b)+in[2]+k1, 11)
+	b = rol32(b+f(c, d, a)+in[3]+k1, 19)
+	a = rol32(a+f(b, c, d)+in[4]+k1, 3)
+	d = rol32(d+f(a, b, c)+in[5]+k1, 7)
+	c = rol32(c+f(d, a, b)+in[6]+k1, 11)
+	b = rol32(b+f(c, d, a)+in[7]+k1, 19)
+
+	// Round 2
+	a = rol32(a+g(b, c, d)+in[1]+k2, 3)
+	d = rol32(d+g(a, b, c)+in[3]+k2, 5)
+	c = rol32(c+g(d, a, b)+in[5]+k2, 9)
+	b = rol32(b+g(c, d, a)+in[7]+k2, 13)
+	a = rol32(a+g(b, c, d)+in[0]+k2, 3)
+	d = rol32(d+g(a, b, c)+in[2]+k2, 5)
+	c = rol32(c+g(d, a, b)+in[4]+k2, 9)
+	b = rol32(b+g(c, d, a)+in[6]+k2, 13)
+
+	// Round 3
+	a = rol32(a+h(b, c, d)+in[3]+k3, 3)
+	d = rol32(d+h(a, b, c)+in[7]+k3, 9)
+	c = rol32(c+h(d, a, b)+in[2]+k3, 11)
+	b = rol32(b+h(c, d, a)+in[6]+k3, 15)
+	a = rol32(a+h(b, c, d)+in[1]+k3, 3)
+	d = rol32(d+h(a, b, c)+in[5]+k3, 9)
+	c = rol32(c+h(d, a, b)+in[0]+k3, 11)
+	b = rol32(b+h(c, d, a)+in[4]+k3, 15)
+
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
+
+// str2hashbuf packs up to len(in)*4 bytes of msg into in, treating the bytes
+// as unsigned.
+func str2hashbuf(msg string, in []uint32) {
+	pad := uint32(len(msg)) | uint32(len(msg))<<8
+	pad |= pad << 16
+
+	val := pad
+	if len(msg) > len(in)*4 {
+		msg = msg[:len(in)*4]
+	}
+	n := 0
+	for i := 0; i < len(msg); i++ {
+		val = uint32(msg[i]) + val<<8
+		if i%4 == 3 {
+			in[n] = val
+			n++
+			val = pad
+		}
+	}
+	if n < len(in) {
+		in[n] = val
+		n++
+	}
+	for ; n < len(in); n++ {
+		in[n] = pad
+	}
+}
+
+// dirHashHalfMD4 returns the major and minor half-MD4 hashes of name using the
+// unsigned variant of the algorithm.
+func dirHashHalfMD4(name string, seed [4]uint32) (uint32, uint32) {
+	buf := seed
+	if buf == [4]uint32{} {
+		buf = defaultHashSeed
+	}
+	var in [8]uint32
+	for p := name; ; p = p[32:] {
+		str2hashbuf(p, in[:])
+		halfMD4Transform(&buf, &in)
+		if len(p) <= 32 {
+			break
+		}
+	}
+	hash := buf[1] &^ 1
+	if hash == 0x7fffffff<<1 {
+		// This value is reserved to mark the end of the directory.
+		hash = (0x7fffffff - 1) << 1
+	}
+	return hash, buf[2]
+}
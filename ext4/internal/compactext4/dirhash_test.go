@@ -0,0 +1,22 @@
+package compactext4
+
+import "testing"
+
+func TestDirHashHalfMD4(t *testing.T) {
+	// Expected values were generated with debugfs's dx_hash command.
+	tests := []struct {
+		name        string
+		seed        [4]uint32
+		hash, minor uint32
+	}{
+		{"hello", [4]uint32{}, 0x1746da32, 0x420013b5},
+		{"0123456789abcdefghijklmnopqrstuvwxyzABCD", [4]uint32{}, 0x4059ff28, 0x8b91bf23},
+		{"hello", [4]uint32{0x67452301, 0xefcdab89, 0x67452301, 0xefcdab89}, 0xa26e4a80, 0x97e5b7f7},
+	}
+	for _, test := range tests {
+		hash, minor := dirHashHalfMD4(test.name, test.seed)
+		if hash != test.hash || minor != test.minor {
+			t.Errorf("%s: expected %#x/%#x, got %#x/%#x", test.name, test.hash, test.minor, hash, minor)
+		}
+	}
+}
@@ -0,0 +1,1278 @@
+package compactext4
+
+// This file implements Verify, an in-process consistency check of ext4 file
+// system images. It follows the passes of e2fsck: inodes and the blocks they
+// map, directory structure, reference counts, and finally the bitmaps and
+// summary counts.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+// FindingKind classifies the problems reported by Verify.
+type FindingKind int
+
+const (
+	// FindingSuperBlock is a problem with the superblock fields or summary
+	// counts.
+	FindingSuperBlock FindingKind = iota
+	// FindingGroupDescriptor is a problem with a block group descriptor.
+	FindingGroupDescriptor
+	// FindingBitmap is a difference between a block or inode bitmap and the
+	// blocks or inodes that are actually in use.
+	FindingBitmap
+	// FindingInode is a problem with an inode or the blocks it maps.
+	FindingInode
+	// FindingLinkCount is an inode whose link count does not match the
+	// directory entries that refer to it.
+	FindingLinkCount
+	// FindingDirectory is a problem with directory entries or indexes.
+	FindingDirectory
+	// FindingXattr is a problem with extended attributes.
+	FindingXattr
+	// FindingChecksum is a metadata checksum mismatch.
+	FindingChecksum
+)
+
+var findingKindNames = []string{
+	"superblock",
+	"group descriptor",
+	"bitmap",
+	"inode",
+	"link count",
+	"directory",
+	"xattr",
+	"checksum",
+}
+
+func (k FindingKind) String() string {
+	if int(k) < len(findingKindNames) {
+		return findingKindNames[k]
+	}
+	return fmt.Sprintf("FindingKind(%d)", int(k))
+}
+
+// A Finding describes one inconsistency found by Verify.
+type Finding struct {
+	Kind    FindingKind
+	Inode   uint32 // the inode concerned, or 0 if there is none
+	Block   uint64 // the block concerned, or 0 if there is none
+	Message string
+}
+
+func (f Finding) String() string {
+	s := f.Kind.String()
+	if f.Inode != 0 {
+		s += fmt.Sprintf(": inode %d", f.Inode)
+	}
+	if f.Block != 0 {
+		s += fmt.Sprintf(": block %d", f.Block)
+	}
+	return s + ": " + f.Message
+}
+
+// blockSet is a bitmap of file system blocks.
+type blockSet []uint64
+
+func newBlockSet(n uint64) blockSet {
+	return make(blockSet, (n+63)/64)
+}
+
+func (s blockSet) has(i uint64) bool {
+	return s[i/64]&(1<<(i%64)) != 0
+}
+
+// add adds i to the set and reports whether it was already present.
+func (s blockSet) add(i uint64) bool {
+	had := s.has(i)
+	s[i/64] |= 1 << (i % 64)
+	return had
+}
+
+func bitSet(b []byte, i uint64) bool {
+	return b[i/8]&(1<<(i%8)) != 0
+}
+
+type xattrBlockRef struct {
+	refs, declared uint32
+}
+
+type verifier struct {
+	fs       *Reader
+	sb       *format.SuperBlock
+	findings []Finding
+
+	blocks     uint64 // the number of blocks in the file system
+	groups     uint32
+	descSize   int64
+	gds        []format.GroupDescriptor64
+	csum       bool // metadata_csum
+	gdtCsum    bool // uninit_bg
+	csumSeed   uint32
+	firstInode uint32
+
+	used        blockSet // blocks found to be in use
+	meta        blockSet // the subset of used that holds group metadata
+	allocated   []bool   // allocated inodes, by number
+	modes       []uint16
+	links       []uint16
+	refs        []uint32 // directory entries referring to each inode
+	parents     []uint32 // the directory containing each directory
+	dotdot      []uint32 // the ".." entry of each directory
+	dirs        []uint32
+	groupDirs   []uint32
+	groupInodes []uint32 // allocated inodes in each group
+	xattrBlocks map[uint64]*xattrBlockRef
+}
+
+// Verify checks the consistency of the ext4 file system image read from r
+// without mounting it or running e2fsck. It cross-checks the superblock and
+// group descriptor counts, the block and inode bitmaps against the blocks and
+// inodes actually in use, inode link counts against directory references,
+// directory entries and indexes, extended attribute hashes and, when the
+// metadata_csum feature is enabled, metadata checksums.
+//
+// Problems with the file system are returned as findings. An error is
+// returned only if the image cannot be read or is not an ext4 file system
+// that Verify supports.
+func Verify(r io.ReaderAt) ([]Finding, error) {
+	fs, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{fs: fs, sb: &fs.sb}
+	if ok, err := v.checkSuperBlock(); err != nil || !ok {
+		return v.findings, err
+	}
+	if err := v.checkGroupDescriptors(); err != nil {
+		return nil, err
+	}
+	if err := v.checkInodes(); err != nil {
+		return nil, err
+	}
+	if err := v.checkDirectories(); err != nil {
+		return nil, err
+	}
+	v.checkLinkCounts()
+	if err := v.checkBlockBitmaps(); err != nil {
+		return nil, err
+	}
+	return v.findings, nil
+}
+
+func (v *verifier) addf(kind FindingKind, ino uint32, block uint64, f string, args ...interface{}) {
+	v.findings = append(v.findings, Finding{
+		Kind:    kind,
+		Inode:   ino,
+		Block:   block,
+		Message: fmt.Sprintf(f, args...),
+	})
+}
+
+func (v *verifier) readAt(b []byte, off int64) error {
+	if _, err := v.fs.r.ReadAt(b, off); err != nil {
+		return fmt.Errorf("reading at offset %d: %s", off, err)
+	}
+	return nil
+}
+
+// checkSuperBlock checks the superblock fields that the rest of the
+// verification depends on. It returns false if the file system is too
+// damaged to continue.
+func (v *verifier) checkSuperBlock() (bool, error) {
+	sb := v.sb
+	const unsupported = format.IncompatCompression | format.IncompatJournalDev | format.IncompatDirdata | format.IncompatEaInode
+	if f := sb.FeatureIncompat & unsupported; f != 0 {
+		return false, fmt.Errorf("unsupported incompatible features %#x", uint32(f))
+	}
+	if sb.FeatureRoCompat&format.RoCompatBigalloc != 0 {
+		return false, fmt.Errorf("bigalloc file systems are not supported")
+	}
+
+	v.csum = sb.FeatureRoCompat&format.RoCompatMetadataCsum != 0
+	v.gdtCsum = sb.FeatureRoCompat&format.RoCompatGdtCsum != 0
+	if v.csum {
+		var b [1024]byte
+		if err := v.readAt(b[:], 1024); err != nil {
+			return false, err
+		}
+		if sb.ChecksumType != 1 {
+			v.addf(FindingSuperBlock, 0, 0, "unknown checksum type %d", sb.ChecksumType)
+		} else if csum := superBlockChecksum(b[:]); csum != sb.Checksum {
+			v.addf(FindingChecksum, 0, 0, "superblock checksum %#x, expected %#x", sb.Checksum, csum)
+		}
+		if sb.FeatureIncompat&format.IncompatCsumSeed != 0 {
+			v.csumSeed = sb.ChecksumSeed
+		} else {
+			v.csumSeed = crc32c(^uint32(0), sb.UUID[:])
+		}
+	}
+	if sb.FeatureIncompat&format.IncompatRecover != 0 {
+		v.addf(FindingSuperBlock, 0, 0, "the journal needs recovery")
+	}
+
+	v.blocks = uint64(sb.BlocksCountLow)
+	if sb.FeatureIncompat&format.Incompat_64Bit != 0 {
+		v.blocks |= uint64(sb.BlocksCountHigh) << 32
+	}
+	bs := uint64(v.fs.blockSize)
+	expectedFirst := uint32(0)
+	if bs == 1024 {
+		expectedFirst = 1
+	}
+	if sb.FirstDataBlock != expectedFirst {
+		v.addf(FindingSuperBlock, 0, 0, "first data block %d, expected %d", sb.FirstDataBlock, expectedFirst)
+		return false, nil
+	}
+	if sb.BlocksPerGroup > uint32(bs*8) || sb.ClustersPerGroup != sb.BlocksPerGroup {
+		v.addf(FindingSuperBlock, 0, 0, "invalid blocks per group %d", sb.BlocksPerGroup)
+		return false, nil
+	}
+	if sb.InodesPerGroup > uint32(bs*8) || uint64(sb.InodesPerGroup)*uint64(v.fs.inodeSize)%bs != 0 {
+		v.addf(FindingSuperBlock, 0, 0, "invalid inodes per group %d", sb.InodesPerGroup)
+		return false, nil
+	}
+	if v.blocks <= uint64(sb.FirstDataBlock) {
+		v.addf(FindingSuperBlock, 0, 0, "invalid block count %d", v.blocks)
+		return false, nil
+	}
+	groups := (v.blocks - uint64(sb.FirstDataBlock) + uint64(sb.BlocksPerGroup) - 1) / uint64(sb.BlocksPerGroup)
+	if groups != uint64(len(v.fs.gds)) || uint64(sb.InodesCount) != groups*uint64(sb.InodesPerGroup) {
+		v.addf(FindingSuperBlock, 0, 0, "%d inodes do not fill %d groups of %d", sb.InodesCount, groups, sb.InodesPerGroup)
+		return false, nil
+	}
+	v.groups = uint32(groups)
+
+	v.firstInode = format.InodeRoot + 1
+	if sb.RevisionLevel != 0 {
+		v.firstInode = sb.FirstInode
+	}
+	if v.firstInode <= format.InodeRoot || v.firstInode > sb.InodesCount {
+		v.addf(FindingSuperBlock, 0, 0, "invalid first inode %d", v.firstInode)
+		return false, nil
+	}
+	return true, nil
+}
+
+// hasSuperBlock reports whether group g holds a copy of the superblock and
+// group descriptors.
+func (v *verifier) hasSuperBlock(g uint32) bool {
+	sb := v.sb
+	if g == 0 {
+		return true
+	}
+	if sb.FeatureCompat&format.CompatSparseSuper2 != 0 {
+		return g == sb.BackupBgs[0] || g == sb.BackupBgs[1]
+	}
+	if sb.FeatureRoCompat&format.RoCompatSparseSuper == 0 || g == 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// useBlocks marks count blocks starting at start as used by ino, or by group
+// metadata if ino is 0. It reports whether the whole range is within the file
+// system.
+func (v *verifier) useBlocks(start, count uint64, ino uint32, what string) bool {
+	kind := FindingInode
+	if ino == 0 {
+		kind = FindingGroupDescriptor
+	}
+	if start < uint64(v.sb.FirstDataBlock) || start >= v.blocks || count > v.blocks-start {
+		v.addf(kind, ino, start, "%s: %d blocks out of range", what, count)
+		return false
+	}
+	var dup, first uint64
+	for b := start; b < start+count; b++ {
+		if v.used.add(b) {
+			if dup == 0 {
+				first = b
+			}
+			dup++
+		}
+		if ino == 0 {
+			v.meta.add(b)
+		}
+	}
+	if dup != 0 {
+		v.addf(kind, ino, first, "%s: %d blocks are also used elsewhere", what, dup)
+	}
+	return true
+}
+
+func (v *verifier) checkGroupDescriptors() error {
+	sb := v.sb
+	bs := uint64(v.fs.blockSize)
+	v.descSize = groupDescriptorSize
+	if sb.FeatureIncompat&format.Incompat_64Bit != 0 {
+		v.descSize = int64(sb.DescSize)
+	}
+	gdBlocks := (uint64(v.groups)*uint64(v.descSize) + bs - 1) / bs
+	gdb := make([]byte, gdBlocks*bs)
+	if err := v.readAt(gdb, (int64(sb.FirstDataBlock)+1)*int64(bs)); err != nil {
+		return err
+	}
+
+	v.used = newBlockSet(v.blocks)
+	v.meta = newBlockSet(v.blocks)
+	v.gds = make([]format.GroupDescriptor64, v.groups)
+	itableBlocks := uint64(sb.InodesPerGroup) * uint64(v.fs.inodeSize) / bs
+	for g := uint32(0); g < v.groups; g++ {
+		d := gdb[int64(g)*v.descSize : int64(g+1)*v.descSize]
+		var raw [groupDescriptorSize64]byte
+		copy(raw[:], d)
+		gd := &v.gds[g]
+		binary.Read(bytes.NewReader(raw[:]), binary.LittleEndian, gd)
+		if v.csum || v.gdtCsum {
+			if csum := v.groupDescriptorChecksum(g, d); csum != gd.Checksum {
+				v.addf(FindingChecksum, 0, 0, "group %d: descriptor checksum %#x, expected %#x", g, gd.Checksum, csum)
+			}
+		}
+
+		if v.hasSuperBlock(g) {
+			start := uint64(sb.FirstDataBlock) + uint64(g)*uint64(sb.BlocksPerGroup)
+			v.useBlocks(start, 1+gdBlocks+uint64(sb.ReservedGdtBlocks), 0, fmt.Sprintf("group %d superblock and descriptors", g))
+		}
+		v.useBlocks(groupBlockBitmap(gd), 1, 0, fmt.Sprintf("group %d block bitmap", g))
+		v.useBlocks(groupInodeBitmap(gd), 1, 0, fmt.Sprintf("group %d inode bitmap", g))
+		if !v.useBlocks(groupInodeTable(gd), itableBlocks, 0, fmt.Sprintf("group %d inode table", g)) {
+			return fmt.Errorf("group %d: inode table out of range", g)
+		}
+	}
+	return nil
+}
+
+func groupBlockBitmap(gd *format.GroupDescriptor64) uint64 {
+	return uint64(gd.BlockBitmapLow) | uint64(gd.BlockBitmapHigh)<<32
+}
+
+func groupInodeBitmap(gd *format.GroupDescriptor64) uint64 {
+	return uint64(gd.InodeBitmapLow) | uint64(gd.InodeBitmapHigh)<<32
+}
+
+func groupInodeTable(gd *format.GroupDescriptor64) uint64 {
+	return uint64(gd.InodeTableLow) | uint64(gd.InodeTableHigh)<<32
+}
+
+// groupDescriptorChecksum returns the checksum of the encoded descriptor b for
+// group g.
+func (v *verifier) groupDescriptorChecksum(g uint32, b []byte) uint16 {
+	d := append([]byte(nil), b...)
+	d[groupDescriptorChecksumOffset] = 0
+	d[groupDescriptorChecksumOffset+1] = 0
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], g)
+	if v.csum {
+		return uint16(crc32c(crc32c(v.csumSeed, n[:]), d))
+	}
+	crc := crc16(^uint16(0), v.sb.UUID[:])
+	crc = crc16(crc, n[:])
+	crc = crc16(crc, d[:groupDescriptorChecksumOffset])
+	return crc16(crc, d[groupDescriptorChecksumOffset+2:])
+}
+
+// crc16 continues the CRC16 (polynomial 0x8005, reflected) used by the
+// uninit_bg group descriptor checksums.
+func crc16(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// bitmapChecksumMatches reports whether the checksum of bitmap b matches the
+// checksum stored in the group descriptor as lo and hi.
+func (v *verifier) bitmapChecksumMatches(b []byte, lo, hi uint16) bool {
+	csum := crc32c(v.csumSeed, b)
+	if v.descSize >= groupDescriptorSize64 {
+		return csum == uint32(lo)|uint32(hi)<<16
+	}
+	return uint16(csum) == lo
+}
+
+func (v *verifier) checkInodes() error {
+	sb := v.sb
+	n := uint64(sb.InodesCount) + 1
+	v.allocated = make([]bool, n)
+	v.modes = make([]uint16, n)
+	v.links = make([]uint16, n)
+	v.refs = make([]uint32, n)
+	v.parents = make([]uint32, n)
+	v.dotdot = make([]uint32, n)
+	v.groupDirs = make([]uint32, v.groups)
+	v.groupInodes = make([]uint32, v.groups)
+	v.xattrBlocks = make(map[uint64]*xattrBlockRef)
+
+	ipg := sb.InodesPerGroup
+	is := v.fs.inodeSize
+	bs := v.fs.blockSize
+	var totalFree uint64
+	for g := uint32(0); g < v.groups; g++ {
+		gd := &v.gds[g]
+		uninit := (v.csum || v.gdtCsum) && gd.Flags&format.BlockGroupInodeUninit != 0
+		bitmap := make([]byte, bs)
+		initialized := ipg
+		if !uninit {
+			if err := v.readAt(bitmap, int64(groupInodeBitmap(gd))*bs); err != nil {
+				return err
+			}
+			if v.csum && !v.bitmapChecksumMatches(bitmap[:ipg/8], gd.InodeBitmapCsumLow, gd.InodeBitmapCsumHigh) {
+				v.addf(FindingChecksum, 0, groupInodeBitmap(gd), "group %d: inode bitmap checksum mismatch", g)
+			}
+			for i := uint64(ipg); i < uint64(bs)*8; i++ {
+				if !bitSet(bitmap, i) {
+					v.addf(FindingBitmap, 0, groupInodeBitmap(gd), "group %d: padding at the end of the inode bitmap is not set", g)
+					break
+				}
+			}
+			if v.csum || v.gdtCsum {
+				unused := uint32(gd.ItableUnusedLow) | uint32(gd.ItableUnusedHigh)<<16
+				if unused > ipg {
+					v.addf(FindingGroupDescriptor, 0, 0, "group %d: %d unused inodes out of %d", g, unused, ipg)
+					unused = 0
+				}
+				initialized = ipg - unused
+			}
+		} else {
+			initialized = 0
+		}
+
+		table := make([]byte, int64(initialized)*is)
+		if err := v.readAt(table, int64(groupInodeTable(gd))*bs); err != nil {
+			return err
+		}
+		for i := uint32(0); i < ipg; i++ {
+			ino := g*ipg + i + 1
+			inBitmap := bitSet(bitmap, uint64(i))
+			if i >= initialized {
+				if inBitmap {
+					v.addf(FindingBitmap, ino, 0, "inode is marked in use but is in the unused part of the inode table")
+				}
+				continue
+			}
+			raw := table[int64(i)*is : int64(i+1)*is]
+			links := binary.LittleEndian.Uint16(raw[26:])
+			if ino < v.firstInode {
+				if !inBitmap {
+					v.addf(FindingBitmap, ino, 0, "reserved inode is marked free")
+				}
+				v.groupInodes[g]++
+				v.checkReservedInode(ino, raw)
+				continue
+			}
+			allocated := links != 0
+			if allocated != inBitmap {
+				if allocated {
+					v.addf(FindingBitmap, ino, 0, "inode is in use but marked free")
+				} else {
+					v.addf(FindingBitmap, ino, 0, "inode is marked in use but is free")
+				}
+			}
+			if allocated {
+				v.groupInodes[g]++
+				v.checkInode(ino, raw)
+				if v.modes[ino]&format.TypeMask == format.S_IFDIR {
+					v.groupDirs[g]++
+				}
+			}
+		}
+
+		free := ipg - v.groupInodes[g]
+		totalFree += uint64(free)
+		if gdFree := uint32(gd.FreeInodesCountLow) | uint32(gd.FreeInodesCountHigh)<<16; gdFree != free {
+			v.addf(FindingGroupDescriptor, 0, 0, "group %d: free inode count %d, counted %d", g, gdFree, free)
+		}
+		if gdDirs := uint32(gd.UsedDirsCountLow) | uint32(gd.UsedDirsCountHigh)<<16; gdDirs != v.groupDirs[g] {
+			v.addf(FindingGroupDescriptor, 0, 0, "group %d: directory count %d, counted %d", g, gdDirs, v.groupDirs[g])
+		}
+	}
+	if uint64(sb.FreeInodesCount) != totalFree {
+		v.addf(FindingSuperBlock, 0, 0, "free inode count %d, counted %d", sb.FreeInodesCount, totalFree)
+	}
+
+	for block, ref := range v.xattrBlocks {
+		if ref.declared != 0 && ref.refs != ref.declared {
+			v.addf(FindingXattr, 0, block, "reference count %d, counted %d", ref.declared, ref.refs)
+		}
+	}
+	return nil
+}
+
+// checkReservedInode checks an inode below the first non-reserved inode.
+func (v *verifier) checkReservedInode(ino uint32, raw []byte) {
+	mode := binary.LittleEndian.Uint16(raw)
+	switch {
+	case ino == 7:
+		// The resize inode maps the reserved group descriptor blocks, which
+		// are accounted for with the group metadata, through a single
+		// double-indirect block.
+		if v.sb.FeatureCompat&format.CompatResizeInode != 0 {
+			if dind := binary.LittleEndian.Uint32(raw[40+13*4:]); dind != 0 {
+				v.useBlocks(uint64(dind), 1, ino, "resize inode")
+			}
+		}
+	case ino == format.InodeRoot:
+		if mode&format.TypeMask != format.S_IFDIR || binary.LittleEndian.Uint16(raw[26:]) == 0 {
+			v.addf(FindingInode, ino, 0, "root inode is not an allocated directory")
+			return
+		}
+		v.checkInode(ino, raw)
+		v.groupDirs[0]++
+	case mode != 0:
+		// The journal, quota files and so on.
+		v.checkInode(ino, raw)
+		v.allocated[ino] = false
+	}
+}
+
+// inodeSeed returns the checksum seed for inode ino with generation gen.
+func (v *verifier) inodeSeed(ino, gen uint32) uint32 {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[:], ino)
+	binary.LittleEndian.PutUint32(b[4:], gen)
+	return crc32c(v.csumSeed, b[:])
+}
+
+func (v *verifier) checkInode(ino uint32, raw []byte) {
+	sb := v.sb
+	var node format.Inode
+	extra := 0
+	if len(raw) > 128 {
+		extra = int(binary.LittleEndian.Uint16(raw[128:]))
+		if 128+extra > len(raw) || extra%4 != 0 {
+			v.addf(FindingInode, ino, 0, "invalid extra inode size %d", extra)
+			extra = 0
+		}
+	}
+	var decoded [256]byte
+	copy(decoded[:], raw[:128+extra])
+	binary.Read(bytes.NewReader(decoded[:inodeStructSize]), binary.LittleEndian, &node)
+	v.allocated[ino] = true
+	v.modes[ino] = node.Mode
+	v.links[ino] = node.LinksCount
+
+	seed := v.inodeSeed(ino, node.Generation)
+	if v.csum {
+		b := append([]byte(nil), raw...)
+		b[inodeChecksumLowOffset], b[inodeChecksumLowOffset+1] = 0, 0
+		stored := uint32(node.ChecksumLow)
+		if extra >= 4 {
+			b[inodeChecksumHighOffset], b[inodeChecksumHighOffset+1] = 0, 0
+			stored |= uint32(node.ChecksumHigh) << 16
+		}
+		csum := crc32c(seed, b)
+		if extra < 4 {
+			csum &= 0xffff
+		}
+		if csum != stored {
+			v.addf(FindingChecksum, ino, 0, "inode checksum %#x, expected %#x", stored, csum)
+		}
+	}
+
+	typ := node.Mode & format.TypeMask
+	switch typ {
+	case format.S_IFREG, format.S_IFDIR, format.S_IFLNK, format.S_IFCHR, format.S_IFBLK, format.S_IFIFO, format.S_IFSOCK:
+	default:
+		v.addf(FindingInode, ino, 0, "invalid file type %#o", typ)
+		return
+	}
+	if typ == format.S_IFDIR {
+		v.dirs = append(v.dirs, ino)
+	}
+
+	// Extended attributes.
+	xattrs := make(map[string][]byte)
+	if xb := raw[128+extra:]; extra != 0 && len(xb) >= 4 && binary.LittleEndian.Uint32(xb) == format.XAttrHeaderMagic {
+		v.checkXattrEntries(ino, 0, xb[4:], 0, false, xattrs)
+	}
+	var blocks uint64
+	if xblock := uint64(node.XattrBlockLow) | uint64(node.XattrBlockHigh)<<32; xblock != 0 {
+		if sb.FeatureCompat&format.CompatExtAttr == 0 {
+			v.addf(FindingXattr, ino, xblock, "xattr block present without the ext_attr feature")
+		}
+		v.checkXattrBlock(ino, xblock)
+		blocks++
+	}
+
+	// Data.
+	size := uint64(node.SizeLow) | uint64(node.SizeHigh)<<32
+	bs := uint64(v.fs.blockSize)
+	switch {
+	case node.Flags&format.InodeFlagInlineData != 0:
+		if sb.FeatureIncompat&format.IncompatInlineData == 0 {
+			v.addf(FindingInode, ino, 0, "inline data without the inline_data feature")
+		}
+		if size > uint64(len(node.Block)+len(xattrs["system.data"])) {
+			v.addf(FindingInode, ino, 0, "size %d exceeds the inline data", size)
+		}
+	case node.Flags&format.InodeFlagExtents != 0:
+		if sb.FeatureIncompat&format.IncompatExtents == 0 {
+			v.addf(FindingInode, ino, 0, "extents without the extent feature")
+		}
+		var end uint64
+		blocks += v.checkExtents(ino, seed, node.Block[:], -1, 0, 1<<32, &end)
+		if node.Flags&format.InodeFlagEOFBlocks == 0 && end > (size+bs-1)/bs && (typ == format.S_IFREG || typ == format.S_IFDIR) {
+			v.addf(FindingInode, ino, 0, "size %d is smaller than the %d blocks it maps", size, end)
+		}
+		if typ == format.S_IFDIR && (size%bs != 0 || size == 0) {
+			v.addf(FindingInode, ino, 0, "invalid directory size %d", size)
+		}
+	case typ == format.S_IFLNK && size < inodeDataSize:
+		// A fast symbolic link.
+	case typ == format.S_IFREG || typ == format.S_IFDIR || typ == format.S_IFLNK:
+		if size != 0 {
+			v.addf(FindingInode, ino, 0, "block-mapped files are not supported")
+			return
+		}
+	}
+
+	iblocks := uint64(node.BlocksLow)
+	if sb.FeatureRoCompat&format.RoCompatHugeFile != 0 {
+		iblocks |= uint64(node.BlocksHigh) << 32
+	}
+	expected := blocks * bs / 512
+	if node.Flags&format.InodeFlagHugeFile != 0 {
+		expected = blocks
+	}
+	if iblocks != expected {
+		v.addf(FindingInode, ino, 0, "i_blocks is %d, counted %d", iblocks, expected)
+	}
+}
+
+// checkExtents checks the extent tree node b, marking the blocks that it and
+// its children use. depth is the expected depth of the node, or -1 for the
+// root. All logical blocks must fall in [lo, hi). end is raised to the end of
+// the last initialized extent. It returns the number of blocks used.
+func (v *verifier) checkExtents(ino, seed uint32, b []byte, depth int, lo, hi uint64, end *uint64) uint64 {
+	var hdr format.ExtentHeader
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr)
+	if hdr.Magic != format.ExtentHeaderMagic {
+		v.addf(FindingInode, ino, 0, "invalid extent header")
+		return 0
+	}
+	expectedMax := uint16(len(b)/extentNodeSize - 1)
+	if hdr.Max != expectedMax || hdr.Entries > hdr.Max {
+		v.addf(FindingInode, ino, 0, "invalid extent header with %d of %d entries", hdr.Entries, hdr.Max)
+		return 0
+	}
+	if (depth >= 0 && int(hdr.Depth) != depth) || hdr.Depth > 5 {
+		v.addf(FindingInode, ino, 0, "extent node depth %d, expected %d", hdr.Depth, depth)
+		return 0
+	}
+
+	var used uint64
+	next := lo
+	for i := 0; i < int(hdr.Entries); i++ {
+		eb := b[(i+1)*extentNodeSize:]
+		logical := uint64(binary.LittleEndian.Uint32(eb))
+		if logical < next || logical >= hi {
+			v.addf(FindingInode, ino, 0, "extent for logical block %d is out of order", logical)
+			return used
+		}
+		if hdr.Depth == 0 {
+			var leaf format.ExtentLeafNode
+			binary.Read(bytes.NewReader(eb), binary.LittleEndian, &leaf)
+			length := uint64(leaf.Length)
+			uninit := length > maxBlocksPerExtent
+			if uninit {
+				length -= maxBlocksPerExtent
+			}
+			if length == 0 || logical+length > hi {
+				v.addf(FindingInode, ino, 0, "invalid extent of %d blocks at logical block %d", length, logical)
+				return used
+			}
+			start := uint64(leaf.StartLow) | uint64(leaf.StartHigh)<<32
+			if v.useBlocks(start, length, ino, "extent") {
+				used += length
+			}
+			if !uninit && logical+length > *end {
+				*end = logical + length
+			}
+			next = logical + length
+			continue
+		}
+
+		var index format.ExtentIndexNode
+		binary.Read(bytes.NewReader(eb), binary.LittleEndian, &index)
+		child := uint64(index.LeafLow) | uint64(index.LeafHigh)<<32
+		childHi := hi
+		if i+1 < int(hdr.Entries) {
+			childHi = uint64(binary.LittleEndian.Uint32(b[(i+2)*extentNodeSize:]))
+		}
+		if !v.useBlocks(child, 1, ino, "extent tree") {
+			return used
+		}
+		used++
+		nb := make([]byte, v.fs.blockSize)
+		if err := v.fs.readBlocks(nb, child); err != nil {
+			v.addf(FindingInode, ino, child, "reading extent tree: %s", err)
+			return used
+		}
+		if v.csum {
+			tailOffset := len(nb) / extentNodeSize * extentNodeSize
+			if csum := crc32c(seed, nb[:tailOffset]); csum != binary.LittleEndian.Uint32(nb[tailOffset:]) {
+				v.addf(FindingChecksum, ino, child, "extent tree block checksum mismatch")
+			}
+		}
+		used += v.checkExtents(ino, seed, nb, int(hdr.Depth)-1, logical, childHi, end)
+		next = logical + 1
+	}
+	return used
+}
+
+// checkXattrEntries checks the xattr entries in b, whose value offsets are
+// relative to b minus offsetDelta, and adds them to xattrs. Entries stored in
+// a block must have a hash; entries stored in the inode may leave it zero. It
+// returns the entry hashes.
+func (v *verifier) checkXattrEntries(ino uint32, block uint64, b []byte, offsetDelta int, inBlock bool, xattrs map[string][]byte) []uint32 {
+	var hashes []uint32
+	eb := b
+	for len(eb) >= 4 && binary.LittleEndian.Uint32(eb) != 0 {
+		nameLen := int(eb[0])
+		if len(eb) < 16+nameLen {
+			v.addf(FindingXattr, ino, block, "entry out of bounds")
+			return hashes
+		}
+		name := string(eb[16 : 16+nameLen])
+		fullName := decompressXattrName(eb[1], name)
+		if binary.LittleEndian.Uint32(eb[4:]) != 0 {
+			v.addf(FindingXattr, ino, block, "%s: value stored in an inode", fullName)
+			return hashes
+		}
+		offset := int(binary.LittleEndian.Uint16(eb[2:])) - offsetDelta
+		valueLen := int(binary.LittleEndian.Uint32(eb[8:]))
+		if offset < 0 || offset > len(b) || valueLen > len(b)-offset {
+			v.addf(FindingXattr, ino, block, "%s: value out of bounds", fullName)
+			return hashes
+		}
+		value := b[offset : offset+valueLen]
+		hash := hashXattrEntry(name, value)
+		stored := binary.LittleEndian.Uint32(eb[12:])
+		if stored != hash && (inBlock || stored != 0) {
+			v.addf(FindingXattr, ino, block, "%s: hash %#x, expected %#x", fullName, stored, hash)
+		}
+		if isACLXattr(fullName) {
+			if _, err := decodeACL(value); err != nil {
+				v.addf(FindingXattr, ino, block, "%s: %s", fullName, err)
+			}
+		}
+		if _, ok := xattrs[fullName]; ok {
+			v.addf(FindingXattr, ino, block, "%s: duplicate attribute", fullName)
+		}
+		xattrs[fullName] = value
+		hashes = append(hashes, stored)
+		eb = eb[(nameLen+3)&^3+16:]
+	}
+	return hashes
+}
+
+func (v *verifier) checkXattrBlock(ino uint32, block uint64) {
+	if ref := v.xattrBlocks[block]; ref != nil {
+		ref.refs++
+		return
+	}
+	ref := &xattrBlockRef{refs: 1}
+	v.xattrBlocks[block] = ref
+	if !v.useBlocks(block, 1, ino, "xattr block") {
+		return
+	}
+	b := make([]byte, v.fs.blockSize)
+	if err := v.fs.readBlocks(b, block); err != nil {
+		v.addf(FindingXattr, ino, block, "reading xattr block: %s", err)
+		return
+	}
+	var hdr format.XAttrHeader
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr)
+	if hdr.Magic != format.XAttrHeaderMagic || hdr.Blocks != 1 {
+		v.addf(FindingXattr, ino, block, "invalid xattr block header")
+		return
+	}
+	ref.declared = hdr.ReferenceCount
+	if v.csum {
+		c := append([]byte(nil), b...)
+		binary.LittleEndian.PutUint32(c[xattrBlockChecksumOffset:], 0)
+		var n [8]byte
+		binary.LittleEndian.PutUint64(n[:], block)
+		if csum := crc32c(crc32c(v.csumSeed, n[:]), c); csum != hdr.Checksum {
+			v.addf(FindingChecksum, ino, block, "xattr block checksum %#x, expected %#x", hdr.Checksum, csum)
+		}
+	}
+	const headerSize = 32
+	hashes := v.checkXattrEntries(ino, block, b[headerSize:], headerSize, true, make(map[string][]byte))
+	if hdr.Hash != 0 {
+		var hash uint32
+		for _, h := range hashes {
+			if h == 0 {
+				hash = 0
+				break
+			}
+			hash = hash<<16 ^ hash>>16 ^ h
+		}
+		if hash != hdr.Hash {
+			v.addf(FindingXattr, ino, block, "block hash %#x, expected %#x", hdr.Hash, hash)
+		}
+	}
+}
+
+// dirEntryVisitor is called for each entry in use in a directory.
+type dirEntryVisitor func(name string, target uint32, ft format.FileType, first bool)
+
+// checkDirEntries checks the directory entries that fill b and calls visit
+// for each entry that is in use. first is true for the first entry in b.
+func (v *verifier) checkDirEntries(ino uint32, block uint64, b []byte, visit dirEntryVisitor) {
+	first := true
+	for len(b) != 0 {
+		if len(b) < directoryEntrySize {
+			v.addf(FindingDirectory, ino, block, "directory entry out of bounds")
+			return
+		}
+		var e format.DirectoryEntry
+		binary.Read(bytes.NewReader(b), binary.LittleEndian, &e)
+		rl := int(e.RecordLength)
+		if rl < directoryEntrySize || rl%4 != 0 || rl > len(b) || directoryEntrySize+int(e.NameLength) > rl {
+			v.addf(FindingDirectory, ino, block, "invalid directory entry with record length %d and name length %d", rl, e.NameLength)
+			return
+		}
+		if e.Inode != 0 {
+			name := string(b[directoryEntrySize : directoryEntrySize+int(e.NameLength)])
+			visit(name, uint32(e.Inode), e.FileType, first)
+		}
+		first = false
+		b = b[rl:]
+	}
+}
+
+// checkDirTail checks the checksum tail of linear directory block b and
+// returns the part of b that holds entries.
+func (v *verifier) checkDirTail(ino, seed uint32, block uint64, b []byte) []byte {
+	if !v.csum {
+		return b
+	}
+	n := len(b) - directoryTailSize
+	var tail format.DirectoryEntryTail
+	binary.Read(bytes.NewReader(b[n:]), binary.LittleEndian, &tail)
+	if tail.ReservedZero1 != 0 || tail.RecordLength != directoryTailSize || tail.ReservedZero2 != 0 || tail.FileType != directoryTailFileType {
+		v.addf(FindingDirectory, ino, block, "directory block has no checksum tail")
+		return b
+	}
+	if csum := crc32c(seed, b[:n]); csum != tail.Checksum {
+		v.addf(FindingChecksum, ino, block, "directory block checksum %#x, expected %#x", tail.Checksum, csum)
+	}
+	return b[:n]
+}
+
+// hashRange is the range of name hashes that belong in a leaf block of an
+// indexed directory. If hi has its low bit set, names with hash hi&^1 may
+// also appear in the block.
+type hashRange struct {
+	lo, hi uint32
+	last   bool // there is no upper bound
+}
+
+func (r hashRange) contains(h uint32) bool {
+	if h < r.lo&^1 {
+		return false
+	}
+	if r.last {
+		return true
+	}
+	return h < r.hi&^1 || (r.hi&1 != 0 && h == r.hi&^1)
+}
+
+func (v *verifier) checkDirectories() error {
+	bs := v.fs.blockSize
+	for _, ino := range v.dirs {
+		node, err := v.fs.readInode(ino)
+		if err != nil {
+			v.addf(FindingDirectory, ino, 0, "%s", err)
+			continue
+		}
+		data, err := v.fs.readData(node)
+		if err != nil {
+			return fmt.Errorf("inode %d: %s", ino, err)
+		}
+		seed := v.inodeSeed(ino, node.Inode.Generation)
+
+		names := make(map[string]bool)
+		hasDot, hasDotDot := false, false
+		var blockIndex uint64
+		var leafRange *hashRange
+		hashVersion := format.DirectoryHashVersion(0xff)
+		visit := func(name string, target uint32, ft format.FileType, first bool) {
+			block := blockIndex
+			switch {
+			case name == ".":
+				if hasDot || blockIndex != 0 || !first || target != ino {
+					v.addf(FindingDirectory, ino, block, "invalid '.' entry")
+				}
+				hasDot = true
+				v.refs[ino]++
+				return
+			case name == "..":
+				if hasDotDot || blockIndex != 0 || !hasDot {
+					v.addf(FindingDirectory, ino, block, "invalid '..' entry")
+				}
+				hasDotDot = true
+				v.dotdot[ino] = target
+				if target != 0 && target < uint32(len(v.refs)) {
+					v.refs[target]++
+				}
+				return
+			case strings.ContainsAny(name, "/\x00") || name == "":
+				v.addf(FindingDirectory, ino, block, "invalid name %q", name)
+			case names[name]:
+				v.addf(FindingDirectory, ino, block, "duplicate entry %q", name)
+			}
+			names[name] = true
+			if target >= uint32(len(v.allocated)) || (target < v.firstInode && target != format.InodeRoot) {
+				v.addf(FindingDirectory, ino, block, "%q refers to invalid inode %d", name, target)
+				return
+			}
+			if !v.allocated[target] {
+				v.addf(FindingDirectory, ino, block, "%q refers to free inode %d", name, target)
+				return
+			}
+			if v.sb.FeatureIncompat&format.IncompatFiletype != 0 && ft != modeToFileType(v.modes[target]) {
+				v.addf(FindingDirectory, ino, block, "%q has file type %d, but inode %d has mode %#o", name, ft, target, v.modes[target])
+			}
+			if leafRange != nil && hashVersion != 0xff {
+				if hashVersion == format.DirectoryHashHalfMD4Unsigned || isASCII(name) {
+					if h, _ := dirHashHalfMD4(name, v.sb.HashSeed); !leafRange.contains(h) {
+						v.addf(FindingDirectory, ino, block, "%q is in the wrong block for its hash", name)
+					}
+				}
+			}
+			v.refs[target]++
+			if v.modes[target]&format.TypeMask == format.S_IFDIR {
+				if v.parents[target] != 0 {
+					v.addf(FindingDirectory, target, 0, "directory is linked from both inode %d and inode %d", v.parents[target], ino)
+				} else {
+					v.parents[target] = ino
+				}
+			}
+		}
+
+		if node.Inode.Flags&format.InodeFlagInlineData != 0 {
+			// The parent inode number replaces the "." and ".." entries.
+			if len(data) < 4 {
+				v.addf(FindingDirectory, ino, 0, "inline directory too short")
+				continue
+			}
+			visit(".", ino, format.FileTypeDirectory, true)
+			visit("..", binary.LittleEndian.Uint32(data), format.FileTypeDirectory, false)
+			if len(data) > inodeDataSize {
+				v.checkDirEntries(ino, 0, data[4:inodeDataSize], visit)
+				v.checkDirEntries(ino, 0, data[inodeDataSize:], visit)
+			} else {
+				v.checkDirEntries(ino, 0, data[4:], visit)
+			}
+			continue
+		}
+
+		if len(data)%int(bs) != 0 {
+			v.addf(FindingDirectory, ino, 0, "directory size %d is not a multiple of the block size", len(data))
+			continue
+		}
+		nblocks := uint32(len(data) / int(bs))
+		var index map[uint32]bool
+		var leaves map[uint32]hashRange
+		if node.Inode.Flags&format.InodeFlagHashedIndex != 0 {
+			if v.sb.FeatureCompat&format.CompatDirIndex == 0 {
+				v.addf(FindingDirectory, ino, 0, "indexed directory without the dir_index feature")
+			} else {
+				index, leaves, hashVersion = v.checkDirIndex(ino, seed, data, visit)
+			}
+		}
+		for i := uint32(0); i < nblocks; i++ {
+			blockIndex = uint64(i)
+			if index[i] {
+				continue
+			}
+			leafRange = nil
+			if leaves != nil {
+				r, ok := leaves[i]
+				if !ok {
+					v.addf(FindingDirectory, ino, uint64(i), "block is not referenced by the directory index")
+				} else {
+					leafRange = &r
+				}
+			}
+			b := data[int64(i)*bs : int64(i+1)*bs]
+			v.checkDirEntries(ino, uint64(i), v.checkDirTail(ino, seed, uint64(i), b), visit)
+		}
+		if !hasDot || !hasDotDot {
+			v.addf(FindingDirectory, ino, 0, "missing '.' or '..' entry")
+		}
+	}
+
+	for _, ino := range v.dirs {
+		parent := v.parents[ino]
+		if ino == format.InodeRoot {
+			parent = ino
+		} else if parent == 0 {
+			v.addf(FindingDirectory, ino, 0, "directory is not linked from any directory")
+			continue
+		}
+		if v.dotdot[ino] != parent {
+			v.addf(FindingDirectory, ino, 0, "'..' refers to inode %d, expected %d", v.dotdot[ino], parent)
+		}
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDirIndex checks the hashed index of a directory whose contents are
+// data, visiting the "." and ".." entries in the root block. It returns the
+// set of index blocks, the hash range of each leaf block, and the hash version
+// used, or 0xff if the index is unusable or its hash is not supported.
+func (v *verifier) checkDirIndex(ino, seed uint32, data []byte, visit dirEntryVisitor) (map[uint32]bool, map[uint32]hashRange, format.DirectoryHashVersion) {
+	bs := int(v.fs.blockSize)
+	nblocks := uint32(len(data) / bs)
+	index := map[uint32]bool{0: true}
+	leaves := make(map[uint32]hashRange)
+	if nblocks == 0 {
+		v.addf(FindingDirectory, ino, 0, "empty indexed directory")
+		return index, nil, 0xff
+	}
+
+	var root format.DirectoryTreeRoot
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &root)
+	if root.Dot.RecordLength != 12 || root.Dot.NameLength != 1 || root.DotName[0] != '.' ||
+		int(root.DotDot.RecordLength) != bs-12 || root.DotDot.NameLength != 2 || string(root.DotDotName[:2]) != ".." {
+		v.addf(FindingDirectory, ino, 0, "invalid '.' or '..' entry in the index root")
+		return index, nil, 0xff
+	}
+	visit(".", uint32(root.Dot.Inode), root.Dot.FileType, true)
+	visit("..", uint32(root.DotDot.Inode), root.DotDot.FileType, false)
+
+	maxLevels := uint8(1)
+	if v.sb.FeatureIncompat&format.IncompatLargedir != 0 {
+		maxLevels = 2
+	}
+	if root.InfoLength != 8 || root.IndirectLevels > maxLevels {
+		v.addf(FindingDirectory, ino, 0, "invalid index root with %d levels", root.IndirectLevels)
+		return index, nil, 0xff
+	}
+	version := root.HashVersion
+	if version <= format.DirectoryHashTea && v.sb.Flags&format.SuperBlockFlagUnsignedHash != 0 {
+		version += 3
+	}
+	if version != format.DirectoryHashHalfMD4 && version != format.DirectoryHashHalfMD4Unsigned {
+		// The leaf hash ranges cannot be checked.
+		version = 0xff
+	}
+
+	ok := true
+	var walk func(block uint32, countOffset int, level uint8, r hashRange)
+	walk = func(block uint32, countOffset int, level uint8, r hashRange) {
+		b := data[int(block)*bs : int(block+1)*bs]
+		limit := int(binary.LittleEndian.Uint16(b[countOffset:]))
+		count := int(binary.LittleEndian.Uint16(b[countOffset+2:]))
+		expectedLimit := (bs - countOffset) / dxEntrySize
+		if v.csum {
+			expectedLimit -= dxTailSize / dxEntrySize
+		}
+		if limit != expectedLimit || count == 0 || count > limit {
+			v.addf(FindingDirectory, ino, uint64(block), "invalid index node with %d of %d entries", count, limit)
+			ok = false
+			return
+		}
+		if v.csum {
+			tailOffset := countOffset + limit*dxEntrySize
+			var tail [dxTailSize]byte
+			copy(tail[:4], b[tailOffset:])
+			csum := crc32c(crc32c(seed, b[:countOffset+count*dxEntrySize]), tail[:])
+			if csum != binary.LittleEndian.Uint32(b[tailOffset+4:]) {
+				v.addf(FindingChecksum, ino, uint64(block), "directory index checksum mismatch")
+			}
+		}
+		for i := 0; i < count; i++ {
+			e := b[countOffset+i*dxEntrySize:]
+			// The first entry has no hash; it covers the start of the
+			// parent's range.
+			child := binary.LittleEndian.Uint32(e[4:])
+			cr := hashRange{lo: r.lo}
+			if i > 0 {
+				cr.lo = binary.LittleEndian.Uint32(e)
+				if cr.lo < r.lo || (i > 1 && cr.lo <= binary.LittleEndian.Uint32(b[countOffset+(i-1)*dxEntrySize:])) {
+					v.addf(FindingDirectory, ino, uint64(block), "index entries out of order")
+					ok = false
+				}
+			}
+			if i+1 < count {
+				cr.hi = binary.LittleEndian.Uint32(e[dxEntrySize:])
+			} else {
+				cr.hi, cr.last = r.hi, r.last
+			}
+			if child == 0 || child >= nblocks || index[child] {
+				v.addf(FindingDirectory, ino, uint64(block), "index refers to invalid block %d", child)
+				ok = false
+				continue
+			}
+			if _, dup := leaves[child]; dup {
+				v.addf(FindingDirectory, ino, uint64(block), "index refers to block %d more than once", child)
+				ok = false
+				continue
+			}
+			if level < root.IndirectLevels {
+				index[child] = true
+				cb := data[int(child)*bs:]
+				if binary.LittleEndian.Uint32(cb) != 0 || int(binary.LittleEndian.Uint16(cb[4:])) != bs {
+					v.addf(FindingDirectory, ino, uint64(child), "invalid index node header")
+					ok = false
+					continue
+				}
+				walk(child, dxNodeCountOffset, level+1, cr)
+			} else {
+				leaves[child] = cr
+			}
+		}
+	}
+	walk(0, dxRootCountOffset, 0, hashRange{last: true})
+	if !ok {
+		// Do not report every leaf as misplaced.
+		version = 0xff
+	}
+	return index, leaves, version
+}
+
+func (v *verifier) checkLinkCounts() {
+	for ino := uint32(format.InodeRoot); ino < uint32(len(v.allocated)); ino++ {
+		if ino < v.firstInode && ino != format.InodeRoot {
+			continue
+		}
+		if !v.allocated[ino] {
+			continue
+		}
+		refs := v.refs[ino]
+		links := uint32(v.links[ino])
+		if refs == 0 {
+			v.addf(FindingLinkCount, ino, 0, "inode is not linked from any directory")
+			continue
+		}
+		if links == refs {
+			continue
+		}
+		if links == 1 && v.modes[ino]&format.TypeMask == format.S_IFDIR &&
+			refs >= format.MaxLinks && v.sb.FeatureRoCompat&format.RoCompatDirNlink != 0 {
+			// The directory has too many subdirectories to count.
+			continue
+		}
+		v.addf(FindingLinkCount, ino, 0, "link count %d, counted %d", links, refs)
+	}
+}
+
+func (v *verifier) checkBlockBitmaps() error {
+	sb := v.sb
+	bs := v.fs.blockSize
+	bpg := uint64(sb.BlocksPerGroup)
+	var totalFree uint64
+	for g := uint32(0); g < v.groups; g++ {
+		gd := &v.gds[g]
+		start := uint64(sb.FirstDataBlock) + uint64(g)*bpg
+		n := bpg
+		if start+n > v.blocks {
+			n = v.blocks - start
+		}
+
+		bitmap := make([]byte, bs)
+		if (v.csum || v.gdtCsum) && gd.Flags&format.BlockGroupBlockUninit != 0 {
+			// The bitmap is implicitly the group's own metadata.
+			for i := uint64(0); i < n; i++ {
+				if v.meta.has(start + i) {
+					bitmap[i/8] |= 1 << (i % 8)
+				}
+			}
+		} else {
+			if err := v.readAt(bitmap, int64(groupBlockBitmap(gd))*bs); err != nil {
+				return err
+			}
+			if v.csum && !v.bitmapChecksumMatches(bitmap[:bpg/8], gd.BlockBitmapCsumLow, gd.BlockBitmapCsumHigh) {
+				v.addf(FindingChecksum, 0, groupBlockBitmap(gd), "group %d: block bitmap checksum mismatch", g)
+			}
+			for i := n; i < bpg; i++ {
+				if !bitSet(bitmap, i) {
+					v.addf(FindingBitmap, 0, groupBlockBitmap(gd), "group %d: padding at the end of the block bitmap is not set", g)
+					break
+				}
+			}
+		}
+
+		var used uint64
+		var diffStart uint64
+		var diffUsed, inDiff bool
+		flush := func(end uint64) {
+			if !inDiff {
+				return
+			}
+			inDiff = false
+			what := "are marked in use but are free"
+			if diffUsed {
+				what = "are in use but marked free"
+			}
+			v.addf(FindingBitmap, 0, diffStart, "blocks %d-%d %s", diffStart, end-1, what)
+		}
+		for i := uint64(0); i < n; i++ {
+			b := start + i
+			isUsed := v.used.has(b)
+			if isUsed {
+				used++
+			}
+			if bitSet(bitmap, i) == isUsed {
+				flush(b)
+				continue
+			}
+			if inDiff && diffUsed != isUsed {
+				flush(b)
+			}
+			if !inDiff {
+				inDiff, diffStart, diffUsed = true, b, isUsed
+			}
+		}
+		flush(start + n)
+
+		free := n - used
+		totalFree += free
+		if gdFree := uint64(gd.FreeBlocksCountLow) | uint64(gd.FreeBlocksCountHigh)<<16; gdFree != free {
+			v.addf(FindingGroupDescriptor, 0, 0, "group %d: free block count %d, counted %d", g, gdFree, free)
+		}
+	}
+	sbFree := uint64(sb.FreeBlocksCountLow)
+	if sb.FeatureIncompat&format.Incompat_64Bit != 0 {
+		sbFree |= uint64(sb.FreeBlocksCountHigh) << 32
+	}
+	if sbFree != totalFree {
+		v.addf(FindingSuperBlock, 0, 0, "free block count %d, counted %d", sbFree, totalFree)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package compactext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+// fsckTestFiles returns the files of a small image with a file, a directory
+// and an xattr block.
+func fsckTestFiles() []testFile {
+	return []testFile{
+		{Path: "dir", File: &File{Mode: S_IFDIR | 0755}},
+		{Path: "file", File: &File{Mode: S_IFREG | 0644}, Data: data[:5000]},
+		{Path: "xattrs", File: &File{Mode: S_IFREG | 0644, Xattrs: map[string][]byte{"user.large": data[:1000]}}},
+	}
+}
+
+func verifyBytes(t *testing.T, b []byte) []Finding {
+	findings, err := Verify(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return findings
+}
+
+// testInode returns the number and disk offset of the inode for name, which
+// must be in the root directory.
+func testInode(t *testing.T, fs *Reader, name string) (uint32, int64) {
+	entries, err := fs.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name == name {
+			sb := &fs.sb
+			g, i := (e.Inode-1)/sb.InodesPerGroup, (e.Inode-1)%sb.InodesPerGroup
+			return e.Inode, int64(fs.gds[g].InodeTable)*fs.blockSize + int64(i)*fs.inodeSize
+		}
+	}
+	t.Fatalf("%s not found", name)
+	return 0, 0
+}
+
+func TestVerifyCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    FindingKind
+		corrupt func(t *testing.T, fs *Reader, b []byte)
+	}{
+		{
+			name: "free block count",
+			kind: FindingSuperBlock,
+			corrupt: func(t *testing.T, fs *Reader, b []byte) {
+				binary.LittleEndian.PutUint32(b[1024+0xc:], fs.sb.FreeBlocksCountLow+1)
+			},
+		},
+		{
+			name: "link count",
+			kind: FindingLinkCount,
+			corrupt: func(t *testing.T, fs *Reader, b []byte) {
+				_, off := testInode(t, fs, "file")
+				b[off+26]++
+			},
+		},
+		{
+			name: "block bitmap",
+			kind: FindingBitmap,
+			corrupt: func(t *testing.T, fs *Reader, b []byte) {
+				ino, _ := testInode(t, fs, "file")
+				node, err := fs.readInode(ino)
+				if err != nil {
+					t.Fatal(err)
+				}
+				block := node.Extents[0].Start - uint64(fs.sb.FirstDataBlock)
+				gd := b[(int64(fs.sb.FirstDataBlock)+1)*fs.blockSize:]
+				bitmap := int64(binary.LittleEndian.Uint32(gd)) * fs.blockSize
+				b[bitmap+int64(block/8)] &^= 1 << (block % 8)
+			},
+		},
+		{
+			name: "directory entry",
+			kind: FindingDirectory,
+			corrupt: func(t *testing.T, fs *Reader, b []byte) {
+				node, err := fs.readInode(format.InodeRoot)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dir := b[int64(node.Extents[0].Start)*fs.blockSize:]
+				i := bytes.Index(dir[:fs.blockSize], []byte("file"))
+				binary.LittleEndian.PutUint16(dir[i-directoryEntrySize+4:], 5)
+			},
+		},
+		{
+			name: "xattr hash",
+			kind: FindingXattr,
+			corrupt: func(t *testing.T, fs *Reader, b []byte) {
+				ino, _ := testInode(t, fs, "xattrs")
+				node, err := fs.readInode(ino)
+				if err != nil {
+					t.Fatal(err)
+				}
+				block := int64(node.Inode.XattrBlockLow) * fs.blockSize
+				b[block+32+12]++
+			},
+		},
+	}
+	clean, _ := writeTestImage(t, fsckTestFiles())
+	for _, finding := range verifyBytes(t, clean) {
+		t.Error(finding)
+	}
+	fs, err := NewReader(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := append([]byte(nil), clean...)
+			test.corrupt(t, fs, b)
+			findings := verifyBytes(t, b)
+			found := false
+			for _, finding := range findings {
+				t.Log(finding)
+				if finding.Kind == test.kind {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("no %s finding", test.kind)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	b, _ := writeTestImage(t, fsckTestFiles(), MetadataChecksum)
+	for _, finding := range verifyBytes(t, b) {
+		t.Error(finding)
+	}
+	fs, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino, off := testInode(t, fs, "file")
+	// Change the mtime.
+	b[off+0x10]++
+	findings := verifyBytes(t, b)
+	if len(findings) != 1 || findings[0].Kind != FindingChecksum || findings[0].Inode != ino {
+		t.Errorf("expected an inode checksum finding, got %v", findings)
+	}
+}
+
+func TestVerifyMkfs(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not found")
+	}
+	dir, err := ioutil.TempDir("", "compactext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "many"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Enough entries for an indexed directory.
+	for i := 0; i < 500; i++ {
+		if err := ioutil.WriteFile(filepath.Join(src, "many", fmt.Sprintf("file%d", i)), data[:i*10], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(name[:200], filepath.Join(src, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "many", "file1"), filepath.Join(src, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(dir, "image")
+	for _, opts := range [][]string{
+		nil,
+		{"-b", "4096"},
+		{"-O", "^metadata_csum,uninit_bg", "-I", "128"},
+		{"-O", "^has_journal,^resize_inode,inline_data"},
+	} {
+		os.Remove(image)
+		args := append([]string{"-q", "-F", "-d", src}, opts...)
+		out, err := exec.Command("mkfs.ext4", append(args, image, "64M")...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("mkfs.ext4 %v: %s: %s", opts, err, out)
+		}
+		f, err := os.Open(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		findings, err := Verify(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v: %s", opts, err)
+		}
+		for _, finding := range findings {
+			t.Errorf("%v: %s", opts, finding)
+		}
+	}
+}
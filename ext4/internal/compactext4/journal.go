@@ -0,0 +1,158 @@
+package compactext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+const (
+	minJournalBlocks      = 1024
+	maxJournalBlocks      = 10240000 // the mke2fs limit
+	journalBackupBlocks   = 1        // s_jnl_backup_type for a copy of i_block
+	journalSuperBlockSize = 1024
+	journalChecksumOffset = 0xfc
+)
+
+// Journal instructs the writer to create a JBD2 journal of the specified size
+// in bytes and set the has_journal feature, so that a file system that is
+// mounted read-write is crash consistent. If size is 0, the journal is sized
+// from the file system size as mke2fs does. A journal is only useful with
+// ExpandDisk, since otherwise the file system has no free space.
+func Journal(size int64) Option {
+	return func(w *Writer) {
+		w.journal = true
+		w.journalSize = size
+	}
+}
+
+// defaultJournalBlocks returns the size of the journal that mke2fs creates for
+// a file system of the specified number of blocks.
+func defaultJournalBlocks(blocks int64) uint32 {
+	switch {
+	case blocks < 32768:
+		return 1024
+	case blocks < 256*1024:
+		return 4096
+	case blocks < 512*1024:
+		return 8192
+	case blocks < 4096*1024:
+		return 16384
+	case blocks < 8192*1024:
+		return 32768
+	case blocks < 16384*1024:
+		return 65536
+	case blocks < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+// journalBlocks returns the number of blocks in the journal.
+func (w *Writer) journalBlocks() (uint32, error) {
+	bs := int64(w.blockSize)
+	if w.journalSize == 0 {
+		fsBlocks := int64(w.block())
+		if w.expandDisk {
+			fsBlocks = w.maxDiskSize / bs
+		}
+		return defaultJournalBlocks(fsBlocks), nil
+	}
+	blocks := (w.journalSize + bs - 1) / bs
+	if w.journalSize < 0 || blocks < minJournalBlocks || blocks > maxJournalBlocks {
+		return 0, fmt.Errorf("invalid journal size %d: must be between %d and %d blocks", w.journalSize, minJournalBlocks, maxJournalBlocks)
+	}
+	return uint32(blocks), nil
+}
+
+// writeJournal allocates the journal inode's blocks at the current position.
+// The journal is empty, so its blocks are zero except for the journal
+// superblock, which is written by writeJournalSuperBlock once the file system
+// UUID is known.
+func (w *Writer) writeJournal() error {
+	blocks, err := w.journalBlocks()
+	if err != nil {
+		return err
+	}
+	node := &inode{
+		Number:    format.InodeJournal,
+		Mode:      format.S_IFREG | 0600,
+		LinkCount: 1,
+		Size:      int64(blocks) * int64(w.blockSize),
+		Flags:     format.InodeFlagHugeFile,
+	}
+	start := w.block()
+	if err := w.skip(node.Size); err != nil {
+		return err
+	}
+	// The journal must not have holes, so it is mapped by full-length
+	// extents.
+	w.curExtents = w.curExtents[:0]
+	for b := uint32(0); b < blocks; b += maxBlocksPerExtent {
+		n := blocks - b
+		if n > maxBlocksPerExtent {
+			n = maxBlocksPerExtent
+		}
+		w.curExtents = append(w.curExtents, extent{Block: b, Length: n, Start: uint64(start + b)})
+	}
+	if err := w.writeExtents(node); err != nil {
+		return err
+	}
+	w.curExtents = w.curExtents[:0]
+	w.inodes[format.InodeJournal-1] = node
+	return nil
+}
+
+// setJournalFields records the journal in the file system superblock,
+// including a backup of the journal inode's extent tree root.
+func (w *Writer) setJournalFields(sb *format.SuperBlock) {
+	node := w.inodes[format.InodeJournal-1]
+	sb.FeatureCompat |= format.CompatHasJournal
+	sb.JournalInum = format.InodeJournal
+	sb.JournalBackupType = journalBackupBlocks
+	var blk [inodeDataSize]byte
+	copy(blk[:], node.Data)
+	for i := 0; i < 15; i++ {
+		sb.JournalBlocks[i] = binary.LittleEndian.Uint32(blk[i*4:])
+	}
+	sb.JournalBlocks[15] = uint32(node.Size >> 32)
+	sb.JournalBlocks[16] = uint32(node.Size)
+}
+
+// writeJournalSuperBlock writes the superblock of an empty journal to the
+// first block of the journal inode.
+func (w *Writer) writeJournalSuperBlock() error {
+	node := w.inodes[format.InodeJournal-1]
+	jsb := format.JournalSuperBlock{
+		Header: format.JournalHeader{
+			Magic:     format.JournalMagic,
+			BlockType: format.JournalBlockTypeSuperBlockV2,
+		},
+		BlockSize: w.blockSize,
+		MaxLen:    uint32(node.Size / int64(w.blockSize)),
+		First:     1,
+		Sequence:  1,
+		UUID:      w.uuid,
+		NrUsers:   1,
+	}
+	if w.is64Bit {
+		jsb.FeatureIncompat |= format.JournalIncompat64Bit
+	}
+	if w.metadataCsum {
+		jsb.FeatureIncompat |= format.JournalIncompatCsumV3
+		jsb.ChecksumType = format.JournalChecksumCrc32c
+	}
+	blk := make([]byte, w.blockSize)
+	b := bytes.NewBuffer(blk[:0])
+	binary.Write(b, binary.BigEndian, &jsb)
+	if w.metadataCsum {
+		csum := crc32c(^uint32(0), blk[:journalSuperBlockSize])
+		binary.BigEndian.PutUint32(blk[journalChecksumOffset:], csum)
+	}
+	w.seekBlock(node.DataBlock)
+	_, err := w.write(blk)
+	return err
+}
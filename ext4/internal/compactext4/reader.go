@@ -0,0 +1,582 @@
+package compactext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+// Reader reads an ext4 file system image.
+type Reader struct {
+	r         io.ReaderAt
+	sb        format.SuperBlock
+	blockSize int64
+	inodeSize int64
+	gds       []groupDescriptor
+
+	dirsLock sync.Mutex
+	dirs     map[uint32]map[string]uint32 // cached directory lookups
+}
+
+type groupDescriptor struct {
+	InodeTable uint64
+}
+
+// A DirEntry describes a single entry returned by ReadDir.
+type DirEntry struct {
+	Name  string
+	Inode uint32
+	Mode  uint16 // only the file type bits are set
+}
+
+// extent maps a range of logical file blocks to physical disk blocks.
+type extent struct {
+	Block  uint32
+	Length uint32
+	Start  uint64
+	Uninit bool
+}
+
+// readerInode is an inode as read from disk.
+type readerInode struct {
+	Number  uint32
+	Inode   format.Inode
+	Size    int64
+	Xattrs  map[string][]byte
+	Data    []byte // inline data or fast symlink target
+	Extents []extent
+}
+
+var inodeStructSize = binary.Size(format.Inode{})
+
+// NewReader returns a Reader that reads the ext4 file system contained in r.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	fs := &Reader{r: r, dirs: make(map[uint32]map[string]uint32)}
+	var b [1024]byte
+	if _, err := r.ReadAt(b[:], 1024); err != nil {
+		return nil, fmt.Errorf("reading superblock: %s", err)
+	}
+	if err := binary.Read(bytes.NewReader(b[:]), binary.LittleEndian, &fs.sb); err != nil {
+		return nil, err
+	}
+	sb := &fs.sb
+	if sb.Magic != format.SuperBlockMagic {
+		return nil, errors.New("not an ext4 file system")
+	}
+	if sb.LogBlockSize > 6 {
+		return nil, fmt.Errorf("invalid block size 2^(10+%d)", sb.LogBlockSize)
+	}
+	fs.blockSize = 1024 << sb.LogBlockSize
+	fs.inodeSize = 128
+	if sb.RevisionLevel != 0 {
+		fs.inodeSize = int64(sb.InodeSize)
+	}
+	if fs.inodeSize < 128 || fs.inodeSize > fs.blockSize || fs.inodeSize&(fs.inodeSize-1) != 0 {
+		return nil, fmt.Errorf("invalid inode size %d", fs.inodeSize)
+	}
+	if sb.BlocksPerGroup == 0 || sb.InodesPerGroup == 0 {
+		return nil, errors.New("invalid group size")
+	}
+	if sb.FeatureIncompat&format.IncompatMetaBg != 0 {
+		return nil, errors.New("meta_bg file systems are not supported")
+	}
+
+	// Read the group descriptors.
+	descSize := int64(groupDescriptorSize)
+	if sb.FeatureIncompat&format.Incompat_64Bit != 0 {
+		descSize = int64(sb.DescSize)
+		if descSize < groupDescriptorSize {
+			return nil, fmt.Errorf("invalid group descriptor size %d", descSize)
+		}
+	}
+	groups := (sb.InodesCount + sb.InodesPerGroup - 1) / sb.InodesPerGroup
+	gdb := make([]byte, int64(groups)*descSize)
+	if _, err := r.ReadAt(gdb, (int64(sb.FirstDataBlock)+1)*fs.blockSize); err != nil {
+		return nil, fmt.Errorf("reading group descriptors: %s", err)
+	}
+	fs.gds = make([]groupDescriptor, groups)
+	for i := range fs.gds {
+		d := gdb[int64(i)*descSize:]
+		table := uint64(binary.LittleEndian.Uint32(d[8:]))
+		if descSize >= 64 {
+			table |= uint64(binary.LittleEndian.Uint32(d[40:])) << 32
+		}
+		fs.gds[i].InodeTable = table
+	}
+	return fs, nil
+}
+
+// BlockSize returns the block size of the file system.
+func (fs *Reader) BlockSize() int64 {
+	return fs.blockSize
+}
+
+// Size returns the size of the file system in bytes.
+func (fs *Reader) Size() int64 {
+	return int64(uint64(fs.sb.BlocksCountLow)|uint64(fs.sb.BlocksCountHigh)<<32) * fs.blockSize
+}
+
+func (fs *Reader) readBlocks(b []byte, block uint64) error {
+	_, err := fs.r.ReadAt(b, int64(block)*fs.blockSize)
+	return err
+}
+
+func (fs *Reader) readInode(ino uint32) (*readerInode, error) {
+	if ino == 0 || ino > fs.sb.InodesCount {
+		return nil, fmt.Errorf("inode %d out of range", ino)
+	}
+	group := (ino - 1) / fs.sb.InodesPerGroup
+	index := (ino - 1) % fs.sb.InodesPerGroup
+	b := make([]byte, fs.inodeSize)
+	if _, err := fs.r.ReadAt(b, int64(fs.gds[group].InodeTable)*fs.blockSize+int64(index)*fs.inodeSize); err != nil {
+		return nil, fmt.Errorf("reading inode %d: %s", ino, err)
+	}
+
+	// Only decode the fields that are present in this inode.
+	used := 128
+	if fs.inodeSize > 128 {
+		used += int(binary.LittleEndian.Uint16(b[128:]))
+		if used > len(b) {
+			return nil, fmt.Errorf("inode %d: invalid extra size", ino)
+		}
+	}
+	var raw [256]byte
+	copy(raw[:], b[:used])
+	node := &readerInode{Number: ino}
+	binary.Read(bytes.NewReader(raw[:inodeStructSize]), binary.LittleEndian, &node.Inode)
+	node.Size = int64(uint64(node.Inode.SizeLow) | uint64(node.Inode.SizeHigh)<<32)
+
+	// Read the extended attributes.
+	node.Xattrs = make(map[string][]byte)
+	if xb := b[used:]; len(xb) >= 4 && binary.LittleEndian.Uint32(xb) == format.XAttrHeaderMagic {
+		if err := getXattrs(xb[4:], node.Xattrs, 0); err != nil {
+			return nil, fmt.Errorf("inode %d: %s", ino, err)
+		}
+	}
+	if block := uint64(node.Inode.XattrBlockLow) | uint64(node.Inode.XattrBlockHigh)<<32; block != 0 {
+		xb := make([]byte, fs.blockSize)
+		if err := fs.readBlocks(xb, block); err != nil {
+			return nil, fmt.Errorf("inode %d: reading xattr block: %s", ino, err)
+		}
+		if binary.LittleEndian.Uint32(xb) != format.XAttrHeaderMagic {
+			return nil, fmt.Errorf("inode %d: invalid xattr block", ino)
+		}
+		if err := getXattrs(xb[32:], node.Xattrs, 32); err != nil {
+			return nil, fmt.Errorf("inode %d: %s", ino, err)
+		}
+	}
+
+	// Find the data.
+	switch {
+	case node.Inode.Flags&format.InodeFlagInlineData != 0:
+		node.Data = append(node.Data, node.Inode.Block[:]...)
+		node.Data = append(node.Data, node.Xattrs["system.data"]...)
+		delete(node.Xattrs, "system.data")
+		if node.Size > int64(len(node.Data)) {
+			return nil, fmt.Errorf("inode %d: inline data too short", ino)
+		}
+		node.Data = node.Data[:node.Size]
+	case node.Inode.Flags&format.InodeFlagExtents != 0:
+		var err error
+		node.Extents, err = fs.readExtents(node.Inode.Block[:], nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("inode %d: %s", ino, err)
+		}
+	case node.Inode.Mode&format.TypeMask == format.S_IFLNK && node.Size < inodeDataSize:
+		node.Data = node.Inode.Block[:node.Size]
+	case node.Inode.Mode&format.TypeMask == format.S_IFREG || node.Inode.Mode&format.TypeMask == format.S_IFDIR || node.Inode.Mode&format.TypeMask == format.S_IFLNK:
+		if node.Size != 0 {
+			return nil, fmt.Errorf("inode %d: block-mapped files are not supported", ino)
+		}
+	}
+	return node, nil
+}
+
+func (fs *Reader) readExtents(b []byte, extents []extent, depth int) ([]extent, error) {
+	if depth > 5 {
+		return nil, errors.New("extent tree too deep")
+	}
+	var hdr format.ExtentHeader
+	binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr)
+	if hdr.Magic != format.ExtentHeaderMagic {
+		return nil, errors.New("invalid extent header")
+	}
+	const extentNodeSize = 12
+	if (int(hdr.Entries)+1)*extentNodeSize > len(b) {
+		return nil, errors.New("extent entries out of bounds")
+	}
+	for i := 0; i < int(hdr.Entries); i++ {
+		eb := b[(i+1)*extentNodeSize:]
+		if hdr.Depth == 0 {
+			var leaf format.ExtentLeafNode
+			binary.Read(bytes.NewReader(eb), binary.LittleEndian, &leaf)
+			e := extent{
+				Block:  leaf.Block,
+				Length: uint32(leaf.Length),
+				Start:  uint64(leaf.StartLow) | uint64(leaf.StartHigh)<<32,
+			}
+			if e.Length > maxBlocksPerExtent {
+				e.Length -= maxBlocksPerExtent
+				e.Uninit = true
+			}
+			extents = append(extents, e)
+		} else {
+			var node format.ExtentIndexNode
+			binary.Read(bytes.NewReader(eb), binary.LittleEndian, &node)
+			nb := make([]byte, fs.blockSize)
+			if err := fs.readBlocks(nb, uint64(node.LeafLow)|uint64(node.LeafHigh)<<32); err != nil {
+				return nil, err
+			}
+			var err error
+			extents, err = fs.readExtents(nb, extents, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return extents, nil
+}
+
+// inodeReader implements io.ReaderAt over an inode's data.
+type inodeReader struct {
+	fs   *Reader
+	node *readerInode
+}
+
+func (ir *inodeReader) ReadAt(b []byte, off int64) (int, error) {
+	node := ir.node
+	if off >= node.Size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	var err error
+	if int64(n) > node.Size-off {
+		n = int(node.Size - off)
+		err = io.EOF
+	}
+	b = b[:n]
+	if node.Extents == nil {
+		if node.Data != nil {
+			copy(b, node.Data[off:])
+		} else {
+			for i := range b {
+				b[i] = 0
+			}
+		}
+		return n, err
+	}
+
+	bs := ir.fs.blockSize
+	extents := node.Extents
+	for len(b) != 0 {
+		lblock := uint32(off / bs)
+		boff := off % bs
+		// Find the extent containing or following lblock.
+		i := sort.Search(len(extents), func(i int) bool {
+			return extents[i].Block+extents[i].Length > lblock
+		})
+		var chunk int64
+		if i == len(extents) || extents[i].Block > lblock {
+			// This is a hole.
+			end := node.Size
+			if i < len(extents) {
+				end = int64(extents[i].Block) * bs
+			}
+			chunk = end - off
+			if chunk > int64(len(b)) {
+				chunk = int64(len(b))
+			}
+			for j := range b[:chunk] {
+				b[j] = 0
+			}
+		} else {
+			e := extents[i]
+			chunk = int64(e.Block+e.Length-lblock)*bs - boff
+			if chunk > int64(len(b)) {
+				chunk = int64(len(b))
+			}
+			if e.Uninit {
+				for j := range b[:chunk] {
+					b[j] = 0
+				}
+			} else {
+				pos := int64(e.Start+uint64(lblock-e.Block))*bs + boff
+				if _, rerr := ir.fs.r.ReadAt(b[:chunk], pos); rerr != nil {
+					return n - len(b), rerr
+				}
+			}
+		}
+		b = b[chunk:]
+		off += chunk
+	}
+	return n, err
+}
+
+func (fs *Reader) readData(node *readerInode) ([]byte, error) {
+	b := make([]byte, node.Size)
+	_, err := (&inodeReader{fs, node}).ReadAt(b, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return b, err
+}
+
+func (fs *Reader) readDirectory(node *readerInode) ([]DirEntry, error) {
+	if node.Inode.Mode&format.TypeMask != format.S_IFDIR {
+		return nil, errors.New("not a directory")
+	}
+	b, err := fs.readData(node)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DirEntry
+	if node.Inode.Flags&format.InodeFlagInlineData != 0 {
+		// The first four bytes of an inline directory hold the parent inode
+		// number; the rest are ordinary directory entries.
+		if len(b) < 4 {
+			return nil, errors.New("inline directory too short")
+		}
+		entries = append(entries, DirEntry{Name: "..", Inode: binary.LittleEndian.Uint32(b), Mode: format.S_IFDIR})
+		if len(b) > inodeDataSize {
+			// The entries in the inode body and in the xattr are separate.
+			more, err := parseDirectoryEntries(b[4:inodeDataSize], nil)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, more...)
+			b = b[inodeDataSize:]
+		} else {
+			b = b[4:]
+		}
+		return parseDirectoryEntries(b, entries)
+	}
+	for len(b) != 0 {
+		n := fs.blockSize
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		entries, err = parseDirectoryEntries(b[:n], entries)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+	}
+	return entries, nil
+}
+
+func parseDirectoryEntries(b []byte, entries []DirEntry) ([]DirEntry, error) {
+	for len(b) != 0 {
+		if len(b) < directoryEntrySize {
+			return nil, errors.New("directory entry out of bounds")
+		}
+		var e format.DirectoryEntry
+		binary.Read(bytes.NewReader(b), binary.LittleEndian, &e)
+		if int(e.RecordLength) < directoryEntrySize || int(e.RecordLength) > len(b) || directoryEntrySize+int(e.NameLength) > int(e.RecordLength) {
+			return nil, errors.New("invalid directory entry")
+		}
+		if e.Inode != 0 {
+			entries = append(entries, DirEntry{
+				Name:  string(b[directoryEntrySize : directoryEntrySize+int(e.NameLength)]),
+				Inode: uint32(e.Inode),
+				Mode:  fileTypeToMode(e.FileType),
+			})
+		}
+		b = b[e.RecordLength:]
+	}
+	return entries, nil
+}
+
+func fileTypeToMode(t format.FileType) uint16 {
+	switch t {
+	default:
+		return 0
+	case format.FileTypeRegular:
+		return format.S_IFREG
+	case format.FileTypeDirectory:
+		return format.S_IFDIR
+	case format.FileTypeCharacter:
+		return format.S_IFCHR
+	case format.FileTypeBlock:
+		return format.S_IFBLK
+	case format.FileTypeFIFO:
+		return format.S_IFIFO
+	case format.FileTypeSocket:
+		return format.S_IFSOCK
+	case format.FileTypeSymbolicLink:
+		return format.S_IFLNK
+	}
+}
+
+// directoryNames returns a map from name to inode number for the entries of
+// directory node, caching the result for subsequent lookups.
+func (fs *Reader) directoryNames(node *readerInode) (map[string]uint32, error) {
+	fs.dirsLock.Lock()
+	names := fs.dirs[node.Number]
+	fs.dirsLock.Unlock()
+	if names != nil {
+		return names, nil
+	}
+	entries, err := fs.readDirectory(node)
+	if err != nil {
+		return nil, err
+	}
+	names = make(map[string]uint32, len(entries))
+	for _, e := range entries {
+		names[e.Name] = e.Inode
+	}
+	fs.dirsLock.Lock()
+	fs.dirs[node.Number] = names
+	fs.dirsLock.Unlock()
+	return names, nil
+}
+
+func (fs *Reader) lookup(name string) (*readerInode, error) {
+	node, err := fs.readInode(format.InodeRoot)
+	if err != nil {
+		return nil, err
+	}
+	p := path.Clean("/" + name)[1:]
+	for len(p) != 0 {
+		var child string
+		child, p = splitFirst(p)
+		names, err := fs.directoryNames(node)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		ino := names[child]
+		if ino == 0 {
+			return nil, fmt.Errorf("%s: file not found", name)
+		}
+		node, err = fs.readInode(ino)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func (fs *Reader) makeFile(node *readerInode) (*File, error) {
+	in := &node.Inode
+	f := &File{
+		Size:   node.Size,
+		Mode:   in.Mode,
+		Uid:    uint32(in.Uid) | uint32(in.UidHigh)<<16,
+		Gid:    uint32(in.Gid) | uint32(in.GidHigh)<<16,
+		Atime:  fsTimeToTime(uint64(in.Atime) | uint64(in.AtimeExtra)<<32),
+		Ctime:  fsTimeToTime(uint64(in.Ctime) | uint64(in.CtimeExtra)<<32),
+		Mtime:  fsTimeToTime(uint64(in.Mtime) | uint64(in.MtimeExtra)<<32),
+		Crtime: fsTimeToTime(uint64(in.Crtime) | uint64(in.CrtimeExtra)<<32),
+		Xattrs: node.Xattrs,
+	}
+	switch in.Mode & format.TypeMask {
+	case format.S_IFBLK, format.S_IFCHR:
+		dev := binary.LittleEndian.Uint32(in.Block[4:])
+		if dev == 0 {
+			// Old-style encoding.
+			dev = uint32(binary.LittleEndian.Uint16(in.Block[:]))
+		}
+		f.Devmajor = (dev >> 8) & 0xfff
+		f.Devminor = dev&0xff | (dev>>12)&0xfff00
+	case format.S_IFLNK:
+		link, err := fs.readLink(node)
+		if err != nil {
+			return nil, err
+		}
+		f.Linkname = link
+	case format.S_IFDIR:
+		f.Size = 0
+	}
+	return f, nil
+}
+
+func (fs *Reader) readLink(node *readerInode) (string, error) {
+	if node.Data != nil {
+		return string(node.Data), nil
+	}
+	b, err := fs.readData(node)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Stat returns information about the named file. Symbolic links are not
+// followed.
+func (fs *Reader) Stat(name string) (*File, error) {
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.makeFile(node)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return f, nil
+}
+
+// Open returns a reader for the contents of the named regular file.
+func (fs *Reader) Open(name string) (*io.SectionReader, error) {
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if node.Inode.Mode&format.TypeMask != format.S_IFREG {
+		return nil, fmt.Errorf("%s: not a regular file", name)
+	}
+	return io.NewSectionReader(&inodeReader{fs, node}, 0, node.Size), nil
+}
+
+// ReadDir returns the entries of the named directory, excluding "." and "..",
+// sorted by name.
+func (fs *Reader) ReadDir(name string) ([]DirEntry, error) {
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.readDirectory(node)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	filtered := entries[:0]
+	for _, e := range entries {
+		if e.Name != "." && e.Name != ".." {
+			filtered = append(filtered, e)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Name < filtered[j].Name
+	})
+	return filtered, nil
+}
+
+// Readlink returns the target of the named symbolic link.
+func (fs *Reader) Readlink(name string) (string, error) {
+	node, err := fs.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if node.Inode.Mode&format.TypeMask != format.S_IFLNK {
+		return "", fmt.Errorf("%s: not a symbolic link", name)
+	}
+	link, err := fs.readLink(node)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, err)
+	}
+	return link, nil
+}
+
+// ListXattrs returns the extended attributes of the named file.
+func (fs *Reader) ListXattrs(name string) (map[string][]byte, error) {
+	node, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return node.Xattrs, nil
+}
@@ -0,0 +1,118 @@
+package compactext4
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+func verifyTestFileReader(t *testing.T, r *Reader, tf testFile) {
+	f, err := r.Stat(tf.Path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if tf.File == nil {
+		// Hard links are verified through their target.
+		return
+	}
+	if expectedDevice(f) == expectedDevice(tf.File) {
+		// The device number encoding only preserves 12 bits of the major
+		// number, so compare the encoded form instead.
+		f.Devmajor, f.Devminor = tf.File.Devmajor, tf.File.Devminor
+	}
+	if !fileEqual(f, tf.File) {
+		t.Errorf("%s: stat mismatch, expected: %#v got: %#v", tf.Path, tf.File, f)
+	}
+	switch tf.File.Mode & format.TypeMask {
+	case 0, S_IFREG:
+		fr, err := r.Open(tf.Path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		same, err := streamEqual(fr, tf.Reader())
+		if err != nil {
+			t.Error(err)
+		} else if !same {
+			t.Errorf("%s: data mismatch", tf.Path)
+		}
+	case S_IFLNK:
+		link, err := r.Readlink(tf.Path)
+		if err != nil {
+			t.Error(err)
+		} else if link != tf.File.Linkname {
+			t.Errorf("%s: link mismatch, expected: %s got: %s", tf.Path, tf.File.Linkname, link)
+		}
+	}
+}
+
+func TestReaderReadDir(t *testing.T) {
+	f, err := ioutil.TempFile("", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := NewWriter(f, InlineData)
+	names := []string{"a", "b", "c"}
+	if err := w.Create("dir", &File{Mode: format.S_IFDIR | 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := w.Create(path.Join("dir", name), &File{Mode: format.S_IFREG | 0644, Size: 3}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(name + name + name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Link("dir/a", "dir/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := r.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		if entries[i].Name != name || entries[i].Mode != S_IFREG {
+			t.Errorf("unexpected entry %d: %#v", i, entries[i])
+		}
+	}
+	if entries[0].Inode != entries[3].Inode {
+		t.Errorf("hard link inode mismatch: %d != %d", entries[0].Inode, entries[3].Inode)
+	}
+	fr, err := r.Open("dir/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("bbb")) {
+		t.Errorf("unexpected data %q", b)
+	}
+	if _, err := r.ReadDir("dir/a"); err == nil {
+		t.Error("expected error reading a file as a directory")
+	}
+	if _, err := r.Stat("dir/missing"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
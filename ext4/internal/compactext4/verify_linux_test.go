@@ -3,7 +3,6 @@ package compactext4
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -23,10 +22,6 @@ func timeEqual(ts syscall.Timespec, t time.Time) bool {
 	return ts.Sec == sec && int(ts.Nsec) == nsec
 }
 
-func expectedDevice(f *File) uint64 {
-	return uint64(f.Devminor&0xff | f.Devmajor<<8 | (f.Devminor&0xffffff00)<<12)
-}
-
 func llistxattr(path string, b []byte) (int, error) {
 	pathp := syscall.StringBytePtr(path)
 	var p unsafe.Pointer
@@ -72,48 +67,12 @@ func readXattrs(path string) (map[string][]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		value := buf2[:vn]
+		value := append([]byte(nil), buf2[:vn]...)
 		xattrs[name] = value
 	}
 	return xattrs, nil
 }
 
-func streamEqual(r1, r2 io.Reader) (bool, error) {
-	var b [4096]byte
-	var b2 [4096]byte
-	for {
-		n, err := r1.Read(b[:])
-		if n == 0 {
-			if err == io.EOF {
-				break
-			}
-			if err == nil {
-				continue
-			}
-			return false, err
-		}
-		_, err = io.ReadFull(r2, b2[:n])
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return false, nil
-		}
-		if err != nil {
-			return false, err
-		}
-		if !bytes.Equal(b[n:], b2[n:]) {
-			return false, nil
-		}
-	}
-	// Check the tail of r2
-	_, err := r2.Read(b[:1])
-	if err == nil {
-		return false, nil
-	}
-	if err != io.EOF {
-		return false, err
-	}
-	return true, nil
-}
-
 func verifyTestFile(t *testing.T, mountPath string, tf testFile) {
 	name := path.Join(mountPath, tf.Path)
 	fi, err := os.Lstat(name)
@@ -245,4 +204,5 @@ func fsck(t *testing.T, image string) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	verifyImage(t, image)
 }
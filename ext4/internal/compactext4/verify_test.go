@@ -15,4 +15,5 @@ func unmountImage(t *testing.T, mountPath string) {
 }
 
 func fsck(t *testing.T, image string) {
+	verifyImage(t, image)
 }
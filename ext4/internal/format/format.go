@@ -44,7 +44,7 @@ type SuperBlock struct {
 	JournalDev           uint32
 	LastOrphan           uint32
 	HashSeed             [4]uint32
-	DefHashVersion       uint8
+	DefHashVersion       DirectoryHashVersion
 	JournalBackupType    uint8
 	DescSize             uint16
 	DefaultMountOpts     uint32
@@ -103,6 +103,12 @@ type SuperBlock struct {
 
 const SuperBlockMagic uint16 = 0xef53
 
+const (
+	SuperBlockFlagSignedHash     = 0x1
+	SuperBlockFlagUnsignedHash   = 0x2
+	SuperBlockFlagTestFilesystem = 0x4
+)
+
 type CompatFeature uint32
 type IncompatFeature uint32
 type RoCompatFeature uint32
@@ -216,7 +222,8 @@ const (
 type InodeNumber uint32
 
 const (
-	InodeRoot = 2
+	InodeRoot    = 2
+	InodeJournal = 8
 )
 
 type Inode struct {
@@ -354,7 +361,7 @@ type DirectoryTreeRoot struct {
 	DotDot         DirectoryEntry
 	DotDotName     [4]byte
 	ReservedZero   uint32
-	HashVersion    uint8
+	HashVersion    DirectoryHashVersion
 	InfoLength     uint8
 	IndirectLevels uint8
 	UnusedFlags    uint8
@@ -364,6 +371,17 @@ type DirectoryTreeRoot struct {
 	//Entries        []DirectoryTreeEntry
 }
 
+type DirectoryHashVersion uint8
+
+const (
+	DirectoryHashLegacy          DirectoryHashVersion = 0x0
+	DirectoryHashHalfMD4         DirectoryHashVersion = 0x1
+	DirectoryHashTea             DirectoryHashVersion = 0x2
+	DirectoryHashLegacyUnsigned  DirectoryHashVersion = 0x3
+	DirectoryHashHalfMD4Unsigned DirectoryHashVersion = 0x4
+	DirectoryHashTeaUnsigned     DirectoryHashVersion = 0x5
+)
+
 type DirectoryTreeNode struct {
 	FakeInode        uint32
 	FakeRecordLength uint16
@@ -409,3 +427,89 @@ type XAttrEntry struct {
 	Hash        uint32
 	//Name        []byte
 }
+
+// POSIX ACLs are stored in the system.posix_acl_access and
+// system.posix_acl_default xattrs. Entries for named users and groups are
+// ACLEntry; the others are ACLEntryShort.
+
+const ACLVersion uint32 = 1
+
+type ACLTag uint16
+
+const (
+	ACLUserObj  ACLTag = 0x1
+	ACLUser     ACLTag = 0x2
+	ACLGroupObj ACLTag = 0x4
+	ACLGroup    ACLTag = 0x8
+	ACLMask     ACLTag = 0x10
+	ACLOther    ACLTag = 0x20
+)
+
+type ACLEntry struct {
+	Tag  ACLTag
+	Perm uint16
+	ID   uint32
+}
+
+type ACLEntryShort struct {
+	Tag  ACLTag
+	Perm uint16
+}
+
+// The JBD2 journal structures are big-endian.
+
+const JournalMagic uint32 = 0xc03b3998
+
+type JournalBlockType uint32
+
+const (
+	JournalBlockTypeDescriptor   JournalBlockType = 1
+	JournalBlockTypeCommit       JournalBlockType = 2
+	JournalBlockTypeSuperBlockV1 JournalBlockType = 3
+	JournalBlockTypeSuperBlockV2 JournalBlockType = 4
+	JournalBlockTypeRevoke       JournalBlockType = 5
+)
+
+type JournalIncompatFeature uint32
+
+const (
+	JournalIncompatRevoke      JournalIncompatFeature = 0x1
+	JournalIncompat64Bit       JournalIncompatFeature = 0x2
+	JournalIncompatAsyncCommit JournalIncompatFeature = 0x4
+	JournalIncompatCsumV2      JournalIncompatFeature = 0x8
+	JournalIncompatCsumV3      JournalIncompatFeature = 0x10
+	JournalIncompatFastCommit  JournalIncompatFeature = 0x20
+)
+
+const JournalChecksumCrc32c uint8 = 4
+
+type JournalHeader struct {
+	Magic     uint32
+	BlockType JournalBlockType
+	Sequence  uint32
+}
+
+type JournalSuperBlock struct {
+	Header          JournalHeader
+	BlockSize       uint32
+	MaxLen          uint32
+	First           uint32
+	Sequence        uint32
+	Start           uint32
+	Errno           int32
+	FeatureCompat   uint32
+	FeatureIncompat JournalIncompatFeature
+	FeatureRoCompat uint32
+	UUID            [16]uint8
+	NrUsers         uint32
+	DynSuper        uint32
+	MaxTransaction  uint32
+	MaxTransData    uint32
+	ChecksumType    uint8
+	Padding2        [3]uint8
+	NumFcBlocks     uint32
+	Head            uint32
+	Padding         [40]uint32
+	Checksum        uint32
+	Users           [16 * 48]uint8
+}
@@ -0,0 +1,83 @@
+// Package vhdformat holds the on-disk structures of VHD and VHDX files, which
+// are shared by the writers in tar2ext4 and the reader in package vhd.
+package vhdformat
+
+// Constants for VHD files
+const (
+	VhdCookie            = "conectix"
+	VhdFeatureMask       = 0x2
+	VhdVersion           = 0x00010000
+	VhdCreatorVersion    = 0x000a0000
+	VhdFixedDataOffset   = -1
+	VhdSectorSize        = 512
+	VhdFooterSize        = 512
+	VhdMaxSize           = 2040 * 1024 * 1024 * 1024
+	DiskTypeFixed        = 2
+	DiskTypeDynamic      = 3
+	DiskTypeDifferencing = 4
+	DynamicHeaderCookie  = "cxsparse"
+	DynamicHeaderVersion = 0x00010000
+	DynamicHeaderSize    = 1024
+	BatEntryUnused       = 0xffffffff
+
+	// Offsets of the checksum fields, which are excluded from the checksums.
+	FooterChecksumOffset        = 64
+	DynamicHeaderChecksumOffset = 36
+)
+
+// Footer is the VHD footer, which is stored at the end of every VHD and also
+// at the start of dynamic and differencing VHDs.
+type Footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         int64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       int64
+	CurrentSize        int64
+	DiskGeometry       uint32
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]uint8
+	SavedState         uint8
+	Reserved           [427]uint8
+}
+
+// DynamicHeader is the header of a dynamic or differencing VHD.
+type DynamicHeader struct {
+	Cookie               [8]byte
+	DataOffset           int64
+	TableOffset          int64
+	HeaderVersion        uint32
+	MaxTableEntries      uint32
+	BlockSize            uint32
+	Checksum             uint32
+	ParentUniqueID       [16]byte
+	ParentTimeStamp      uint32
+	Reserved1            uint32
+	ParentUnicodeName    [512]byte
+	ParentLocatorEntries [8][24]byte
+	Reserved2            [256]byte
+}
+
+// Checksum returns the VHD checksum of the encoded structure b, which is the
+// one's complement of the sum of its bytes, skipping the four-byte checksum
+// field at checksumOffset.
+func Checksum(b []byte, checksumOffset int) uint32 {
+	var chk uint32
+	for i, c := range b {
+		if i < checksumOffset || i >= checksumOffset+4 {
+			chk += uint32(c)
+		}
+	}
+	return ^chk
+}
+
+// SectorBitmapSize returns the size of the sector bitmap that precedes each
+// block of a dynamic VHD, which is padded to a whole number of sectors.
+func SectorBitmapSize(blockSize uint32) int64 {
+	return (int64(blockSize)/VhdSectorSize/8 + VhdSectorSize - 1) / VhdSectorSize * VhdSectorSize
+}
@@ -0,0 +1,127 @@
+package vhdformat
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"strings"
+)
+
+// Constants for VHDX files
+const (
+	VhdxFileSignature       = "vhdxfile"
+	VhdxHeaderSignature     = 0x64616568 // "head"
+	VhdxRegionSignature     = 0x69676572 // "regi"
+	VhdxMetadataSignature   = "metadata"
+	VhdxVersion             = 1
+	VhdxStructureSize       = 64 * 1024
+	VhdxHeaderSize          = 4 * 1024
+	VhdxAlignment           = 1024 * 1024
+	VhdxMaxSize             = 64 * 1024 * 1024 * 1024 * 1024
+	VhdxMaxRegionEntries    = 2047
+	VhdxMaxMetadataEntries  = 2047
+	VhdxRegionRequired      = 1
+	VhdxMetadataIsVirtual   = 2
+	VhdxMetadataIsRequired  = 4
+	VhdxFileHasParent       = 2
+	VhdxPayloadNotPresent   = 0
+	VhdxPayloadUndefined    = 1
+	VhdxPayloadZero         = 2
+	VhdxPayloadUnmapped     = 3
+	VhdxPayloadFullyPresent = 6
+	VhdxPayloadPartial      = 7
+)
+
+// GUIDs of the VHDX regions and metadata items.
+var (
+	VhdxBatRegionGUID         = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	VhdxMetadataRegionGUID    = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	VhdxFileParametersGUID    = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	VhdxVirtualDiskSizeGUID   = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	VhdxVirtualDiskIDGUID     = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746") // page 83 data
+	VhdxLogicalSectorSizeGUID = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	VhdxPhysSectorSizeGUID    = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	VhdxParentLocatorGUID     = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+)
+
+// mustParseGUID converts a GUID string to its on-disk form, in which the
+// first three fields are little endian.
+func mustParseGUID(s string) [16]byte {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		panic("invalid GUID " + s)
+	}
+	var guid [16]byte
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(guid[8:], b[8:])
+	return guid
+}
+
+type VhdxFileIdentifier struct {
+	Signature [8]byte
+	Creator   [256]uint16
+}
+
+type VhdxHeader struct {
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+	Reserved       [4016]byte
+}
+
+type VhdxRegionTableHeader struct {
+	Signature  uint32
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type VhdxRegionTableEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type VhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type VhdxMetadataTableEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+type VhdxFileParameters struct {
+	BlockSize uint32
+	Flags     uint32
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// VhdxChecksum returns the CRC32C of the encoded structure b, whose checksum
+// field, which follows the four-byte signature, must be zero.
+func VhdxChecksum(b []byte) uint32 {
+	return crc32.Checksum(b, crc32cTable)
+}
+
+// VhdxChunkRatio returns the number of payload blocks that are followed by a
+// sector bitmap entry in the BAT.
+func VhdxChunkRatio(logicalSectorSize, blockSize uint32) int64 {
+	return int64(1<<23) * int64(logicalSectorSize) / int64(blockSize)
+}
@@ -0,0 +1,145 @@
+package tar2ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+// aclRecords maps the PAX records in which GNU tar and star store POSIX ACLs
+// as text to the xattrs that hold them.
+var aclRecords = []struct {
+	record, xattr string
+}{
+	{"SCHILY.acl.access", "system.posix_acl_access"},
+	{"SCHILY.acl.default", "system.posix_acl_default"},
+}
+
+const aclXattrVersion = 2 // POSIX_ACL_XATTR_VERSION
+
+type aclEntry struct {
+	tag  format.ACLTag
+	perm uint16
+	id   uint32
+}
+
+// parseACL converts an ACL in the text form of acl(5) to the xattr format
+// returned by getxattr(2). Entries are separated by commas or newlines and
+// have the form tag:qualifier:perms, to which star appends the numeric ID of a
+// named user or group. User and group names cannot be resolved here, so named
+// entries must have a numeric qualifier or ID. It returns nil for an empty
+// ACL.
+func parseACL(text string) ([]byte, error) {
+	var entries []aclEntry
+	for _, s := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			// Drop comments such as #effective:r--.
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		e, err := parseACLEntry(s)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	// The kernel requires the entries in order of tag and then ID.
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	counts := make(map[format.ACLTag]int)
+	for i, e := range entries {
+		if i > 0 && e.tag == entries[i-1].tag && e.id == entries[i-1].id {
+			return nil, errors.New("duplicate ACL entry")
+		}
+		counts[e.tag]++
+	}
+	if counts[format.ACLUserObj] != 1 || counts[format.ACLGroupObj] != 1 || counts[format.ACLOther] != 1 {
+		return nil, errors.New("ACL must have one user, group and other entry")
+	}
+	if counts[format.ACLUser]+counts[format.ACLGroup] != 0 && counts[format.ACLMask] == 0 {
+		return nil, errors.New("ACL with named entries has no mask entry")
+	}
+
+	b := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for i, e := range entries {
+		eb := b[4+8*i:]
+		binary.LittleEndian.PutUint16(eb, uint16(e.tag))
+		binary.LittleEndian.PutUint16(eb[2:], e.perm)
+		binary.LittleEndian.PutUint32(eb[4:], e.id)
+	}
+	return b, nil
+}
+
+func parseACLEntry(s string) (aclEntry, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return aclEntry{}, fmt.Errorf("invalid ACL entry %q", s)
+	}
+	e := aclEntry{id: 0xffffffff}
+	named := fields[1] != ""
+	switch fields[0] {
+	case "user", "u":
+		e.tag = format.ACLUserObj
+		if named {
+			e.tag = format.ACLUser
+		}
+	case "group", "g":
+		e.tag = format.ACLGroupObj
+		if named {
+			e.tag = format.ACLGroup
+		}
+	case "mask", "m":
+		e.tag = format.ACLMask
+	case "other", "o":
+		e.tag = format.ACLOther
+	default:
+		return aclEntry{}, fmt.Errorf("invalid ACL entry %q", s)
+	}
+	if named {
+		if e.tag != format.ACLUser && e.tag != format.ACLGroup {
+			return aclEntry{}, fmt.Errorf("invalid ACL entry %q", s)
+		}
+		id := fields[1]
+		if len(fields) == 4 {
+			id = fields[3]
+		}
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return aclEntry{}, fmt.Errorf("ACL entry %q: no numeric ID", s)
+		}
+		e.id = uint32(n)
+	} else if len(fields) == 4 {
+		return aclEntry{}, fmt.Errorf("invalid ACL entry %q", s)
+	}
+	for _, c := range fields[2] {
+		switch c {
+		case 'r':
+			e.perm |= 4
+		case 'w':
+			e.perm |= 2
+		case 'x':
+			e.perm |= 1
+		case '-':
+		default:
+			return aclEntry{}, fmt.Errorf("invalid permissions in ACL entry %q", s)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,155 @@
+package tar2ext4
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+	"github.com/Microsoft/hcsshim/ext4/internal/format"
+)
+
+const undefinedID = 0xffffffff
+
+// makeACL returns an ACL in the xattr format.
+func makeACL(entries ...aclEntry) []byte {
+	b := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for i, e := range entries {
+		binary.LittleEndian.PutUint16(b[4+8*i:], uint16(e.tag))
+		binary.LittleEndian.PutUint16(b[6+8*i:], e.perm)
+		binary.LittleEndian.PutUint32(b[8+8*i:], e.id)
+	}
+	return b
+}
+
+var testACL = makeACL(
+	aclEntry{format.ACLUserObj, 6, undefinedID},
+	aclEntry{format.ACLUser, 4, 1000},
+	aclEntry{format.ACLGroupObj, 4, undefinedID},
+	aclEntry{format.ACLGroup, 6, 50},
+	aclEntry{format.ACLGroup, 2, 2000},
+	aclEntry{format.ACLMask, 6, undefinedID},
+	aclEntry{format.ACLOther, 0, undefinedID},
+)
+
+func TestParseACL(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []byte
+		err      bool
+	}{
+		{text: "user::rw-,user:1000:r--,group::r--,group:50:rw-,group:2000:-w-,mask::rw-,other::---", expected: testACL},
+		// star format with names and IDs, out of order, with comments.
+		{text: "other::---,group:staff:-w-:2000,user::rw-,user:bob:r--:1000\ngroup::r--,group:adm:rw-:50 #effective:rw-,mask::rw-", expected: testACL},
+		{text: "u::rw,u:1000:r,g::r,g:50:rw,g:2000:w,m::rw,o::", expected: testACL},
+		{text: "", expected: nil},
+		{text: "user::rw-,user:bob:r--,group::r--,mask::r--,other::---", err: true},
+		{text: "user::rw-,user:1000:r--,group::r--,other::---", err: true},
+		{text: "user::rw-,user:1000:r--,user:1000:r--,group::r--,mask::r--,other::---", err: true},
+		{text: "user::rwz,group::r--,other::---", err: true},
+		{text: "user::rw-,group::r--", err: true},
+		{text: "mask:1:rw-,user::rw-,group::r--,other::---", err: true},
+	}
+	for _, test := range tests {
+		b, err := parseACL(test.text)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error", test.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.text, err)
+		} else if !bytes.Equal(b, test.expected) {
+			t.Errorf("%q: got %x, expected %x", test.text, b, test.expected)
+		}
+	}
+}
+
+func TestConvertACLs(t *testing.T) {
+	defaultACL := makeACL(
+		aclEntry{format.ACLUserObj, 7, undefinedID},
+		aclEntry{format.ACLGroupObj, 5, undefinedID},
+		aclEntry{format.ACLOther, 5, undefinedID},
+	)
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, hdr := range []*tar.Header{
+		{
+			Name:     "dir/",
+			Typeflag: tar.TypeDir,
+			Mode:     0775,
+			PAXRecords: map[string]string{
+				"SCHILY.acl.access":  "user::rwx,group::rwx,other::r-x",
+				"SCHILY.acl.default": "user::rwx,group::r-x,other::r-x",
+			},
+		},
+		{
+			Name:       "dir/text",
+			Typeflag:   tar.TypeReg,
+			Mode:       0660,
+			PAXRecords: map[string]string{"SCHILY.acl.access": "user::rw-,user:1000:r--,group::r--,group:50:rw-,group:2000:-w-,mask::rw-,other::---"},
+		},
+		{
+			Name:       "dir/xattr",
+			Typeflag:   tar.TypeReg,
+			Mode:       0660,
+			PAXRecords: map[string]string{"SCHILY.xattr.system.posix_acl_access": string(testACL)},
+		},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "tar2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := Convert(&b, f); err != nil {
+		t.Fatal(err)
+	}
+	r, err := compactext4.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string][]byte{
+		"dir": {
+			"system.posix_acl_access": makeACL(
+				aclEntry{format.ACLUserObj, 7, undefinedID},
+				aclEntry{format.ACLGroupObj, 7, undefinedID},
+				aclEntry{format.ACLOther, 5, undefinedID},
+			),
+			"system.posix_acl_default": defaultACL,
+		},
+		"dir/text":  {"system.posix_acl_access": testACL},
+		"dir/xattr": {"system.posix_acl_access": testACL},
+	}
+	for name, xattrs := range expected {
+		st, err := r.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for xname, value := range xattrs {
+			if !bytes.Equal(st.Xattrs[xname], value) {
+				t.Errorf("%s: %s is %x, expected %x", name, xname, st.Xattrs[xname], value)
+			}
+		}
+	}
+	findings, err := compactext4.Verify(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, finding := range findings {
+		t.Error(finding)
+	}
+}
@@ -0,0 +1,142 @@
+package tar2ext4
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Digests holds the expected digests of a layer in the "algorithm:hex" form
+// used by OCI. Empty digests are not checked.
+type Digests struct {
+	// Compressed is the digest of the layer as stored, which is the digest in
+	// the layer's OCI descriptor.
+	Compressed string
+	// Uncompressed is the digest of the layer's tar stream, which is the diff
+	// ID in the image configuration.
+	Uncompressed string
+}
+
+// DigestVerify instructs the converter to verify the digests of the input
+// layers while they are converted. One entry must be provided for each layer,
+// in the same order as the layers.
+func DigestVerify(expected ...Digests) Option {
+	return func(p *params) {
+		p.digests = expected
+	}
+}
+
+type digester struct {
+	expected  string
+	algorithm string
+	h         hash.Hash
+}
+
+func newDigester(expected string) (*digester, error) {
+	i := strings.IndexByte(expected, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("%s: invalid digest", expected)
+	}
+	d := &digester{expected: expected, algorithm: expected[:i]}
+	switch d.algorithm {
+	case "sha256":
+		d.h = sha256.New()
+	case "sha512":
+		d.h = sha512.New()
+	default:
+		return nil, fmt.Errorf("%s: unsupported digest algorithm", expected)
+	}
+	return d, nil
+}
+
+func (d *digester) verify(what string) error {
+	if d == nil {
+		return nil
+	}
+	actual := d.algorithm + ":" + hex.EncodeToString(d.h.Sum(nil))
+	if actual != d.expected {
+		return fmt.Errorf("%s digest mismatch: expected %s, got %s", what, d.expected, actual)
+	}
+	return nil
+}
+
+// layerReader reads the tar stream of a layer that may be compressed with gzip
+// or zstd, computing the layer's digests as it goes.
+type layerReader struct {
+	io.Reader
+	close                    func()
+	compressed, uncompressed *digester
+}
+
+func newLayerReader(r io.Reader, expected Digests) (*layerReader, error) {
+	lr := &layerReader{close: func() {}}
+	var err error
+	if expected.Compressed != "" {
+		lr.compressed, err = newDigester(expected.Compressed)
+		if err != nil {
+			return nil, err
+		}
+		r = io.TeeReader(r, lr.compressed.h)
+	}
+	if expected.Uncompressed != "" {
+		lr.uncompressed, err = newDigester(expected.Uncompressed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	lr.Reader = br
+	// A short read means the stream is too small to be compressed; let the tar
+	// reader report any error.
+	magic, _ := br.Peek(len(zstdMagic))
+	if bytes.HasPrefix(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		lr.Reader = zr
+		lr.close = func() { zr.Close() }
+	} else if bytes.Equal(magic, zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		lr.Reader = zr
+		lr.close = zr.Close
+	}
+	if lr.uncompressed != nil {
+		lr.Reader = io.TeeReader(lr.Reader, lr.uncompressed.h)
+	}
+	return lr, nil
+}
+
+// verify reads the remainder of the layer, which the tar reader may have left
+// unread, and checks its digests.
+func (lr *layerReader) verify() error {
+	if lr.compressed == nil && lr.uncompressed == nil {
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, lr.Reader); err != nil {
+		return err
+	}
+	if err := lr.compressed.verify("compressed layer"); err != nil {
+		return err
+	}
+	return lr.uncompressed.verify("uncompressed layer")
+}
@@ -0,0 +1,15 @@
+package tar2ext4
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// makeSparse marks f as a sparse file. NTFS allocates the regions that are
+// skipped when extending a file unless it is sparse, which for an expanded disk
+// would take up the whole disk size.
+func makeSparse(f *os.File) error {
+	var n uint32
+	return windows.DeviceIoControl(windows.Handle(f.Fd()), windows.FSCTL_SET_SPARSE, nil, 0, nil, 0, &n, nil)
+}
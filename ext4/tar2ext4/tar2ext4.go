@@ -2,9 +2,12 @@ package tar2ext4
 
 import (
 	"archive/tar"
-	"bufio"
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 
@@ -14,6 +17,12 @@ import (
 type params struct {
 	convertWhiteout bool
 	appendVhdFooter bool
+	format          imageFormat
+	deterministic   bool
+	digests         []Digests
+	verity          bool
+	veritySalt      []byte
+	verityInfo      *VerityInfo
 	ext4opts        []compactext4.Option
 }
 
@@ -32,6 +41,36 @@ func AppendVhdFooter(p *params) {
 	p.appendVhdFooter = true
 }
 
+type imageFormat int
+
+const (
+	formatRaw imageFormat = iota
+	formatDynamicVhd
+	formatVhdx
+)
+
+// DynamicVhd instructs the converter to write the image as a dynamic VHD
+// rather than as a raw file system image. Only the parts of the disk that
+// contain data are stored in the file.
+func DynamicVhd(p *params) {
+	p.format = formatDynamicVhd
+}
+
+// Vhdx instructs the converter to write the image as a dynamic VHDX rather
+// than as a raw file system image. Only the parts of the disk that contain
+// data are stored in the file.
+func Vhdx(p *params) {
+	p.format = formatVhdx
+}
+
+// Deterministic instructs the converter to produce byte-identical images for
+// identical input. The file system and VHD UUIDs are derived from a hash of the
+// image contents, rather than being zero and random respectively.
+func Deterministic(p *params) {
+	p.deterministic = true
+	p.ext4opts = append(p.ext4opts, compactext4.Deterministic)
+}
+
 // InlineData instructs the converter to write small files into the inode
 // structures directly. This creates smaller images but currently is not
 // compatible with DAX.
@@ -48,20 +87,191 @@ func MaximumDiskSize(size int64) Option {
 	}
 }
 
+// ExpandDisk instructs the converter to size the file system to the maximum
+// disk size rather than to the size of its contents, leaving the remaining
+// space free so that the image can be mounted read-write.
+func ExpandDisk(p *params) {
+	p.ext4opts = append(p.ext4opts, compactext4.ExpandDisk)
+}
+
+// MetadataChecksum instructs the converter to protect the file system metadata
+// with CRC32C checksums (the ext4 metadata_csum feature).
+func MetadataChecksum(p *params) {
+	p.ext4opts = append(p.ext4opts, compactext4.MetadataChecksum)
+}
+
+// Use64Bit instructs the converter to enable the ext4 64bit feature.
+func Use64Bit(p *params) {
+	p.ext4opts = append(p.ext4opts, compactext4.Use64Bit)
+}
+
+// BlockSize instructs the converter to use the specified file system block
+// size, which must be 1024, 2048 or 4096 bytes. The default is 4096.
+func BlockSize(size int) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.BlockSize(size))
+	}
+}
+
+// InodeSize instructs the converter to use the specified inode size, which
+// must be 128 or 256 bytes. The default is 256.
+func InodeSize(size int) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.InodeSize(size))
+	}
+}
+
+// InodeRatio instructs the converter to create one inode for every
+// bytesPerInode bytes of an expanded disk (see ExpandDisk), like the -i option
+// of mke2fs. The default is 16KB.
+func InodeRatio(bytesPerInode int64) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.InodeRatio(bytesPerInode))
+	}
+}
+
+// InodeCount instructs the converter to create at least n inodes, so that
+// files can be created once the image is mounted read-write.
+func InodeCount(n uint32) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.InodeCount(n))
+	}
+}
+
+// ReservedBlocksPercentage instructs the converter to reserve the specified
+// percentage of the file system blocks for the root user, like the -m option
+// of mke2fs. By default no blocks are reserved.
+func ReservedBlocksPercentage(percent int) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.ReservedBlocksPercentage(percent))
+	}
+}
+
+// Journal instructs the converter to create a JBD2 journal of the specified
+// size in bytes, or of a size chosen from the file system size if size is 0.
+// This is intended for images written with ExpandDisk that are mounted
+// read-write.
+func Journal(size int64) Option {
+	return func(p *params) {
+		p.ext4opts = append(p.ext4opts, compactext4.Journal(size))
+	}
+}
+
 const (
 	whiteoutPrefix = ".wh."
 	opaqueWhiteout = ".wh..wh..opq"
+	lostAndFound   = "lost+found"
 )
 
 // Convert writes a compact ext4 file system image that contains the files in the
-// input tar stream.
+// input tar stream, which may be compressed with gzip or zstd.
 func Convert(r io.Reader, w io.ReadWriteSeeker, options ...Option) error {
-	var p params
+	c := newConverter(w, options)
+	return c.convert([]io.Reader{r})
+}
+
+// ConvertLayers writes a compact ext4 file system image that contains the
+// files in the input layer tar streams, applied in order starting with the
+// lowest layer. OCI-style whiteouts in each layer delete files from the layers
+// below it, so ConvertWhiteout has no effect.
+func ConvertLayers(layers []io.Reader, w io.ReadWriteSeeker, options ...Option) error {
+	c := newConverter(w, options)
+	c.flatten = true
+	return c.convert(layers)
+}
+
+// ConvertFS writes a compact ext4 file system image whose files are added by
+// fill, which is passed the writer of the file system, and applies options as
+// Convert does. It lets the packages of this module that build images from
+// sources other than tar streams, such as dir2ext4, share the image formats of
+// Convert. DigestVerify cannot be used, since there is no layer to verify.
+func ConvertFS(w io.ReadWriteSeeker, fill func(fs *compactext4.Writer) error, options ...Option) error {
+	c := newConverter(w, options)
+	if len(c.p.digests) != 0 {
+		return fmt.Errorf("DigestVerify cannot be used without layers")
+	}
+	return c.run(func() error {
+		return fill(c.fs)
+	})
+}
+
+type converter struct {
+	p       params
+	w       io.ReadWriteSeeker
+	image   io.ReadWriteSeeker // the file system image, which is w for raw images
+	tmp     *os.File           // holds the image until it is converted to another format
+	fs      *compactext4.Writer
+	flatten bool
+	added   map[string]bool // paths added by the current layer when flattening
+}
+
+func newConverter(w io.ReadWriteSeeker, options []Option) *converter {
+	c := &converter{w: w}
 	for _, opt := range options {
-		opt(&p)
+		opt(&c.p)
+	}
+	return c
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+func (c *converter) convert(layers []io.Reader) error {
+	if len(c.p.digests) != 0 && len(c.p.digests) != len(layers) {
+		return fmt.Errorf("%d digests provided for %d layers", len(c.p.digests), len(layers))
+	}
+	return c.run(func() error {
+		for i, r := range layers {
+			var expected Digests
+			if len(c.p.digests) != 0 {
+				expected = c.p.digests[i]
+			}
+			if err := c.convertLayer(r, expected); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// run creates the file system, calls fill to add its files, and then writes
+// the image in the requested format.
+func (c *converter) run(fill func() error) error {
+	if c.p.appendVhdFooter && c.p.format != formatRaw {
+		return fmt.Errorf("AppendVhdFooter cannot be combined with a dynamic disk format")
+	}
+	c.image = c.w
+	if c.p.format != formatRaw {
+		// The file system is written to a temporary file first so that the
+		// disk can be laid out around the blocks that are in use.
+		f, err := ioutil.TempFile("", "tar2ext4")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := makeSparse(f); err != nil {
+			return err
+		}
+		c.image = f
+		c.tmp = f
+	}
+	c.fs = compactext4.NewWriter(c.image, c.p.ext4opts...)
+	if err := fill(); err != nil {
+		return err
+	}
+	return c.finish()
+}
+
+func (c *converter) convertLayer(r io.Reader, expected Digests) error {
+	c.added = make(map[string]bool)
+	lr, err := newLayerReader(r, expected)
+	if err != nil {
+		return err
 	}
-	t := tar.NewReader(bufio.NewReader(r))
-	fs := compactext4.NewWriter(w, p.ext4opts...)
+	defer lr.close()
+	t := tar.NewReader(lr)
 	for {
 		hdr, err := t.Next()
 		if err == io.EOF {
@@ -70,102 +280,185 @@ func Convert(r io.Reader, w io.ReadWriteSeeker, options ...Option) error {
 		if err != nil {
 			return err
 		}
+		if err := c.convertEntry(hdr, t); err != nil {
+			return err
+		}
+	}
+	return lr.verify()
+}
 
-		if p.convertWhiteout {
-			dir, name := path.Split(hdr.Name)
-			if strings.HasPrefix(name, whiteoutPrefix) {
-				if name == opaqueWhiteout {
-					// Update the directory with the appropriate xattr.
-					f, err := fs.Stat(dir)
-					if err != nil {
-						return err
-					}
-					f.Xattrs["trusted.overlay.opaque"] = []byte("y")
-					err = fs.Create(dir, f)
-					if err != nil {
-						return err
-					}
-				} else {
-					// Create an overlay-style whiteout.
-					f := &compactext4.File{
-						Mode:     compactext4.S_IFCHR,
-						Devmajor: 0,
-						Devminor: 0,
-					}
-					err = fs.Create(path.Join(dir, name[len(whiteoutPrefix):]), f)
-					if err != nil {
-						return err
-					}
-				}
-
-				continue
+// removeLower deletes the contents of dir that were not added by the current
+// layer, which is the effect of an opaque whiteout.
+func (c *converter) removeLower(dir string) error {
+	entries, err := c.fs.ReadDir(dir)
+	if err != nil {
+		// The directory does not exist, so there is nothing to hide.
+		return nil
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name)
+		if cleanPath(name) == lostAndFound {
+			// This is required by e2fsck and is not part of any layer.
+			continue
+		}
+		if !c.added[cleanPath(name)] {
+			if err := c.fs.RemoveAll(name); err != nil {
+				return err
+			}
+		} else if e.Mode == compactext4.S_IFDIR {
+			if err := c.removeLower(name); err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
 
-		if hdr.Typeflag == tar.TypeLink {
-			err = fs.Link(hdr.Linkname, hdr.Name)
+func (c *converter) convertEntry(hdr *tar.Header, t io.Reader) error {
+	fs := c.fs
+	dir, name := path.Split(hdr.Name)
+	if c.flatten && strings.HasPrefix(name, whiteoutPrefix) {
+		if name == opaqueWhiteout {
+			return c.removeLower(dir)
+		}
+		return fs.RemoveAll(path.Join(dir, name[len(whiteoutPrefix):]))
+	}
+	if c.p.convertWhiteout && strings.HasPrefix(name, whiteoutPrefix) {
+		if name == opaqueWhiteout {
+			// Update the directory with the appropriate xattr.
+			f, err := fs.Stat(dir)
+			if err != nil {
+				return err
+			}
+			f.Xattrs["trusted.overlay.opaque"] = []byte("y")
+			err = fs.Create(dir, f)
 			if err != nil {
 				return err
 			}
 		} else {
+			// Create an overlay-style whiteout.
 			f := &compactext4.File{
-				Mode:     uint16(hdr.Mode),
-				Atime:    hdr.AccessTime,
-				Mtime:    hdr.ModTime,
-				Ctime:    hdr.ChangeTime,
-				Crtime:   hdr.ModTime,
-				Size:     hdr.Size,
-				Uid:      uint32(hdr.Uid),
-				Gid:      uint32(hdr.Gid),
-				Linkname: hdr.Linkname,
-				Devmajor: uint32(hdr.Devmajor),
-				Devminor: uint32(hdr.Devminor),
-				Xattrs:   make(map[string][]byte),
-			}
-			for key, value := range hdr.PAXRecords {
-				const xattrPrefix = "SCHILY.xattr."
-				if strings.HasPrefix(key, xattrPrefix) {
-					f.Xattrs[key[len(xattrPrefix):]] = []byte(value)
-				}
+				Mode:     compactext4.S_IFCHR,
+				Devmajor: 0,
+				Devminor: 0,
 			}
-
-			var typ uint16
-			switch hdr.Typeflag {
-			case tar.TypeReg, tar.TypeRegA:
-				typ = compactext4.S_IFREG
-			case tar.TypeSymlink:
-				typ = compactext4.S_IFLNK
-			case tar.TypeChar:
-				typ = compactext4.S_IFCHR
-			case tar.TypeBlock:
-				typ = compactext4.S_IFBLK
-			case tar.TypeDir:
-				typ = compactext4.S_IFDIR
-			case tar.TypeFifo:
-				typ = compactext4.S_IFIFO
-			}
-			f.Mode &= ^compactext4.TypeMask
-			f.Mode |= typ
-			err = fs.Create(hdr.Name, f)
+			err := fs.Create(path.Join(dir, name[len(whiteoutPrefix):]), f)
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(fs, t)
-			if err != nil {
-				return err
+		}
+
+		return nil
+	}
+
+	if c.flatten {
+		// An entry replaces any file from a lower layer, even one of a
+		// different type.
+		if f, err := fs.Stat(hdr.Name); err == nil {
+			isDir := f.Mode&compactext4.TypeMask == compactext4.S_IFDIR
+			if hdr.Typeflag == tar.TypeLink || isDir != (hdr.Typeflag == tar.TypeDir) {
+				if err := fs.RemoveAll(hdr.Name); err != nil {
+					return err
+				}
 			}
 		}
+		c.added[cleanPath(hdr.Name)] = true
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		return fs.Link(hdr.Linkname, hdr.Name)
+	}
+	f := &compactext4.File{
+		Mode:     uint16(hdr.Mode),
+		Atime:    hdr.AccessTime,
+		Mtime:    hdr.ModTime,
+		Ctime:    hdr.ChangeTime,
+		Crtime:   hdr.ModTime,
+		Size:     hdr.Size,
+		Uid:      uint32(hdr.Uid),
+		Gid:      uint32(hdr.Gid),
+		Linkname: hdr.Linkname,
+		Devmajor: uint32(hdr.Devmajor),
+		Devminor: uint32(hdr.Devminor),
+		Xattrs:   make(map[string][]byte),
+	}
+	for key, value := range hdr.PAXRecords {
+		const xattrPrefix = "SCHILY.xattr."
+		if strings.HasPrefix(key, xattrPrefix) {
+			f.Xattrs[key[len(xattrPrefix):]] = []byte(value)
+		}
+	}
+	for _, acl := range aclRecords {
+		text, ok := hdr.PAXRecords[acl.record]
+		if _, exists := f.Xattrs[acl.xattr]; !ok || exists {
+			// A SCHILY.xattr record holds the ACL exactly, so prefer it.
+			continue
+		}
+		value, err := parseACL(text)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", hdr.Name, acl.record, err)
+		}
+		if value != nil {
+			f.Xattrs[acl.xattr] = value
+		}
+	}
+
+	var typ uint16
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		typ = compactext4.S_IFREG
+	case tar.TypeSymlink:
+		typ = compactext4.S_IFLNK
+	case tar.TypeChar:
+		typ = compactext4.S_IFCHR
+	case tar.TypeBlock:
+		typ = compactext4.S_IFBLK
+	case tar.TypeDir:
+		typ = compactext4.S_IFDIR
+	case tar.TypeFifo:
+		typ = compactext4.S_IFIFO
+	}
+	f.Mode &= ^compactext4.TypeMask
+	f.Mode |= typ
+	err := fs.Create(hdr.Name, f)
+	if err != nil {
+		return err
 	}
-	err := fs.Close()
+	_, err = io.Copy(fs, t)
+	return err
+}
+
+func (c *converter) finish() error {
+	err := c.fs.Close()
+	if err != nil {
+		return err
+	}
+	size, err := c.image.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
-	if p.appendVhdFooter {
-		size, err := w.Seek(0, io.SeekEnd)
+	var uuid [16]byte
+	if c.p.deterministic {
+		fsUUID := c.fs.UUID()
+		sum := sha256.Sum256(fsUUID[:])
+		uuid = compactext4.UUIDFromHash(sum[:])
+	} else {
+		uuid = generateUUID()
+	}
+	if c.p.verity {
+		size, err = c.appendVerity(size, uuid)
 		if err != nil {
 			return err
 		}
-		err = binary.Write(w, binary.BigEndian, makeFixedVHDFooter(size))
+	}
+	switch c.p.format {
+	case formatDynamicVhd:
+		return writeDynamicVHD(c.w, c.tmp, size, uuid)
+	case formatVhdx:
+		return writeVHDX(c.w, c.tmp, size, uuid)
+	}
+	if c.p.appendVhdFooter {
+		err = binary.Write(c.w, binary.BigEndian, makeFixedVHDFooter(size, uuid))
 		if err != nil {
 			return err
 		}
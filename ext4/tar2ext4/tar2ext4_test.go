@@ -0,0 +1,258 @@
+package tar2ext4
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+	"github.com/klauspost/compress/zstd"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	data     string
+	linkname string
+}
+
+func makeLayer(t *testing.T, entries []testEntry) io.Reader {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.data)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &b
+}
+
+// readTree returns the contents of the regular files in the image and "/" for
+// each directory, keyed by path.
+func readTree(t *testing.T, r *compactext4.Reader, dir string, tree map[string]string) {
+	entries, err := r.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name)
+		switch e.Mode {
+		case compactext4.S_IFDIR:
+			tree[name] = "/"
+			readTree(t, r, name, tree)
+		case compactext4.S_IFREG:
+			f, err := r.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree[name] = string(b)
+		default:
+			tree[name] = "?"
+		}
+	}
+}
+
+func TestConvertLayers(t *testing.T) {
+	big := string(bytes.Repeat([]byte("0123456789"), 1000))
+	lower := makeLayer(t, []testEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a", typeflag: tar.TypeReg, data: "a1"},
+		{name: "dir/b", typeflag: tar.TypeReg, data: "b1"},
+		{name: "dir/sub/", typeflag: tar.TypeDir},
+		{name: "dir/sub/c", typeflag: tar.TypeReg, data: "c1"},
+		{name: "opaque/", typeflag: tar.TypeDir},
+		{name: "opaque/old", typeflag: tar.TypeReg, data: "old"},
+		{name: "opaque/keep/", typeflag: tar.TypeDir},
+		{name: "opaque/keep/old", typeflag: tar.TypeReg, data: "old"},
+		{name: "big", typeflag: tar.TypeReg, data: big},
+		{name: "target", typeflag: tar.TypeReg, data: "t1"},
+		{name: "link", typeflag: tar.TypeLink, linkname: "target"},
+		{name: "typechange", typeflag: tar.TypeReg, data: "file"},
+	})
+	upper := makeLayer(t, []testEntry{
+		{name: "dir/.wh.a", typeflag: tar.TypeReg},
+		{name: "dir/sub/.wh.missing", typeflag: tar.TypeReg},
+		{name: "opaque/", typeflag: tar.TypeDir},
+		{name: "opaque/keep/", typeflag: tar.TypeDir},
+		{name: "opaque/keep/new", typeflag: tar.TypeReg, data: "new"},
+		{name: "opaque/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "opaque/new", typeflag: tar.TypeReg, data: "new"},
+		{name: "big", typeflag: tar.TypeReg, data: big[1:]},
+		{name: "target", typeflag: tar.TypeReg, data: "t2"},
+		{name: "typechange/", typeflag: tar.TypeDir},
+		{name: "typechange/x", typeflag: tar.TypeReg, data: "x"},
+	})
+	top := makeLayer(t, []testEntry{
+		{name: ".wh.dir", typeflag: tar.TypeReg},
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/d", typeflag: tar.TypeReg, data: "d3"},
+	})
+
+	f, err := ioutil.TempFile("", "tar2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := ConvertLayers([]io.Reader{lower, upper, top}, f); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := compactext4.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := make(map[string]string)
+	readTree(t, r, "", tree)
+	expected := map[string]string{
+		"lost+found":      "/",
+		"dir":             "/",
+		"dir/d":           "d3",
+		"opaque":          "/",
+		"opaque/keep":     "/",
+		"opaque/keep/new": "new",
+		"opaque/new":      "new",
+		"big":             big[1:],
+		"target":          "t2",
+		"link":            "t1",
+		"typechange":      "/",
+		"typechange/x":    "x",
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("unexpected tree:\n%v\nexpected:\n%v", tree, expected)
+	}
+}
+
+func sha256Digest(b []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+}
+
+func TestConvertCompressed(t *testing.T) {
+	layer, err := ioutil.ReadAll(makeLayer(t, []testEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a", typeflag: tar.TypeReg, data: "a"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(layer)
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(layer)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		digests     Digests
+		expectError bool
+	}{
+		{name: "plain", data: layer},
+		{name: "gzip", data: gz.Bytes()},
+		{name: "zstd", data: zst.Bytes()},
+		{
+			name:    "plain digests",
+			data:    layer,
+			digests: Digests{Compressed: sha256Digest(layer), Uncompressed: sha256Digest(layer)},
+		},
+		{
+			name:    "gzip digests",
+			data:    gz.Bytes(),
+			digests: Digests{Compressed: sha256Digest(gz.Bytes()), Uncompressed: sha256Digest(layer)},
+		},
+		{
+			name:    "zstd diff ID",
+			data:    zst.Bytes(),
+			digests: Digests{Uncompressed: sha256Digest(layer)},
+		},
+		{
+			name:        "compressed mismatch",
+			data:        gz.Bytes(),
+			digests:     Digests{Compressed: sha256Digest(layer)},
+			expectError: true,
+		},
+		{
+			name:        "uncompressed mismatch",
+			data:        zst.Bytes(),
+			digests:     Digests{Uncompressed: sha256Digest(zst.Bytes())},
+			expectError: true,
+		},
+		{
+			name:        "unsupported algorithm",
+			data:        layer,
+			digests:     Digests{Compressed: "md5:d41d8cd98f00b204e9800998ecf8427e"},
+			expectError: true,
+		},
+	}
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "tar2ext4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		err = Convert(bytes.NewReader(test.data), f, DigestVerify(test.digests))
+		if test.expectError {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		r, err := compactext4.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := make(map[string]string)
+		readTree(t, r, "", tree)
+		expected := map[string]string{
+			"lost+found": "/",
+			"dir":        "/",
+			"dir/a":      "a",
+		}
+		if !reflect.DeepEqual(tree, expected) {
+			t.Errorf("%s: unexpected tree:\n%v\nexpected:\n%v", test.name, tree, expected)
+		}
+	}
+}
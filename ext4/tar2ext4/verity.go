@@ -0,0 +1,171 @@
+package tar2ext4
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	verityBlockSize      = 4096
+	verityMaxSaltSize    = 256
+	veritySignature      = "verity\x00\x00"
+	verityVersion        = 1
+	verityHashTypeNormal = 1 // the standard format rather than the Chrome OS one
+)
+
+// VerityInfo describes the dm-verity hash tree appended to an image.
+type VerityInfo struct {
+	// RootHash is the SHA-256 root hash of the tree.
+	RootHash []byte
+	// Salt is the salt that was hashed with each block.
+	Salt []byte
+	// DataBlocks is the number of 4K file system blocks covered by the tree.
+	DataBlocks int64
+	// HashOffset is the offset in bytes of the verity superblock, which is
+	// followed by the tree. It is also the size of the file system.
+	HashOffset int64
+}
+
+// AppendVerity instructs the converter to append a dm-verity hash tree,
+// preceded by a verity superblock, to the file system image. The tree uses
+// SHA-256 and 4K data and hash blocks, so the image can be opened with
+// `veritysetup --hash-offset`. A random salt is used if salt is nil, or one
+// derived from the image contents if Deterministic is also given. If info is
+// not nil, it is filled in with the root hash and layout of the tree.
+func AppendVerity(salt []byte, info *VerityInfo) Option {
+	return func(p *params) {
+		p.verity = true
+		p.veritySalt = salt
+		p.verityInfo = info
+	}
+}
+
+// veritySuperBlock is the superblock written by veritysetup.
+type veritySuperBlock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [verityMaxSaltSize]byte
+	_             [168]byte
+}
+
+// verityTree computes the hash tree over dataBlocks blocks read from r. It
+// returns the hash blocks in the order dm-verity expects them on disk, with
+// the level nearest the root first, and the root hash.
+func verityTree(r io.Reader, dataBlocks int64, salt []byte) ([]byte, []byte, error) {
+	hashBlock := func(b []byte) []byte {
+		h := sha256.New()
+		h.Write(salt)
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	var level []byte
+	b := make([]byte, verityBlockSize)
+	for i := int64(0); i < dataBlocks; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		level = append(level, hashBlock(b)...)
+	}
+	var levels [][]byte
+	for {
+		if n := len(level) % verityBlockSize; n != 0 {
+			level = append(level, make([]byte, verityBlockSize-n)...)
+		}
+		levels = append(levels, level)
+		if len(level) == verityBlockSize {
+			break
+		}
+		var next []byte
+		for i := 0; i < len(level); i += verityBlockSize {
+			next = append(next, hashBlock(level[i:i+verityBlockSize])...)
+		}
+		level = next
+	}
+	var tree []byte
+	for i := len(levels) - 1; i >= 0; i-- {
+		tree = append(tree, levels[i]...)
+	}
+	return tree, hashBlock(levels[len(levels)-1]), nil
+}
+
+// appendVerity writes the verity superblock and hash tree after the size bytes
+// of file system in c.image, and returns the new size of the image.
+func (c *converter) appendVerity(size int64, uuid [16]byte) (int64, error) {
+	if size%verityBlockSize != 0 {
+		return 0, fmt.Errorf("image size %d is not a multiple of the verity block size", size)
+	}
+	salt := c.p.veritySalt
+	if salt == nil {
+		if c.p.deterministic {
+			fsUUID := c.fs.UUID()
+			sum := sha256.Sum256(append([]byte("verity salt"), fsUUID[:]...))
+			salt = sum[:]
+		} else {
+			salt = make([]byte, sha256.Size)
+			if _, err := rand.Read(salt); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(salt) > verityMaxSaltSize {
+		return 0, fmt.Errorf("verity salt is longer than %d bytes", verityMaxSaltSize)
+	}
+
+	if _, err := c.image.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	dataBlocks := size / verityBlockSize
+	tree, root, err := verityTree(bufio.NewReader(c.image), dataBlocks, salt)
+	if err != nil {
+		return 0, err
+	}
+
+	sb := veritySuperBlock{
+		Version:       verityVersion,
+		HashType:      verityHashTypeNormal,
+		UUID:          uuid,
+		DataBlockSize: verityBlockSize,
+		HashBlockSize: verityBlockSize,
+		DataBlocks:    uint64(dataBlocks),
+		SaltSize:      uint16(len(salt)),
+	}
+	copy(sb.Signature[:], veritySignature)
+	copy(sb.Algorithm[:], "sha256")
+	copy(sb.Salt[:], salt)
+	if _, err := c.image.Seek(size, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(c.image, binary.LittleEndian, &sb); err != nil {
+		return 0, err
+	}
+	// The tree starts at the next hash block.
+	pad := make([]byte, verityBlockSize-binary.Size(&sb))
+	if _, err := c.image.Write(pad); err != nil {
+		return 0, err
+	}
+	if _, err := c.image.Write(tree); err != nil {
+		return 0, err
+	}
+
+	if info := c.p.verityInfo; info != nil {
+		*info = VerityInfo{
+			RootHash:   root,
+			Salt:       salt,
+			DataBlocks: dataBlocks,
+			HashOffset: size,
+		}
+	}
+	return size + verityBlockSize + int64(len(tree)), nil
+}
@@ -0,0 +1,88 @@
+package tar2ext4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// verifyBlock checks data block n of a verity image against root the way
+// dm-verity does, locating the hash blocks from the superblock alone.
+func verifyBlock(t *testing.T, b []byte, hashOffset int64, sb *veritySuperBlock, root []byte, n uint64) {
+	salt := sb.Salt[:sb.SaltSize]
+	hash := func(block []byte) []byte {
+		h := sha256.New()
+		h.Write(salt)
+		h.Write(block)
+		return h.Sum(nil)
+	}
+	const bits = 7 // 128 SHA-256 digests per 4K hash block
+	levels := 0
+	for (sb.DataBlocks-1)>>(bits*uint(levels)) != 0 {
+		levels++
+	}
+	levelBlock := make([]uint64, levels)
+	position := uint64(1) // the superblock occupies the first hash block
+	for i := levels - 1; i >= 0; i-- {
+		levelBlock[i] = position
+		per := uint64(1) << (bits * uint(i+1))
+		position += (sb.DataBlocks + per - 1) / per
+	}
+
+	want := root
+	for i := levels - 1; i >= 0; i-- {
+		off := hashOffset + int64(levelBlock[i]+n>>(bits*uint(i+1)))*verityBlockSize
+		block := b[off : off+verityBlockSize]
+		if !bytes.Equal(hash(block), want) {
+			t.Fatalf("block %d: hash mismatch at level %d", n, i)
+		}
+		idx := (n >> (bits * uint(i))) & (1<<bits - 1)
+		want = block[idx*sha256.Size : (idx+1)*sha256.Size]
+	}
+	data := b[n*verityBlockSize : (n+1)*verityBlockSize]
+	if !bytes.Equal(hash(data), want) {
+		t.Fatalf("block %d: data hash mismatch", n)
+	}
+}
+
+func TestVerity(t *testing.T) {
+	raw := convertToBytes(t)
+	var info VerityInfo
+	b := convertToBytes(t, AppendVerity(nil, &info), AppendVhdFooter)
+	b = b[:len(b)-512]
+
+	if info.HashOffset != int64(len(raw)) || !bytes.Equal(b[:len(raw)], raw) {
+		t.Fatal("file system changed by appending the hash tree")
+	}
+	var sb veritySuperBlock
+	if err := binary.Read(bytes.NewReader(b[info.HashOffset:]), binary.LittleEndian, &sb); err != nil {
+		t.Fatal(err)
+	}
+	if string(sb.Signature[:]) != veritySignature || sb.Version != 1 || sb.HashType != 1 ||
+		sb.DataBlockSize != verityBlockSize || sb.HashBlockSize != verityBlockSize ||
+		string(bytes.TrimRight(sb.Algorithm[:], "\x00")) != "sha256" {
+		t.Fatalf("unexpected superblock %+v", sb)
+	}
+	if int64(sb.DataBlocks) != info.DataBlocks || info.DataBlocks != int64(len(raw))/verityBlockSize {
+		t.Errorf("superblock covers %d blocks, expected %d", sb.DataBlocks, info.DataBlocks)
+	}
+	if !bytes.Equal(sb.Salt[:sb.SaltSize], info.Salt) {
+		t.Error("salt mismatch")
+	}
+	for _, n := range []uint64{0, 1, 127, 128, 5000, sb.DataBlocks - 1} {
+		verifyBlock(t, b, info.HashOffset, &sb, info.RootHash, n)
+	}
+
+	// The salt is derived from the contents for deterministic images.
+	var info2 VerityInfo
+	convertToBytes(t, AppendVerity(nil, &info2))
+	if !bytes.Equal(info.RootHash, info2.RootHash) {
+		t.Error("root hash is not deterministic")
+	}
+	var info3 VerityInfo
+	convertToBytes(t, AppendVerity([]byte("salt"), &info3))
+	if bytes.Equal(info.RootHash, info3.RootHash) || string(info3.Salt) != "salt" {
+		t.Error("salt was not used")
+	}
+}
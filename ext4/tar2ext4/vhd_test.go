@@ -0,0 +1,209 @@
+package tar2ext4
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/vhdformat"
+)
+
+func convertToBytes(t *testing.T, options ...Option) []byte {
+	layer := makeLayer(t, []testEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a", typeflag: tar.TypeReg, data: string(bytes.Repeat([]byte("a"), 5*1024*1024))},
+	})
+	f, err := ioutil.TempFile("", "tar2ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	options = append(options, Deterministic, MaximumDiskSize(64*1024*1024), ExpandDisk)
+	if err := Convert(layer, f, options...); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func checkDisk(t *testing.T, raw, disk []byte, virtualSize int64, allocated int) {
+	if virtualSize < int64(len(raw)) {
+		t.Fatalf("virtual size %d smaller than image size %d", virtualSize, len(raw))
+	}
+	if !bytes.Equal(disk[:len(raw)], raw) {
+		t.Error("disk contents do not match the image")
+	}
+	if !bytes.Equal(disk[len(raw):], make([]byte, len(disk)-len(raw))) {
+		t.Error("disk is not zero past the end of the image")
+	}
+	// The image has the file data and the metadata at each end.
+	if allocated < 3 || allocated > 8 {
+		t.Errorf("unexpected number of allocated blocks %d", allocated)
+	}
+}
+
+func TestDynamicVhd(t *testing.T) {
+	raw := convertToBytes(t)
+	vhd := convertToBytes(t, DynamicVhd)
+	if len(vhd) > len(raw)/2 {
+		t.Errorf("dynamic VHD too large: %d bytes", len(vhd))
+	}
+
+	var footer vhdformat.Footer
+	if err := binary.Read(bytes.NewReader(vhd[len(vhd)-512:]), binary.BigEndian, &footer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(vhd[:512], vhd[len(vhd)-512:]) {
+		t.Error("footer copy does not match footer")
+	}
+	if footer.DiskType != vhdformat.DiskTypeDynamic || footer.DataOffset != dynamicHeaderOffset {
+		t.Errorf("bad footer %+v", footer)
+	}
+	if footer.Checksum != calculateCheckSum(&footer) {
+		t.Error("bad footer checksum")
+	}
+	geometry := footer.DiskGeometry
+	chsSize := int64(geometry>>16) * int64(geometry>>8&0xff) * int64(geometry&0xff) * vhdSectorSize
+	if chsSize != footer.CurrentSize {
+		t.Errorf("geometry size %d does not match disk size %d", chsSize, footer.CurrentSize)
+	}
+
+	var header vhdformat.DynamicHeader
+	if err := binary.Read(bytes.NewReader(vhd[dynamicHeaderOffset:]), binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	b := vhd[dynamicHeaderOffset : dynamicHeaderOffset+vhdformat.DynamicHeaderSize]
+	if header.Checksum != vhdformat.Checksum(b, vhdformat.DynamicHeaderChecksumOffset) {
+		t.Error("bad header checksum")
+	}
+
+	disk := make([]byte, header.MaxTableEntries*header.BlockSize)
+	allocated := 0
+	for i := 0; i < int(header.MaxTableEntries); i++ {
+		sector := binary.BigEndian.Uint32(vhd[header.TableOffset+int64(i)*4:])
+		if sector == vhdformat.BatEntryUnused {
+			continue
+		}
+		allocated++
+		off := int64(sector)*vhdSectorSize + dynamicBlockBitmapSize
+		copy(disk[i*dynamicBlockSize:], vhd[off:off+dynamicBlockSize])
+	}
+	checkDisk(t, raw, disk[:footer.CurrentSize], footer.CurrentSize, allocated)
+}
+
+func TestVhdx(t *testing.T) {
+	raw := convertToBytes(t)
+	vhdx := convertToBytes(t, Vhdx)
+	if len(vhdx) > len(raw)/2 {
+		t.Errorf("VHDX too large: %d bytes", len(vhdx))
+	}
+	if string(vhdx[:8]) != vhdformat.VhdxFileSignature {
+		t.Fatal("bad file signature")
+	}
+
+	checkCRC := func(name string, b []byte) {
+		b = append([]byte(nil), b...)
+		csum := binary.LittleEndian.Uint32(b[4:])
+		binary.LittleEndian.PutUint32(b[4:], 0)
+		if vhdformat.VhdxChecksum(b) != csum {
+			t.Errorf("bad %s checksum", name)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		off := i * vhdformat.VhdxStructureSize
+		if binary.LittleEndian.Uint32(vhdx[off:]) != vhdformat.VhdxHeaderSignature {
+			t.Fatalf("bad header %d signature", i)
+		}
+		checkCRC("header", vhdx[off:off+vhdformat.VhdxHeaderSize])
+	}
+	var batOffset, metadataOffset uint64
+	for i := 3; i <= 4; i++ {
+		off := i * vhdformat.VhdxStructureSize
+		var table vhdxRegionTable
+		if err := binary.Read(bytes.NewReader(vhdx[off:]), binary.LittleEndian, &table); err != nil {
+			t.Fatal(err)
+		}
+		if table.Header.Signature != vhdformat.VhdxRegionSignature {
+			t.Fatalf("bad region table %d signature", i)
+		}
+		checkCRC("region table", vhdx[off:off+vhdformat.VhdxStructureSize])
+		for _, e := range table.Entries {
+			switch e.GUID {
+			case vhdformat.VhdxBatRegionGUID:
+				batOffset = e.FileOffset
+			case vhdformat.VhdxMetadataRegionGUID:
+				metadataOffset = e.FileOffset
+			}
+		}
+	}
+
+	var mdHeader vhdformat.VhdxMetadataTableHeader
+	r := bytes.NewReader(vhdx[metadataOffset:])
+	if err := binary.Read(r, binary.LittleEndian, &mdHeader); err != nil {
+		t.Fatal(err)
+	}
+	if string(mdHeader.Signature[:]) != vhdformat.VhdxMetadataSignature {
+		t.Fatal("bad metadata signature")
+	}
+	var blockSize uint32
+	var diskSize uint64
+	for i := 0; i < int(mdHeader.EntryCount); i++ {
+		var e vhdformat.VhdxMetadataTableEntry
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			t.Fatal(err)
+		}
+		item := vhdx[metadataOffset+uint64(e.Offset):]
+		switch e.ItemID {
+		case vhdformat.VhdxFileParametersGUID:
+			blockSize = binary.LittleEndian.Uint32(item)
+		case vhdformat.VhdxVirtualDiskSizeGUID:
+			diskSize = binary.LittleEndian.Uint64(item)
+		}
+	}
+	if blockSize != vhdxBlockSize {
+		t.Fatalf("unexpected block size %d", blockSize)
+	}
+
+	blocks := (diskSize + uint64(blockSize) - 1) / uint64(blockSize)
+	disk := make([]byte, blocks*uint64(blockSize))
+	allocated := 0
+	for i := uint64(0); i < blocks; i++ {
+		entry := binary.LittleEndian.Uint64(vhdx[batOffset+(i+i/vhdxChunkRatio)*8:])
+		if entry&7 == 0 {
+			continue
+		}
+		if entry&7 != vhdformat.VhdxPayloadFullyPresent {
+			t.Fatalf("unexpected BAT entry %#x", entry)
+		}
+		allocated++
+		off := entry &^ (vhdformat.VhdxAlignment - 1)
+		copy(disk[i*uint64(blockSize):], vhdx[off:off+uint64(blockSize)])
+	}
+	checkDisk(t, raw, disk[:diskSize], int64(diskSize), allocated)
+}
+
+func TestVhdGeometry(t *testing.T) {
+	for _, size := range []int64{4096, 100 * 1024 * 1024, 16 * 1024 * 1024 * 1024, 200 * 1024 * 1024 * 1024} {
+		geometry, diskSize := vhdGeometry(size)
+		if diskSize < size {
+			t.Errorf("%d: disk size %d too small", size, diskSize)
+		}
+		if geometry == 65535<<16|16<<8|255 {
+			if diskSize != size {
+				t.Errorf("%d: disk size %d changed with maximum geometry", size, diskSize)
+			}
+			continue
+		}
+		chsSize := int64(geometry>>16) * int64(geometry>>8&0xff) * int64(geometry&0xff) * vhdSectorSize
+		if chsSize != diskSize {
+			t.Errorf("%d: geometry %#x does not match disk size %d", size, geometry, diskSize)
+		}
+	}
+}
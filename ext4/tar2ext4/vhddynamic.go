@@ -0,0 +1,168 @@
+package tar2ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/vhdformat"
+)
+
+// Constants for dynamic VHDs
+const (
+	vhdSectorSize          = vhdformat.VhdSectorSize
+	dynamicBlockSize       = 2 * 1024 * 1024
+	dynamicHeaderOffset    = vhdSectorSize
+	dynamicBatOffset       = dynamicHeaderOffset + vhdformat.DynamicHeaderSize
+	dynamicBlockBitmapSize = dynamicBlockSize / vhdSectorSize / 8
+)
+
+// vhdGeometry returns the CHS geometry for a disk of at least size bytes using
+// the algorithm from the VHD specification, along with the size of the disk
+// described by that geometry. Some implementations take the disk size from
+// the geometry, so the cylinder count is rounded up to cover the whole image.
+// Disks too large to describe get the maximum geometry and keep their size.
+func vhdGeometry(size int64) (uint32, int64) {
+	const maxSectors = 65535 * 16 * 255
+	totalSectors := (size + vhdSectorSize - 1) / vhdSectorSize
+	if totalSectors > maxSectors {
+		return 65535<<16 | 16<<8 | 255, size
+	}
+
+	var sectorsPerTrack, heads, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+		}
+	}
+	cylinders := (totalSectors + sectorsPerTrack*heads - 1) / (sectorsPerTrack * heads)
+	if cylinders > 65535 {
+		return 65535<<16 | 16<<8 | 255, size
+	}
+	geometry := uint32(cylinders<<16 | heads<<8 | sectorsPerTrack)
+	return geometry, cylinders * heads * sectorsPerTrack * vhdSectorSize
+}
+
+func makeDynamicVHDFooter(size int64, geometry uint32, uuid [16]byte) *vhdformat.Footer {
+	footer := makeFixedVHDFooter(size, uuid)
+	footer.DataOffset = dynamicHeaderOffset
+	footer.DiskGeometry = geometry
+	footer.DiskType = vhdformat.DiskTypeDynamic
+	footer.Checksum = calculateCheckSum(footer)
+	return footer
+}
+
+func makeDynamicVHDHeader(entries uint32) *vhdformat.DynamicHeader {
+	header := &vhdformat.DynamicHeader{
+		DataOffset:      -1,
+		TableOffset:     dynamicBatOffset,
+		HeaderVersion:   vhdformat.DynamicHeaderVersion,
+		MaxTableEntries: entries,
+		BlockSize:       dynamicBlockSize,
+	}
+	copy(header.Cookie[:], vhdformat.DynamicHeaderCookie)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, header)
+	header.Checksum = vhdformat.Checksum(buf.Bytes(), vhdformat.DynamicHeaderChecksumOffset)
+	return header
+}
+
+// usedBlocks reports which blockSize blocks of the first size bytes of r
+// contain data other than zeros.
+func usedBlocks(r io.ReaderAt, size int64, blockSize int) ([]bool, error) {
+	var used []bool
+	buf := make([]byte, blockSize)
+	zero := make([]byte, blockSize)
+	for off := int64(0); off < size; off += int64(blockSize) {
+		b, err := readBlock(r, buf, off, size)
+		if err != nil {
+			return nil, err
+		}
+		used = append(used, !bytes.Equal(b, zero))
+	}
+	return used, nil
+}
+
+// readBlock reads the block at off into buf, padding it with zeros past size.
+func readBlock(r io.ReaderAt, buf []byte, off, size int64) ([]byte, error) {
+	n := len(buf)
+	if size-off < int64(n) {
+		n = int(size - off)
+	}
+	if _, err := r.ReadAt(buf[:n], off); err != nil {
+		return nil, err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return buf, nil
+}
+
+// writeDynamicVHD writes the first size bytes of r to w as a dynamic VHD. Blocks
+// that contain only zeros are not allocated.
+func writeDynamicVHD(w io.Writer, r io.ReaderAt, size int64, uuid [16]byte) error {
+	if size > vhdformat.VhdMaxSize {
+		return fmt.Errorf("image size %d exceeds the maximum VHD size", size)
+	}
+	geometry, diskSize := vhdGeometry(size)
+	used, err := usedBlocks(r, size, dynamicBlockSize)
+	if err != nil {
+		return err
+	}
+
+	entries := uint32((diskSize + dynamicBlockSize - 1) / dynamicBlockSize)
+	batSectors := (entries*4 + vhdSectorSize - 1) / vhdSectorSize
+	bat := make([]uint32, batSectors*vhdSectorSize/4)
+	sector := uint32(dynamicBatOffset/vhdSectorSize) + batSectors
+	for i := range bat {
+		bat[i] = vhdformat.BatEntryUnused
+		if i < len(used) && used[i] {
+			bat[i] = sector
+			sector += (dynamicBlockBitmapSize + dynamicBlockSize) / vhdSectorSize
+		}
+	}
+
+	footer := makeDynamicVHDFooter(diskSize, geometry, uuid)
+	// The footer is copied to the start of the file.
+	for _, v := range []interface{}{footer, makeDynamicVHDHeader(entries), bat} {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	// Every sector of an allocated block is marked present.
+	bitmap := bytes.Repeat([]byte{0xff}, dynamicBlockBitmapSize)
+	buf := make([]byte, dynamicBlockSize)
+	for i, u := range used {
+		if !u {
+			continue
+		}
+		b, err := readBlock(r, buf, int64(i)*dynamicBlockSize, size)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(bitmap); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.BigEndian, footer)
+}
@@ -0,0 +1,167 @@
+package tar2ext4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"unicode/utf16"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/compactext4"
+	"github.com/Microsoft/hcsshim/ext4/internal/vhdformat"
+)
+
+// Constants for the VHDX files written by the converter
+const (
+	vhdxCreator             = "tar2ext4"
+	vhdxLogOffset           = 1 * vhdformat.VhdxAlignment
+	vhdxLogLength           = vhdformat.VhdxAlignment
+	vhdxMetadataOffset      = 2 * vhdformat.VhdxAlignment
+	vhdxMetadataLength      = vhdformat.VhdxAlignment
+	vhdxBatOffset           = 3 * vhdformat.VhdxAlignment
+	vhdxBlockSize           = 2 * 1024 * 1024
+	vhdxLogicalSectorSize   = 512
+	vhdxPhysicalSectorSize  = 4096
+	vhdxChunkRatio          = (1 << 23) * vhdxLogicalSectorSize / vhdxBlockSize
+	vhdxMetadataItemsOffset = vhdformat.VhdxStructureSize
+)
+
+type vhdxRegionTable struct {
+	Header  vhdformat.VhdxRegionTableHeader
+	Entries [2]vhdformat.VhdxRegionTableEntry
+}
+
+// vhdxStructure encodes v into a buffer of the given size. If checksumSize is
+// not zero, the CRC32C of the first checksumSize bytes is stored in the
+// checksum field that follows the signature.
+func vhdxStructure(v interface{}, size int, checksumSize int) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, v)
+	b := make([]byte, size)
+	copy(b, buf.Bytes())
+	if checksumSize != 0 {
+		binary.LittleEndian.PutUint32(b[4:], vhdformat.VhdxChecksum(b[:checksumSize]))
+	}
+	return b
+}
+
+func roundUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
+
+func makeVHDXMetadata(size int64, uuid [16]byte) []byte {
+	const virtual = vhdformat.VhdxMetadataIsVirtual | vhdformat.VhdxMetadataIsRequired
+	var items bytes.Buffer
+	var entries []vhdformat.VhdxMetadataTableEntry
+	add := func(id [16]byte, flags uint32, v interface{}) {
+		offset := vhdxMetadataItemsOffset + items.Len()
+		binary.Write(&items, binary.LittleEndian, v)
+		entries = append(entries, vhdformat.VhdxMetadataTableEntry{
+			ItemID: id,
+			Offset: uint32(offset),
+			Length: uint32(vhdxMetadataItemsOffset + items.Len() - offset),
+			Flags:  flags,
+		})
+	}
+	add(vhdformat.VhdxFileParametersGUID, vhdformat.VhdxMetadataIsRequired, vhdformat.VhdxFileParameters{BlockSize: vhdxBlockSize})
+	add(vhdformat.VhdxVirtualDiskSizeGUID, virtual, uint64(size))
+	add(vhdformat.VhdxVirtualDiskIDGUID, virtual, uuid)
+	add(vhdformat.VhdxLogicalSectorSizeGUID, virtual, uint32(vhdxLogicalSectorSize))
+	add(vhdformat.VhdxPhysSectorSizeGUID, virtual, uint32(vhdxPhysicalSectorSize))
+
+	header := vhdformat.VhdxMetadataTableHeader{EntryCount: uint16(len(entries))}
+	copy(header.Signature[:], vhdformat.VhdxMetadataSignature)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, header)
+	binary.Write(buf, binary.LittleEndian, entries)
+	b := make([]byte, vhdxMetadataLength)
+	copy(b, buf.Bytes())
+	copy(b[vhdxMetadataItemsOffset:], items.Bytes())
+	return b
+}
+
+// writeVHDX writes the first size bytes of r to w as a dynamic VHDX. Blocks
+// that contain only zeros are not allocated.
+func writeVHDX(w io.Writer, r io.ReaderAt, size int64, uuid [16]byte) error {
+	used, err := usedBlocks(r, size, vhdxBlockSize)
+	if err != nil {
+		return err
+	}
+
+	// A sector bitmap entry follows every chunk of payload block entries.
+	blocks := int64(len(used))
+	batEntries := blocks
+	if blocks > 0 {
+		batEntries += (blocks - 1) / vhdxChunkRatio
+	}
+	batLength := roundUp(batEntries*8, vhdformat.VhdxAlignment)
+	bat := make([]uint64, batLength/8)
+	offset := uint64(vhdxBatOffset + batLength)
+	for i, u := range used {
+		if u {
+			bat[i+i/vhdxChunkRatio] = offset | vhdformat.VhdxPayloadFullyPresent
+			offset += vhdxBlockSize
+		}
+	}
+
+	id := vhdformat.VhdxFileIdentifier{}
+	copy(id.Signature[:], vhdformat.VhdxFileSignature)
+	copy(id.Creator[:], utf16.Encode([]rune(vhdxCreator)))
+
+	// The file is never opened for writing, so the write GUIDs only need to
+	// be unique to this image.
+	fileSum := sha256.Sum256(append(uuid[:], "file"...))
+	dataSum := sha256.Sum256(append(uuid[:], "data"...))
+	header := vhdformat.VhdxHeader{
+		Signature:     vhdformat.VhdxHeaderSignature,
+		FileWriteGUID: compactext4.UUIDFromHash(fileSum[:]),
+		DataWriteGUID: compactext4.UUIDFromHash(dataSum[:]),
+		Version:       vhdformat.VhdxVersion,
+		LogLength:     vhdxLogLength,
+		LogOffset:     vhdxLogOffset,
+	}
+	header1 := header
+	header2 := header
+	header2.SequenceNumber = 1
+
+	regionTable := vhdxRegionTable{
+		Header: vhdformat.VhdxRegionTableHeader{Signature: vhdformat.VhdxRegionSignature, EntryCount: 2},
+		Entries: [2]vhdformat.VhdxRegionTableEntry{
+			{GUID: vhdformat.VhdxBatRegionGUID, FileOffset: vhdxBatOffset, Length: uint32(batLength), Required: vhdformat.VhdxRegionRequired},
+			{GUID: vhdformat.VhdxMetadataRegionGUID, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataLength, Required: vhdformat.VhdxRegionRequired},
+		},
+	}
+
+	var batBytes bytes.Buffer
+	binary.Write(&batBytes, binary.LittleEndian, bat)
+	for _, b := range [][]byte{
+		vhdxStructure(id, vhdformat.VhdxStructureSize, 0),
+		vhdxStructure(header1, vhdformat.VhdxStructureSize, vhdformat.VhdxHeaderSize),
+		vhdxStructure(header2, vhdformat.VhdxStructureSize, vhdformat.VhdxHeaderSize),
+		vhdxStructure(regionTable, vhdformat.VhdxStructureSize, vhdformat.VhdxStructureSize),
+		vhdxStructure(regionTable, vhdformat.VhdxStructureSize, vhdformat.VhdxStructureSize),
+		make([]byte, vhdxLogOffset-5*vhdformat.VhdxStructureSize),
+		make([]byte, vhdxLogLength),
+		makeVHDXMetadata(roundUp(size, vhdxLogicalSectorSize), uuid),
+		batBytes.Bytes(),
+	} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, vhdxBlockSize)
+	for i, u := range used {
+		if !u {
+			continue
+		}
+		b, err := readBlock(r, buf, int64(i)*vhdxBlockSize, size)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+// Package vhd reads VHD and VHDX virtual disk files.
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/vhdformat"
+)
+
+// Format is the file format of a virtual disk.
+type Format int
+
+// Virtual disk file formats.
+const (
+	FormatVHD Format = iota + 1
+	FormatVHDX
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatVHD:
+		return "VHD"
+	case FormatVHDX:
+		return "VHDX"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Type is the type of a virtual disk.
+type Type int
+
+// Virtual disk types. The values match the VHD disk type field.
+const (
+	Fixed        Type = 2
+	Dynamic      Type = 3
+	Differencing Type = 4
+)
+
+func (t Type) String() string {
+	switch t {
+	case Fixed:
+		return "fixed"
+	case Dynamic:
+		return "dynamic"
+	case Differencing:
+		return "differencing"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Geometry is the CHS geometry of a VHD.
+type Geometry struct {
+	Cylinders       uint16
+	Heads           uint8
+	SectorsPerTrack uint8
+}
+
+// Disk is a virtual disk. Its ReadAt method reads the contents of the virtual
+// disk.
+type Disk struct {
+	Format             Format
+	Type               Type
+	Size               int64    // virtual disk size in bytes
+	UUID               [16]byte // VHD unique ID or VHDX virtual disk ID, as stored
+	Creator            string   // creator application (VHD) or creator (VHDX)
+	Geometry           Geometry // VHD only
+	BlockSize          uint32   // dynamic and differencing disks only
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+
+	r       io.ReaderAt
+	blocks  []int64 // file offsets of the blocks of dynamic and differencing disks
+	bitmaps []int64 // file offsets of the sector bitmaps of the blocks of dynamic VHDs
+}
+
+// blockZero marks a block that is not stored in the file and reads as zeros.
+const blockZero = -1
+
+// Open reads the headers of the VHD or VHDX file in the first size bytes of r
+// and returns the virtual disk that it contains.
+func Open(r io.ReaderAt, size int64) (*Disk, error) {
+	var sig [8]byte
+	if _, err := r.ReadAt(sig[:], 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(sig[:]) == vhdformat.VhdxFileSignature {
+		return openVHDX(r, size)
+	}
+	return openVHD(r, size)
+}
+
+// Allocated returns the number of bytes of the disk that are stored in the
+// file. For fixed disks this is the size of the disk.
+func (d *Disk) Allocated() int64 {
+	if d.blocks == nil {
+		return d.Size
+	}
+	var n int64
+	for _, b := range d.blocks {
+		if b >= 0 {
+			n += int64(d.BlockSize)
+		}
+	}
+	return n
+}
+
+// ReadAt implements io.ReaderAt for the contents of the virtual disk. Sectors of
+// a dynamic VHD that are not marked present in their block's sector bitmap read
+// as zeros. Differencing disks cannot be read because their parents are not
+// available.
+func (d *Disk) ReadAt(b []byte, off int64) (int, error) {
+	if d.Type == Differencing {
+		return 0, errors.New("reading differencing disks is not supported")
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= d.Size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(b)) > d.Size-off {
+		b = b[:d.Size-off]
+		err = io.EOF
+	}
+	if d.blocks == nil {
+		n, rerr := d.r.ReadAt(b, off)
+		if rerr != nil {
+			return n, rerr
+		}
+		return n, err
+	}
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		block := pos / int64(d.BlockSize)
+		blockOff := pos % int64(d.BlockSize)
+		c := int64(d.BlockSize) - blockOff
+		if c > int64(len(b)-n) {
+			c = int64(len(b) - n)
+		}
+		p := b[n : n+int(c)]
+		if fileOff := d.blocks[block]; fileOff == blockZero {
+			for i := range p {
+				p[i] = 0
+			}
+		} else if _, rerr := d.r.ReadAt(p, fileOff+blockOff); rerr != nil {
+			return n, rerr
+		} else if d.bitmaps != nil {
+			if rerr := d.zeroAbsentSectors(p, d.bitmaps[block], blockOff); rerr != nil {
+				return n, rerr
+			}
+		}
+		n += len(p)
+	}
+	return n, err
+}
+
+// zeroAbsentSectors zeros the parts of p, read from offset blockOff of a block,
+// that are in sectors not marked present in the block's sector bitmap at
+// bitmapOff.
+func (d *Disk) zeroAbsentSectors(p []byte, bitmapOff int64, blockOff int64) error {
+	first := blockOff / vhdformat.VhdSectorSize
+	last := (blockOff + int64(len(p)) - 1) / vhdformat.VhdSectorSize
+	bitmap := make([]byte, last/8-first/8+1)
+	if _, err := d.r.ReadAt(bitmap, bitmapOff+first/8); err != nil {
+		return err
+	}
+	for sector := first; sector <= last; sector++ {
+		// The bitmap starts with the most significant bit of each byte.
+		if bitmap[sector/8-first/8]&(0x80>>uint(sector%8)) != 0 {
+			continue
+		}
+		start := sector*vhdformat.VhdSectorSize - blockOff
+		end := start + vhdformat.VhdSectorSize
+		if start < 0 {
+			start = 0
+		}
+		if end > int64(len(p)) {
+			end = int64(len(p))
+		}
+		for i := start; i < end; i++ {
+			p[i] = 0
+		}
+	}
+	return nil
+}
+
+// readStruct reads the size bytes at off and decodes them into v, verifying
+// the VHD checksum stored at checksumOffset.
+func readStruct(r io.ReaderAt, off int64, size int, checksumOffset int, v interface{}) error {
+	b := make([]byte, size)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return err
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, v); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(b[checksumOffset:]) != vhdformat.Checksum(b, checksumOffset) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+func openVHD(r io.ReaderAt, size int64) (*Disk, error) {
+	if size < vhdformat.VhdFooterSize {
+		return nil, errors.New("not a VHD or VHDX file")
+	}
+	var footer vhdformat.Footer
+	if err := readStruct(r, size-vhdformat.VhdFooterSize, vhdformat.VhdFooterSize, vhdformat.FooterChecksumOffset, &footer); err != nil {
+		if string(footer.Cookie[:]) != vhdformat.VhdCookie {
+			return nil, errors.New("not a VHD or VHDX file")
+		}
+		return nil, fmt.Errorf("reading footer: %s", err)
+	}
+	if string(footer.Cookie[:]) != vhdformat.VhdCookie {
+		return nil, errors.New("not a VHD or VHDX file")
+	}
+	if footer.FileFormatVersion>>16 != vhdformat.VhdVersion>>16 {
+		return nil, fmt.Errorf("unsupported VHD version %#x", footer.FileFormatVersion)
+	}
+	d := &Disk{
+		Format:  FormatVHD,
+		Type:    Type(footer.DiskType),
+		Size:    footer.CurrentSize,
+		UUID:    footer.UniqueID,
+		Creator: strings.TrimRight(string(footer.CreatorApplication[:]), "\x00"),
+		Geometry: Geometry{
+			Cylinders:       uint16(footer.DiskGeometry >> 16),
+			Heads:           uint8(footer.DiskGeometry >> 8),
+			SectorsPerTrack: uint8(footer.DiskGeometry),
+		},
+		LogicalSectorSize:  vhdformat.VhdSectorSize,
+		PhysicalSectorSize: vhdformat.VhdSectorSize,
+		r:                  r,
+	}
+	if d.Size < 0 {
+		return nil, fmt.Errorf("invalid disk size %d", d.Size)
+	}
+
+	switch d.Type {
+	case Fixed:
+		if d.Size > size-vhdformat.VhdFooterSize {
+			return nil, fmt.Errorf("file too short for disk size %d", d.Size)
+		}
+		return d, nil
+	case Dynamic, Differencing:
+	default:
+		return nil, fmt.Errorf("unknown disk type %d", footer.DiskType)
+	}
+
+	var header vhdformat.DynamicHeader
+	if err := readStruct(r, footer.DataOffset, vhdformat.DynamicHeaderSize, vhdformat.DynamicHeaderChecksumOffset, &header); err != nil {
+		return nil, fmt.Errorf("reading dynamic disk header: %s", err)
+	}
+	if string(header.Cookie[:]) != vhdformat.DynamicHeaderCookie {
+		return nil, errors.New("invalid dynamic disk header")
+	}
+	if header.HeaderVersion>>16 != vhdformat.DynamicHeaderVersion>>16 {
+		return nil, fmt.Errorf("unsupported dynamic disk header version %#x", header.HeaderVersion)
+	}
+	if header.BlockSize < vhdformat.VhdSectorSize || header.BlockSize&(header.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d", header.BlockSize)
+	}
+	d.BlockSize = header.BlockSize
+	blocks := (d.Size + int64(d.BlockSize) - 1) / int64(d.BlockSize)
+	if int64(header.MaxTableEntries) < blocks {
+		return nil, fmt.Errorf("block table has %d entries for %d blocks", header.MaxTableEntries, blocks)
+	}
+	// Check that the file holds the whole table before allocating memory for
+	// it, since the table size comes from the untrusted header.
+	if header.TableOffset < 0 || header.TableOffset > size || blocks*4 > size-header.TableOffset {
+		return nil, fmt.Errorf("block table of %d entries at %d is outside the file", blocks, header.TableOffset)
+	}
+
+	bat := make([]uint32, blocks)
+	if err := binary.Read(io.NewSectionReader(r, header.TableOffset, blocks*4), binary.BigEndian, bat); err != nil {
+		return nil, fmt.Errorf("reading block table: %s", err)
+	}
+	// Each block starts with a bitmap of the sectors present in the block.
+	bitmapSize := vhdformat.SectorBitmapSize(d.BlockSize)
+	d.blocks = make([]int64, blocks)
+	d.bitmaps = make([]int64, blocks)
+	for i, sector := range bat {
+		if sector == vhdformat.BatEntryUnused {
+			d.blocks[i] = blockZero
+		} else {
+			d.bitmaps[i] = int64(sector) * vhdformat.VhdSectorSize
+			d.blocks[i] = d.bitmaps[i] + bitmapSize
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,174 @@
+package vhd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/vhdformat"
+	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
+)
+
+func makeImage(t *testing.T, options ...tar2ext4.Option) []byte {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	data := bytes.Repeat([]byte("data"), 1024*1024)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "vhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	options = append(options, tar2ext4.Deterministic, tar2ext4.MaximumDiskSize(32*1024*1024), tar2ext4.ExpandDisk)
+	if err := tar2ext4.Convert(&layer, f, options...); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestOpen(t *testing.T) {
+	raw := makeImage(t)
+	tests := []struct {
+		name   string
+		option tar2ext4.Option
+		format Format
+		typ    Type
+	}{
+		{"fixed", tar2ext4.AppendVhdFooter, FormatVHD, Fixed},
+		{"dynamic", tar2ext4.DynamicVhd, FormatVHD, Dynamic},
+		{"vhdx", tar2ext4.Vhdx, FormatVHDX, Dynamic},
+	}
+	for _, test := range tests {
+		b := makeImage(t, test.option)
+		d, err := Open(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if d.Format != test.format || d.Type != test.typ {
+			t.Errorf("%s: got %s %s disk", test.name, d.Type, d.Format)
+		}
+		if d.Size < int64(len(raw)) {
+			t.Errorf("%s: disk size %d smaller than image size %d", test.name, d.Size, len(raw))
+		}
+		if d.Type == Dynamic && d.Allocated() >= d.Size {
+			t.Errorf("%s: %d of %d bytes allocated", test.name, d.Allocated(), d.Size)
+		}
+		contents, err := ioutil.ReadAll(io.NewSectionReader(d, 0, d.Size))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(contents[:len(raw)], raw) {
+			t.Errorf("%s: contents do not match the image", test.name)
+		}
+		if !bytes.Equal(contents[len(raw):], make([]byte, len(contents)-len(raw))) {
+			t.Errorf("%s: disk is not zero past the end of the image", test.name)
+		}
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		option  tar2ext4.Option
+		corrupt func(b []byte)
+	}{
+		{"vhd footer", tar2ext4.AppendVhdFooter, func(b []byte) { b[len(b)-vhdformat.VhdFooterSize+40]++ }},
+		{"vhd dynamic header", tar2ext4.DynamicVhd, func(b []byte) { b[vhdformat.VhdFooterSize+30]++ }},
+		{"vhdx headers", tar2ext4.Vhdx, func(b []byte) {
+			b[vhdformat.VhdxStructureSize+8]++
+			b[2*vhdformat.VhdxStructureSize+8]++
+		}},
+		{"vhdx region tables", tar2ext4.Vhdx, func(b []byte) {
+			b[3*vhdformat.VhdxStructureSize+8]++
+			b[4*vhdformat.VhdxStructureSize+8]++
+		}},
+		{"raw", nil, func(b []byte) {}},
+	}
+	for _, test := range tests {
+		var b []byte
+		if test.option != nil {
+			b = makeImage(t, test.option)
+		} else {
+			b = makeImage(t)
+		}
+		test.corrupt(b)
+		if _, err := Open(bytes.NewReader(b), int64(len(b))); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+}
+
+// setDynamicHeader modifies the dynamic header of the dynamic VHD b with f and
+// updates its checksum.
+func setDynamicHeader(t *testing.T, b []byte, f func(h *vhdformat.DynamicHeader)) {
+	hb := b[vhdformat.VhdFooterSize : vhdformat.VhdFooterSize+vhdformat.DynamicHeaderSize]
+	var h vhdformat.DynamicHeader
+	if err := binary.Read(bytes.NewReader(hb), binary.BigEndian, &h); err != nil {
+		t.Fatal(err)
+	}
+	f(&h)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &h)
+	copy(hb, buf.Bytes())
+	binary.BigEndian.PutUint32(hb[vhdformat.DynamicHeaderChecksumOffset:], vhdformat.Checksum(hb, vhdformat.DynamicHeaderChecksumOffset))
+}
+
+func TestOpenBlockTableOutOfRange(t *testing.T) {
+	b := makeImage(t, tar2ext4.DynamicVhd)
+	setDynamicHeader(t, b, func(h *vhdformat.DynamicHeader) {
+		h.TableOffset = int64(len(b)) - 4
+	})
+	if _, err := Open(bytes.NewReader(b), int64(len(b))); err == nil {
+		t.Fatal("expected error for a block table past the end of the file")
+	}
+}
+
+func TestReadSectorBitmap(t *testing.T) {
+	b := makeImage(t, tar2ext4.DynamicVhd)
+	d, err := Open(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mark the sector that holds the start of the superblock, at offset 1024
+	// of the first block, absent.
+	const sb = 1024
+	if d.blocks[0] == blockZero {
+		t.Fatal("first block is not allocated")
+	}
+	buf := make([]byte, 3*vhdformat.VhdSectorSize)
+	if _, err := d.ReadAt(buf, sb-vhdformat.VhdSectorSize); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte(nil), buf...)
+	if bytes.Equal(want[vhdformat.VhdSectorSize:2*vhdformat.VhdSectorSize], make([]byte, vhdformat.VhdSectorSize)) {
+		t.Fatal("expected the superblock sector to hold data")
+	}
+	b[d.bitmaps[0]] &^= 0x80 >> (sb / vhdformat.VhdSectorSize)
+	if _, err := d.ReadAt(buf, sb-vhdformat.VhdSectorSize); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[vhdformat.VhdSectorSize:], make([]byte, vhdformat.VhdSectorSize))
+	if !bytes.Equal(buf, want) {
+		t.Fatal("expected only the absent sector to read as zeros")
+	}
+}
@@ -0,0 +1,233 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	"github.com/Microsoft/hcsshim/ext4/internal/vhdformat"
+)
+
+// readVHDXStructure reads the size bytes at off, verifies their CRC32C, which
+// is stored after the four-byte signature, and decodes them into v.
+func readVHDXStructure(r io.ReaderAt, off int64, size int, v interface{}) error {
+	b := make([]byte, size)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return err
+	}
+	csum := binary.LittleEndian.Uint32(b[4:])
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	if vhdformat.VhdxChecksum(b) != csum {
+		return errors.New("checksum mismatch")
+	}
+	return binary.Read(bytes.NewReader(b), binary.LittleEndian, v)
+}
+
+// readVHDXHeader returns the current header, which is the valid header with
+// the larger sequence number.
+func readVHDXHeader(r io.ReaderAt) (*vhdformat.VhdxHeader, error) {
+	var current *vhdformat.VhdxHeader
+	for i := 1; i <= 2; i++ {
+		var h vhdformat.VhdxHeader
+		err := readVHDXStructure(r, int64(i)*vhdformat.VhdxStructureSize, vhdformat.VhdxHeaderSize, &h)
+		if err != nil || h.Signature != vhdformat.VhdxHeaderSignature {
+			continue
+		}
+		if current == nil || h.SequenceNumber > current.SequenceNumber {
+			current = &h
+		}
+	}
+	if current == nil {
+		return nil, errors.New("no valid VHDX header")
+	}
+	if current.Version != vhdformat.VhdxVersion {
+		return nil, fmt.Errorf("unsupported VHDX version %d", current.Version)
+	}
+	if current.LogGUID != [16]byte{} {
+		return nil, errors.New("VHDX log replay is not supported")
+	}
+	return current, nil
+}
+
+// readVHDXRegions returns the entries of the first valid region table.
+func readVHDXRegions(r io.ReaderAt) ([]vhdformat.VhdxRegionTableEntry, error) {
+	var err error
+	for i := 3; i <= 4; i++ {
+		var hdr vhdformat.VhdxRegionTableHeader
+		off := int64(i) * vhdformat.VhdxStructureSize
+		err = readVHDXStructure(r, off, vhdformat.VhdxStructureSize, &hdr)
+		if err != nil {
+			continue
+		}
+		if hdr.Signature != vhdformat.VhdxRegionSignature || hdr.EntryCount > vhdformat.VhdxMaxRegionEntries {
+			err = errors.New("invalid region table")
+			continue
+		}
+		entries := make([]vhdformat.VhdxRegionTableEntry, hdr.EntryCount)
+		sr := io.NewSectionReader(r, off+int64(binary.Size(hdr)), vhdformat.VhdxStructureSize)
+		if err = binary.Read(sr, binary.LittleEndian, entries); err != nil {
+			continue
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("reading region table: %s", err)
+}
+
+// readVHDXMetadata reads the metadata table in the metadata region at off,
+// returning the items by ID.
+func readVHDXMetadata(r io.ReaderAt, off int64, length uint32) (map[[16]byte][]byte, error) {
+	sr := io.NewSectionReader(r, off, int64(length))
+	var hdr vhdformat.VhdxMetadataTableHeader
+	if err := binary.Read(sr, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Signature[:]) != vhdformat.VhdxMetadataSignature || hdr.EntryCount > vhdformat.VhdxMaxMetadataEntries {
+		return nil, errors.New("invalid metadata table")
+	}
+	entries := make([]vhdformat.VhdxMetadataTableEntry, hdr.EntryCount)
+	if err := binary.Read(sr, binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+	items := make(map[[16]byte][]byte)
+	for _, e := range entries {
+		switch e.ItemID {
+		case vhdformat.VhdxFileParametersGUID, vhdformat.VhdxVirtualDiskSizeGUID, vhdformat.VhdxVirtualDiskIDGUID,
+			vhdformat.VhdxLogicalSectorSizeGUID, vhdformat.VhdxPhysSectorSizeGUID, vhdformat.VhdxParentLocatorGUID:
+		default:
+			if e.Flags&vhdformat.VhdxMetadataIsRequired != 0 {
+				return nil, fmt.Errorf("unknown required metadata item %x", e.ItemID)
+			}
+			continue
+		}
+		if int64(e.Offset)+int64(e.Length) > int64(length) {
+			return nil, fmt.Errorf("metadata item %x out of range", e.ItemID)
+		}
+		b := make([]byte, e.Length)
+		if _, err := r.ReadAt(b, off+int64(e.Offset)); err != nil {
+			return nil, err
+		}
+		items[e.ItemID] = b
+	}
+	return items, nil
+}
+
+func openVHDX(r io.ReaderAt, size int64) (*Disk, error) {
+	var id vhdformat.VhdxFileIdentifier
+	if err := binary.Read(io.NewSectionReader(r, 0, size), binary.LittleEndian, &id); err != nil {
+		return nil, fmt.Errorf("reading file identifier: %s", err)
+	}
+	if _, err := readVHDXHeader(r); err != nil {
+		return nil, err
+	}
+	regions, err := readVHDXRegions(r)
+	if err != nil {
+		return nil, err
+	}
+	var bat, metadata *vhdformat.VhdxRegionTableEntry
+	for i := range regions {
+		switch e := &regions[i]; e.GUID {
+		case vhdformat.VhdxBatRegionGUID:
+			bat = e
+		case vhdformat.VhdxMetadataRegionGUID:
+			metadata = e
+		default:
+			if e.Required&vhdformat.VhdxRegionRequired != 0 {
+				return nil, fmt.Errorf("unknown required region %x", e.GUID)
+			}
+		}
+	}
+	if bat == nil || metadata == nil {
+		return nil, errors.New("missing BAT or metadata region")
+	}
+
+	items, err := readVHDXMetadata(r, int64(metadata.FileOffset), metadata.Length)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %s", err)
+	}
+	for _, item := range []struct {
+		guid [16]byte
+		size int
+	}{
+		{vhdformat.VhdxFileParametersGUID, 8},
+		{vhdformat.VhdxVirtualDiskSizeGUID, 8},
+		{vhdformat.VhdxVirtualDiskIDGUID, 16},
+		{vhdformat.VhdxLogicalSectorSizeGUID, 4},
+		{vhdformat.VhdxPhysSectorSizeGUID, 4},
+	} {
+		if len(items[item.guid]) < item.size {
+			return nil, fmt.Errorf("missing metadata item %x", item.guid)
+		}
+	}
+
+	creator := make([]uint16, len(id.Creator))
+	copy(creator, id.Creator[:])
+	for len(creator) > 0 && creator[len(creator)-1] == 0 {
+		creator = creator[:len(creator)-1]
+	}
+	d := &Disk{
+		Format:             FormatVHDX,
+		Type:               Dynamic,
+		Size:               int64(binary.LittleEndian.Uint64(items[vhdformat.VhdxVirtualDiskSizeGUID])),
+		Creator:            string(utf16.Decode(creator)),
+		BlockSize:          binary.LittleEndian.Uint32(items[vhdformat.VhdxFileParametersGUID]),
+		LogicalSectorSize:  binary.LittleEndian.Uint32(items[vhdformat.VhdxLogicalSectorSizeGUID]),
+		PhysicalSectorSize: binary.LittleEndian.Uint32(items[vhdformat.VhdxPhysSectorSizeGUID]),
+		r:                  r,
+	}
+	copy(d.UUID[:], items[vhdformat.VhdxVirtualDiskIDGUID])
+	if binary.LittleEndian.Uint32(items[vhdformat.VhdxFileParametersGUID][4:])&vhdformat.VhdxFileHasParent != 0 {
+		d.Type = Differencing
+	}
+	if d.BlockSize < 1024*1024 || d.BlockSize > 256*1024*1024 || d.BlockSize&(d.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d", d.BlockSize)
+	}
+	if d.LogicalSectorSize != 512 && d.LogicalSectorSize != 4096 {
+		return nil, fmt.Errorf("invalid logical sector size %d", d.LogicalSectorSize)
+	}
+	if d.Size < 0 || d.Size > vhdformat.VhdxMaxSize {
+		return nil, fmt.Errorf("invalid disk size %d", d.Size)
+	}
+
+	// A sector bitmap entry follows every chunk of payload block entries.
+	chunkRatio := vhdformat.VhdxChunkRatio(d.LogicalSectorSize, d.BlockSize)
+	blocks := (d.Size + int64(d.BlockSize) - 1) / int64(d.BlockSize)
+	entries := blocks
+	if blocks > 0 {
+		entries += (blocks - 1) / chunkRatio
+	}
+	if entries*8 > int64(bat.Length) {
+		return nil, fmt.Errorf("BAT region too small for %d blocks", blocks)
+	}
+	// Check that the file holds the whole BAT before allocating memory for
+	// it, since its size comes from the untrusted metadata.
+	if int64(bat.FileOffset) < 0 || int64(bat.FileOffset) > size || entries*8 > size-int64(bat.FileOffset) {
+		return nil, fmt.Errorf("BAT of %d entries at %d is outside the file", entries, bat.FileOffset)
+	}
+	batEntries := make([]uint64, entries)
+	if err := binary.Read(io.NewSectionReader(r, int64(bat.FileOffset), entries*8), binary.LittleEndian, batEntries); err != nil {
+		return nil, fmt.Errorf("reading BAT: %s", err)
+	}
+	d.blocks = make([]int64, blocks)
+	for i := range d.blocks {
+		entry := batEntries[int64(i)+int64(i)/chunkRatio]
+		switch state := entry & 7; state {
+		case vhdformat.VhdxPayloadNotPresent, vhdformat.VhdxPayloadUndefined, vhdformat.VhdxPayloadZero, vhdformat.VhdxPayloadUnmapped:
+			d.blocks[i] = blockZero
+		case vhdformat.VhdxPayloadFullyPresent:
+			d.blocks[i] = int64(entry >> 20 << 20)
+		case vhdformat.VhdxPayloadPartial:
+			// Only differencing disks, which cannot be read, have partially
+			// present blocks, whose other sectors come from the parent.
+			if d.Type != Differencing {
+				return nil, fmt.Errorf("invalid state %d for block %d of a disk without a parent", state, i)
+			}
+			d.blocks[i] = int64(entry >> 20 << 20)
+		default:
+			return nil, fmt.Errorf("invalid state %d for block %d", state, i)
+		}
+	}
+	return d, nil
+}
@@ -340,23 +340,28 @@ func (namespace *HostComputeNamespace) Sync() error {
 	}
 
 	// Look in the registry for the key to map from namespace id to pod-id
-	cfg, err := icni.LoadPersistedNamespaceConfig(namespace.Id)
+	sk, err := icni.OpenStateStore()
+	if err != nil {
+		return err
+	}
+	defer sk.Close()
+	cfg, err := icni.LoadPersistedNamespaceConfig(sk, namespace.Id)
 	if err != nil {
 		if regstate.IsNotFoundError(err) {
 			return nil
 		}
 		return err
 	}
-	req := runhcs.VMRequest{
-		ID: cfg.ContainerID,
-		Op: runhcs.OpSyncNamespace,
+	req, err := runhcs.NewVMRequest(cfg.ContainerID, runhcs.OpSyncNamespace, &runhcs.SyncNamespaceRequest{NamespaceID: namespace.Id})
+	if err != nil {
+		return err
 	}
 	shimPath := runhcs.VMPipePath(cfg.HostUniqueID)
-	if err := runhcs.IssueVMRequest(shimPath, &req); err != nil {
+	if err := runhcs.IssueVMRequest(shimPath, req); err != nil {
 		// The shim is likey gone. Simply ignore the sync as if it didn't exist.
 		if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ERROR_FILE_NOT_FOUND {
 			// Remove the reg key there is no point to try again
-			cfg.Remove()
+			cfg.Remove(sk)
 			return nil
 		}
 		f := map[string]interface{}{
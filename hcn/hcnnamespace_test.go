@@ -386,10 +386,15 @@ func TestSyncNamespaceGuest(t *testing.T) {
 	}
 
 	// Create registry state
+	sk, err := cni.OpenStateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sk.Close()
 	pnc := cni.NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err = pnc.Store()
+	err = pnc.Store(sk)
 	if err != nil {
-		pnc.Remove()
+		pnc.Remove(sk)
 		t.Fatal(err)
 	}
 
@@ -400,7 +405,7 @@ func TestSyncNamespaceGuest(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = pnc.Remove()
+	err = pnc.Remove(sk)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -426,10 +431,15 @@ func TestSyncNamespaceGuestDefault(t *testing.T) {
 	}
 
 	// Create registry state
+	sk, err := cni.OpenStateStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sk.Close()
 	pnc := cni.NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err = pnc.Store()
+	err = pnc.Store(sk)
 	if err != nil {
-		pnc.Remove()
+		pnc.Remove(sk)
 		t.Fatal(err)
 	}
 
@@ -440,7 +450,7 @@ func TestSyncNamespaceGuestDefault(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = pnc.Remove()
+	err = pnc.Remove(sk)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -4,7 +4,7 @@ import (
 	"errors"
 
 	"github.com/Microsoft/hcsshim/internal/guid"
-	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/statestore"
 )
 
 const (
@@ -32,15 +32,9 @@ func NewPersistedNamespaceConfig(namespaceID, containerID string, containerHostU
 	}
 }
 
-// LoadPersistedNamespaceConfig loads a persisted config from the registry that matches
-// `namespaceID`. If not found returns `regstate.NotFoundError`
-func LoadPersistedNamespaceConfig(namespaceID string) (*PersistedNamespaceConfig, error) {
-	sk, err := regstate.Open(cniRoot, false)
-	if err != nil {
-		return nil, err
-	}
-	defer sk.Close()
-
+// LoadPersistedNamespaceConfig loads a persisted config from `sk` that matches
+// `namespaceID`. If not found returns `statestore.NotFoundError`
+func LoadPersistedNamespaceConfig(sk statestore.StateStore, namespaceID string) (*PersistedNamespaceConfig, error) {
 	pnc := PersistedNamespaceConfig{
 		namespaceID: namespaceID,
 		stored:      true,
@@ -51,9 +45,9 @@ func LoadPersistedNamespaceConfig(namespaceID string) (*PersistedNamespaceConfig
 	return &pnc, nil
 }
 
-// Store stores or updates the in-memory config to its registry state. If the
+// Store stores or updates the in-memory config to its state in `sk`. If the
 // store failes returns the store error.
-func (pnc *PersistedNamespaceConfig) Store() error {
+func (pnc *PersistedNamespaceConfig) Store(sk statestore.StateStore) error {
 	if pnc.namespaceID == "" {
 		return errors.New("invalid namespaceID ''")
 	}
@@ -64,12 +58,6 @@ func (pnc *PersistedNamespaceConfig) Store() error {
 	if pnc.HostUniqueID == empty {
 		return errors.New("invalid containerHostUniqueID 'empy'")
 	}
-	sk, err := regstate.Open(cniRoot, false)
-	if err != nil {
-		return err
-	}
-	defer sk.Close()
-
 	if pnc.stored {
 		if err := sk.Set(pnc.namespaceID, cniKey, pnc); err != nil {
 			return err
@@ -83,22 +71,12 @@ func (pnc *PersistedNamespaceConfig) Store() error {
 	return nil
 }
 
-// Remove removes any persisted state associated with this config. If the config
-// is not found in the registery `Remove` returns no error.
-func (pnc *PersistedNamespaceConfig) Remove() error {
+// Remove removes any persisted state associated with this config from `sk`. If
+// the config is not found `Remove` returns no error.
+func (pnc *PersistedNamespaceConfig) Remove(sk statestore.StateStore) error {
 	if pnc.stored {
-		sk, err := regstate.Open(cniRoot, false)
-		if err != nil {
-			if regstate.IsNotFoundError(err) {
-				pnc.stored = false
-				return nil
-			}
-			return err
-		}
-		defer sk.Close()
-
 		if err := sk.Remove(pnc.namespaceID); err != nil {
-			if regstate.IsNotFoundError(err) {
+			if statestore.IsNotFoundError(err) {
 				pnc.stored = false
 				return nil
 			}
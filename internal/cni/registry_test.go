@@ -1,36 +1,60 @@
 package cni
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/Microsoft/hcsshim/internal/guid"
-	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/statestore"
 )
 
+func openTestStore(t *testing.T) (statestore.StateStore, func()) {
+	root, err := ioutil.TempDir("", "cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, err := statestore.OpenDir(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return sk, func() {
+		sk.Close()
+		os.RemoveAll(root)
+	}
+}
+
 func Test_LoadPersistedNamespaceConfig_NoConfig(t *testing.T) {
-	pnc, err := LoadPersistedNamespaceConfig(t.Name())
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
+	pnc, err := LoadPersistedNamespaceConfig(sk, t.Name())
 	if pnc != nil {
 		t.Fatal("config should be nil")
 	}
 	if err == nil {
 		t.Fatal("err should be set")
 	} else {
-		if !regstate.IsNotFoundError(err) {
+		if !statestore.IsNotFoundError(err) {
 			t.Fatal("err should be NotFoundError")
 		}
 	}
 }
 
 func Test_LoadPersistedNamespaceConfig_WithConfig(t *testing.T) {
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
 	pnc := NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err := pnc.Store()
+	err := pnc.Store(sk)
 	if err != nil {
-		pnc.Remove()
+		pnc.Remove(sk)
 		t.Fatalf("store failed with: %v", err)
 	}
-	defer pnc.Remove()
+	defer pnc.Remove(sk)
 
-	pnc2, err := LoadPersistedNamespaceConfig(t.Name())
+	pnc2, err := LoadPersistedNamespaceConfig(sk, t.Name())
 	if err != nil {
 		t.Fatal("should have no error on stored config")
 	}
@@ -53,34 +77,40 @@ func Test_LoadPersistedNamespaceConfig_WithConfig(t *testing.T) {
 }
 
 func Test_PersistedNamespaceConfig_StoreNew(t *testing.T) {
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
 	pnc := NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err := pnc.Store()
+	err := pnc.Store(sk)
 	if err != nil {
-		pnc.Remove()
+		pnc.Remove(sk)
 		t.Fatalf("store failed with: %v", err)
 	}
-	defer pnc.Remove()
+	defer pnc.Remove(sk)
 }
 
 func Test_PersistedNamespaceConfig_StoreUpdate(t *testing.T) {
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
 	pnc := NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err := pnc.Store()
+	err := pnc.Store(sk)
 	if err != nil {
-		pnc.Remove()
+		pnc.Remove(sk)
 		t.Fatalf("store failed with: %v", err)
 	}
-	defer pnc.Remove()
+	defer pnc.Remove(sk)
 
 	pnc.ContainerID = "test-container2"
 	pnc.HostUniqueID = guid.New()
-	err = pnc.Store()
+	err = pnc.Store(sk)
 	if err != nil {
-		pnc.Remove()
+		pnc.Remove(sk)
 		t.Fatalf("store update failed with: %v", err)
 	}
 
 	// Verify the update
-	pnc2, err := LoadPersistedNamespaceConfig(t.Name())
+	pnc2, err := LoadPersistedNamespaceConfig(sk, t.Name())
 	if err != nil {
 		t.Fatal("stored config should have been returned")
 	}
@@ -93,44 +123,53 @@ func Test_PersistedNamespaceConfig_StoreUpdate(t *testing.T) {
 }
 
 func Test_PersistedNamespaceConfig_RemoveNotStored(t *testing.T) {
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
 	pnc := NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err := pnc.Remove()
+	err := pnc.Remove(sk)
 	if err != nil {
 		t.Fatalf("remove on not stored should not fail: %v", err)
 	}
 }
 
 func Test_PersistedNamespaceConfig_RemoveStoredKey(t *testing.T) {
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
 	pnc := NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err := pnc.Store()
+	err := pnc.Store(sk)
 	if err != nil {
 		t.Fatalf("store failed with: %v", err)
 	}
-	err = pnc.Remove()
+	err = pnc.Remove(sk)
 	if err != nil {
 		t.Fatalf("remove on stored key should not fail: %v", err)
 	}
 }
 
 func Test_PersistedNamespaceConfig_RemovedOtherKey(t *testing.T) {
+	sk, cleanup := openTestStore(t)
+	defer cleanup()
+
 	pnc := NewPersistedNamespaceConfig(t.Name(), "test-container", guid.New())
-	err := pnc.Store()
+	err := pnc.Store(sk)
 	if err != nil {
 		t.Fatalf("store failed with: %v", err)
 	}
 
-	pnc2, err := LoadPersistedNamespaceConfig(t.Name())
+	pnc2, err := LoadPersistedNamespaceConfig(sk, t.Name())
 	if err != nil {
 		t.Fatal("should of found stored config")
 	}
 
-	err = pnc.Remove()
+	err = pnc.Remove(sk)
 	if err != nil {
 		t.Fatalf("remove on stored key should not fail: %v", err)
 	}
 
 	// Now remove the other key that has the invalid memory state
-	err = pnc2.Remove()
+	err = pnc2.Remove(sk)
 	if err != nil {
 		t.Fatalf("remove on in-memory already removed should not fail: %v", err)
 	}
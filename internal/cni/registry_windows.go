@@ -0,0 +1,14 @@
+package cni
+
+import (
+	"github.com/Microsoft/hcsshim/internal/regstate"
+	"github.com/Microsoft/hcsshim/internal/statestore"
+)
+
+// OpenStateStore opens the registry key that holds the `NamespaceID` to UVM
+// map. The map is shared by every process on the host that syncs namespaces,
+// which look a namespace up without knowing the state root of the runtime that
+// created it.
+func OpenStateStore() (statestore.StateStore, error) {
+	return regstate.Open(cniRoot, false)
+}
@@ -0,0 +1,109 @@
+// Package ext4flags provides the command line flags shared by the commands that
+// write ext4 images with github.com/Microsoft/hcsshim/ext4/tar2ext4.
+package ext4flags
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
+)
+
+// Flags holds the values of the image flags registered on a flag set.
+type Flags struct {
+	vhd           *bool
+	format        *string
+	inlineData    *bool
+	deterministic *bool
+	csum          *bool
+	use64Bit      *bool
+	verity        *bool
+	size          *int64
+	expand        *bool
+	journal       *bool
+	blockSize     *int
+	inodeSize     *int
+
+	verityInfo tar2ext4.VerityInfo
+}
+
+// Register defines the image flags on fs.
+func Register(fs *flag.FlagSet) *Flags {
+	return &Flags{
+		vhd:           fs.Bool("vhd", false, "add a VHD footer to the end of the image; same as -format=vhd"),
+		format:        fs.String("format", "", "output format: vhd (fixed), vhd-dynamic or vhdx; the default is a raw ext4 image"),
+		inlineData:    fs.Bool("inline", false, "write small file data into the inode; not compatible with DAX"),
+		deterministic: fs.Bool("deterministic", false, "produce identical output for identical input by deriving UUIDs from the image contents"),
+		csum:          fs.Bool("csum", false, "enable metadata checksums (metadata_csum)"),
+		use64Bit:      fs.Bool("64bit", false, "enable the 64bit feature"),
+		verity:        fs.Bool("verity", false, "append a dm-verity hash tree to the file system and print its root hash"),
+		size:          fs.Int64("size", 0, "maximum disk size in bytes; the default is 16GB"),
+		expand:        fs.Bool("expand", false, "size the file system to -size, leaving free space so that it can be mounted read-write"),
+		journal:       fs.Bool("journal", false, "create a journal sized from the file system; use with -expand"),
+		blockSize:     fs.Int("block-size", 0, "file system block size: 1024, 2048 or 4096; the default is 4096"),
+		inodeSize:     fs.Int("inode-size", 0, "inode size: 128 or 256; the default is 256"),
+	}
+}
+
+// Options returns the tar2ext4 options selected by the flags.
+func (f *Flags) Options() ([]tar2ext4.Option, error) {
+	var opts []tar2ext4.Option
+	format := *f.format
+	if *f.vhd {
+		if format != "" && format != "vhd" {
+			return nil, fmt.Errorf("-vhd cannot be used with -format=%s", format)
+		}
+		format = "vhd"
+	}
+	switch format {
+	case "":
+	case "vhd":
+		opts = append(opts, tar2ext4.AppendVhdFooter)
+	case "vhd-dynamic":
+		opts = append(opts, tar2ext4.DynamicVhd)
+	case "vhdx":
+		opts = append(opts, tar2ext4.Vhdx)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if *f.inlineData {
+		opts = append(opts, tar2ext4.InlineData)
+	}
+	if *f.deterministic {
+		opts = append(opts, tar2ext4.Deterministic)
+	}
+	if *f.csum {
+		opts = append(opts, tar2ext4.MetadataChecksum)
+	}
+	if *f.use64Bit {
+		opts = append(opts, tar2ext4.Use64Bit)
+	}
+	if *f.verity {
+		opts = append(opts, tar2ext4.AppendVerity(nil, &f.verityInfo))
+	}
+	if *f.size != 0 {
+		opts = append(opts, tar2ext4.MaximumDiskSize(*f.size))
+	}
+	if *f.expand {
+		opts = append(opts, tar2ext4.ExpandDisk)
+	}
+	if *f.journal {
+		opts = append(opts, tar2ext4.Journal(0))
+	}
+	if *f.blockSize != 0 {
+		opts = append(opts, tar2ext4.BlockSize(*f.blockSize))
+	}
+	if *f.inodeSize != 0 {
+		opts = append(opts, tar2ext4.InodeSize(*f.inodeSize))
+	}
+	return opts, nil
+}
+
+// RootHash returns the dm-verity root hash of the image once it has been
+// written, or nil if -verity was not given.
+func (f *Flags) RootHash() []byte {
+	if !*f.verity {
+		return nil
+	}
+	return f.verityInfo.RootHash
+}
@@ -20,6 +20,7 @@ var (
 	hcsNotificationSystemStartCompleted  hcsNotification = 0x00000003
 	hcsNotificationSystemPauseCompleted  hcsNotification = 0x00000004
 	hcsNotificationSystemResumeCompleted hcsNotification = 0x00000005
+	hcsNotificationSystemSaveCompleted   hcsNotification = 0x00000008
 
 	// Notifications for HCS_PROCESS handles
 	hcsNotificationProcessExited hcsNotification = 0x00010000
@@ -47,6 +48,7 @@ func newChannels() notificationChannels {
 	channels[hcsNotificationSystemStartCompleted] = make(notificationChannel, 1)
 	channels[hcsNotificationSystemPauseCompleted] = make(notificationChannel, 1)
 	channels[hcsNotificationSystemResumeCompleted] = make(notificationChannel, 1)
+	channels[hcsNotificationSystemSaveCompleted] = make(notificationChannel, 1)
 	channels[hcsNotificationProcessExited] = make(notificationChannel, 1)
 	channels[hcsNotificationServiceDisconnect] = make(notificationChannel, 1)
 	return channels
@@ -57,6 +59,7 @@ func closeChannels(channels notificationChannels) {
 	close(channels[hcsNotificationSystemStartCompleted])
 	close(channels[hcsNotificationSystemPauseCompleted])
 	close(channels[hcsNotificationSystemResumeCompleted])
+	close(channels[hcsNotificationSystemSaveCompleted])
 	close(channels[hcsNotificationProcessExited])
 	close(channels[hcsNotificationServiceDisconnect])
 }
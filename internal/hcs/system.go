@@ -330,6 +330,12 @@ func (computeSystem *System) Properties(types ...schema1.PropertyType) (*schema1
 
 // Pause pauses the execution of the computeSystem. This feature is not enabled in TP5.
 func (computeSystem *System) Pause() error {
+	return computeSystem.PauseWithOptions(nil)
+}
+
+// PauseWithOptions pauses the execution of the computeSystem, passing options
+// such as a *hcsschema.PauseOptions to HCS. A nil options uses the defaults.
+func (computeSystem *System) PauseWithOptions(options interface{}) error {
 	computeSystem.handleLock.RLock()
 	defer computeSystem.handleLock.RUnlock()
 	title := "hcsshim::ComputeSystem::Pause ID=" + computeSystem.ID()
@@ -339,14 +345,23 @@ func (computeSystem *System) Pause() error {
 		return makeSystemError(computeSystem, "Pause", "", ErrAlreadyClosed, nil)
 	}
 
+	optionsString := ""
+	if options != nil {
+		optionsJSON, err := json.Marshal(options)
+		if err != nil {
+			return err
+		}
+		optionsString = string(optionsJSON)
+	}
+
 	var resultp *uint16
 	completed := false
 	go syscallWatcher(fmt.Sprintf("PauseComputeSystem %s:", computeSystem.ID()), &completed)
-	err := hcsPauseComputeSystem(computeSystem.handle, "", &resultp)
+	err := hcsPauseComputeSystem(computeSystem.handle, optionsString, &resultp)
 	completed = true
 	events, err := processAsyncHcsResult(err, resultp, computeSystem.callbackNumber, hcsNotificationSystemPauseCompleted, &timeout.SystemPause)
 	if err != nil {
-		return makeSystemError(computeSystem, "Pause", "", err, events)
+		return makeSystemError(computeSystem, "Pause", optionsString, err, events)
 	}
 
 	logrus.Debugf(title + " succeeded")
@@ -378,6 +393,38 @@ func (computeSystem *System) Resume() error {
 	return nil
 }
 
+// Save saves the state of the paused computeSystem as described by options,
+// normally a *hcsschema.SaveOptions.
+func (computeSystem *System) Save(options interface{}) error {
+	computeSystem.handleLock.RLock()
+	defer computeSystem.handleLock.RUnlock()
+	title := "hcsshim::ComputeSystem::Save ID=" + computeSystem.ID()
+	logrus.Debugf(title)
+
+	if computeSystem.handle == 0 {
+		return makeSystemError(computeSystem, "Save", "", ErrAlreadyClosed, nil)
+	}
+
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	optionsString := string(optionsJSON)
+
+	var resultp *uint16
+	completed := false
+	go syscallWatcher(fmt.Sprintf("SaveComputeSystem %s: %s", computeSystem.ID(), optionsString), &completed)
+	err = hcsSaveComputeSystem(computeSystem.handle, optionsString, &resultp)
+	completed = true
+	events, err := processAsyncHcsResult(err, resultp, computeSystem.callbackNumber, hcsNotificationSystemSaveCompleted, &timeout.SystemSave)
+	if err != nil {
+		return makeSystemError(computeSystem, "Save", optionsString, err, events)
+	}
+
+	logrus.Debugf(title + " succeeded")
+	return nil
+}
+
 // CreateProcess launches a new process within the computeSystem.
 func (computeSystem *System) CreateProcess(c interface{}) (*Process, error) {
 	computeSystem.handleLock.RLock()
@@ -120,7 +120,7 @@ func CreateContainer(createOptions *CreateOptions) (_ *hcs.System, _ *Resources,
 		}
 		coi.actualNetworkNamespace = resources.netNS
 		if coi.HostingSystem != nil {
-			endpoints, err := getNamespaceEndpoints(coi.actualNetworkNamespace)
+			endpoints, err := GetNamespaceEndpoints(coi.actualNetworkNamespace)
 			if err != nil {
 				return nil, resources, err
 			}
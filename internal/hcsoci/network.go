@@ -24,7 +24,9 @@ func createNetworkNamespace(coi *createOptionsInternal, resources *Resources) er
 	return nil
 }
 
-func getNamespaceEndpoints(netNS string) ([]*hns.HNSEndpoint, error) {
+// GetNamespaceEndpoints returns the endpoints of the HNS network namespace
+// netNS.
+func GetNamespaceEndpoints(netNS string) ([]*hns.HNSEndpoint, error) {
 	ids, err := hns.GetNamespaceEndpoints(netNS)
 	if err != nil {
 		return nil, err
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"time"
 
 	"github.com/Microsoft/go-winio/vhd"
+	"github.com/Microsoft/hcsshim/ext4/tar2ext4"
 	"github.com/Microsoft/hcsshim/internal/copyfile"
 	"github.com/Microsoft/hcsshim/internal/timeout"
 	"github.com/Microsoft/hcsshim/internal/uvm"
@@ -167,3 +169,49 @@ func CreateScratch(lcowUVM *uvm.UtilityVM, destFile string, sizeGB uint32, cache
 	logrus.Debugf("hcsshim::CreateLCOWScratch: %s created (non-cache)", destFile)
 	return nil
 }
+
+// CreateScratchOnHost creates an empty ext4 scratch disk of a requested size
+// directly on the host, without using a utility VM. The disk is a dynamic VHDX
+// or VHD, chosen by the extension of destFile, so only the blocks that hold file
+// system metadata are allocated in the file.
+func CreateScratchOnHost(destFile string, sizeGB uint32) (err error) {
+	var format tar2ext4.Option
+	switch ext := strings.ToLower(filepath.Ext(destFile)); ext {
+	case ".vhdx":
+		format = tar2ext4.Vhdx
+	case ".vhd":
+		format = tar2ext4.DynamicVhd
+	default:
+		return fmt.Errorf("unsupported scratch disk extension %q for %s: must be .vhdx or .vhd", ext, destFile)
+	}
+
+	// Keep the same minimum size as CreateScratch.
+	if sizeGB < DefaultScratchSizeGB {
+		sizeGB = DefaultScratchSizeGB
+	}
+
+	logrus.Debugf("hcsshim::CreateScratchOnHost: Dest:%s size:%dGB", destFile, sizeGB)
+
+	f, err := os.Create(destFile)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %s", destFile, err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(destFile)
+		}
+	}()
+
+	// An empty tar stream produces a file system containing only lost+found.
+	err = tar2ext4.Convert(bytes.NewReader(nil), f,
+		tar2ext4.MaximumDiskSize(int64(sizeGB)*1024*1024*1024),
+		tar2ext4.ExpandDisk,
+		format)
+	if err != nil {
+		return fmt.Errorf("failed to format %s: %s", destFile, err)
+	}
+
+	logrus.Debugf("hcsshim::CreateScratchOnHost: %s created", destFile)
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"syscall"
 
+	"github.com/Microsoft/hcsshim/internal/statestore"
 	"golang.org/x/sys/windows/registry"
 )
 
@@ -23,37 +24,27 @@ const (
 	_REG_OPENED_EXISTING_KEY = 2
 )
 
+// Key is a statestore.StateStore backed by volatile registry keys, so its
+// state does not survive a reboot.
 type Key struct {
 	registry.Key
 	Name string
 }
 
+var _ statestore.StateStore = &Key{}
+
 var localMachine = &Key{registry.LOCAL_MACHINE, "HKEY_LOCAL_MACHINE"}
 var localUser = &Key{registry.CURRENT_USER, "HKEY_CURRENT_USER"}
 
 var rootPath = `SOFTWARE\Microsoft\runhcs`
 
-type NotFoundError struct {
-	Id string
-}
-
-func (err *NotFoundError) Error() string {
-	return fmt.Sprintf("ID '%s' was not found", err.Id)
-}
+type NotFoundError = statestore.NotFoundError
 
 func IsNotFoundError(err error) bool {
-	_, ok := err.(*NotFoundError)
-	return ok
+	return statestore.IsNotFoundError(err)
 }
 
-type NoStateError struct {
-	ID  string
-	Key string
-}
-
-func (err *NoStateError) Error() string {
-	return fmt.Sprintf("state '%s' is not present for ID '%s'", err.Key, err.ID)
-}
+type NoStateError = statestore.NoStateError
 
 func createVolatileKey(k *Key, path string, access uint32) (newk *Key, openedExisting bool, err error) {
 	var (
@@ -150,7 +141,7 @@ func (k *Key) openid(id string) (*Key, error) {
 	fullpath := filepath.Join(k.Name, escaped)
 	nk, err := k.open(escaped)
 	if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ERROR_FILE_NOT_FOUND {
-		return nil, &NotFoundError{id}
+		return nil, &NotFoundError{Id: id}
 	}
 	if err != nil {
 		return nil, &os.PathError{Op: "RegOpenKey", Path: fullpath, Err: err}
@@ -163,7 +154,7 @@ func (k *Key) Remove(id string) error {
 	err := registry.DeleteKey(k.Key, escaped)
 	if err != nil {
 		if err == syscall.ERROR_FILE_NOT_FOUND {
-			return &NotFoundError{id}
+			return &NotFoundError{Id: id}
 		}
 		return &os.PathError{Op: "RegDeleteKey", Path: filepath.Join(k.Name, escaped), Err: err}
 	}
@@ -213,7 +204,7 @@ func (k *Key) set(id string, create bool, key string, state interface{}) error {
 	}
 	if err != nil {
 		if err == syscall.ERROR_FILE_NOT_FOUND {
-			return &NoStateError{id, key}
+			return &NoStateError{ID: id, Key: key}
 		}
 		return &os.PathError{Op: "RegSetValueEx", Path: sk.Name + ":" + key, Err: err}
 	}
@@ -237,7 +228,7 @@ func (k *Key) Clear(id, key string) error {
 	err = sk.DeleteValue(key)
 	if err != nil {
 		if err == syscall.ERROR_FILE_NOT_FOUND {
-			return &NoStateError{id, key}
+			return &NoStateError{ID: id, Key: key}
 		}
 		return &os.PathError{Op: "RegDeleteValue", Path: sk.Name + ":" + key, Err: err}
 	}
@@ -276,7 +267,7 @@ func (k *Key) Get(id, key string, state interface{}) error {
 	}
 	if err != nil {
 		if err == syscall.ERROR_FILE_NOT_FOUND {
-			return &NoStateError{id, key}
+			return &NoStateError{ID: id, Key: key}
 		}
 		return &os.PathError{Op: "RegQueryValueEx", Path: sk.Name + ":" + key, Err: err}
 	}
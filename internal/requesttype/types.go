@@ -6,5 +6,6 @@ package requesttype
 const (
 	Add    = "Add"
 	Remove = "Remove"
+	Update = "Update"
 	PreAdd = "PreAdd" // For networking
 )
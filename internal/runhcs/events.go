@@ -0,0 +1,32 @@
+package runhcs
+
+import (
+	"github.com/Microsoft/hcsshim/internal/schema1"
+)
+
+// Event types written by `runhcs events`.
+const (
+	// EventStats carries the container's resource usage statistics.
+	EventStats = "stats"
+	// EventPause is written when the container is paused.
+	EventPause = "pause"
+	// EventResume is written when a paused container is resumed.
+	EventResume = "resume"
+	// EventExit is written when the container exits. It is the last event.
+	EventExit = "exit"
+	// EventError is used by clients for an event that could not be decoded.
+	EventError = "error"
+)
+
+// Event is a container event. `runhcs events` writes one JSON encoded event
+// per line.
+type Event struct {
+	// Type is the type of the event, for example EventStats.
+	Type string `json:"type"`
+	// ID is the container ID.
+	ID string `json:"id"`
+	// Stats is set for EventStats events.
+	Stats *schema1.Statistics `json:"data,omitempty"`
+	// Err is set by clients for EventError events.
+	Err error `json:"-"`
+}
@@ -1,11 +1,25 @@
 package runhcs
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 
 	"github.com/Microsoft/go-winio"
 )
 
+// VMRequestVersion is the version of the VM shim request protocol implemented
+// by this package.
+//
+// Version 0 requests predate versioning. They carry no payload, and the shim
+// responds with ShimSuccess or the text of an error. From version 1, the shim
+// responds with a JSON encoded VMResponse. A shim responds to each request in
+// the format of the request's version, so shims and clients of either version
+// can be used together.
+const VMRequestVersion = 1
+
 // VMRequestOp is an operation that can be issued to a VM shim.
 type VMRequestOp string
 
@@ -13,6 +27,7 @@ const (
 	// OpCreateContainer is a create container request.
 	OpCreateContainer VMRequestOp = "create"
 	// OpSyncNamespace is a `cni.NamespaceTypeGuest` sync request with the UVM.
+	// Its payload is a SyncNamespaceRequest.
 	OpSyncNamespace VMRequestOp = "sync"
 	// OpUnmountContainer is a container unmount request.
 	OpUnmountContainer VMRequestOp = "unmount"
@@ -22,22 +37,140 @@ const (
 
 // VMRequest is an operation request that is issued to a VM shim.
 type VMRequest struct {
-	ID string
-	Op VMRequestOp
+	// Version is the protocol version of the request, or 0 if the client
+	// predates versioning.
+	Version int `json:",omitempty"`
+	ID      string
+	Op      VMRequestOp
+	// Data is the JSON encoded payload of the operation, if it has one.
+	Data json.RawMessage `json:",omitempty"`
+}
+
+// SyncNamespaceRequest is the payload of an OpSyncNamespace request.
+type SyncNamespaceRequest struct {
+	// NamespaceID is the ID of the HNS namespace to sync. If empty, the network
+	// namespace of the container is synced.
+	NamespaceID string `json:",omitempty"`
+}
+
+// NewVMRequest returns a request for op on container id. data is the payload
+// of the operation, or nil if it has none.
+func NewVMRequest(id string, op VMRequestOp, data interface{}) (*VMRequest, error) {
+	req := &VMRequest{
+		Version: VMRequestVersion,
+		ID:      id,
+		Op:      op,
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		req.Data = b
+	}
+	return req, nil
+}
+
+// DecodeData decodes the payload of the request into v. It leaves v unchanged
+// if the request has no payload.
+func (req *VMRequest) DecodeData(v interface{}) error {
+	if len(req.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(req.Data, v)
 }
 
-// IssueVMRequest issues a request to a shim at the given pipe.
+// Error codes of a VMError.
+const (
+	// VMErrorFailed is returned when the operation failed.
+	VMErrorFailed = "Failed"
+	// VMErrorUnknownOp is returned when the shim does not implement the
+	// operation.
+	VMErrorUnknownOp = "UnknownOp"
+	// VMErrorUnsupportedVersion is returned when the request's version is
+	// newer than the shim's.
+	VMErrorUnsupportedVersion = "UnsupportedVersion"
+)
+
+// VMError is an error returned by a VM shim.
+type VMError struct {
+	// Code classifies the error, for example VMErrorUnknownOp.
+	Code    string
+	Message string
+}
+
+func (err *VMError) Error() string {
+	return err.Message
+}
+
+// VMResponse is the response of a VM shim to a request of version 1 or later.
+type VMResponse struct {
+	// Version is the protocol version of the shim.
+	Version int
+	// Error is set if the request failed.
+	Error *VMError `json:",omitempty"`
+}
+
+// WriteVMResponse writes the result err of req to w, in the format of the
+// request's version.
+func WriteVMResponse(w io.Writer, req *VMRequest, err error) error {
+	if req.Version == 0 {
+		if err != nil {
+			_, werr := io.WriteString(w, err.Error())
+			return werr
+		}
+		_, werr := w.Write(ShimSuccess)
+		return werr
+	}
+	resp := VMResponse{Version: VMRequestVersion}
+	if err != nil {
+		verr, ok := err.(*VMError)
+		if !ok {
+			verr = &VMError{Code: VMErrorFailed, Message: err.Error()}
+		}
+		resp.Error = verr
+	}
+	return json.NewEncoder(w).Encode(&resp)
+}
+
+// ReadVMResponse reads the response to a request from r until EOF. It returns
+// a *VMError if the request failed. Responses of shims that predate versioning
+// are also accepted.
+func ReadVMResponse(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, ShimSuccess) {
+		return nil
+	}
+	var resp VMResponse
+	if err := json.Unmarshal(b, &resp); err != nil || resp.Version == 0 {
+		if len(b) == 0 {
+			return errors.New("unknown shim failure")
+		}
+		return &VMError{Code: VMErrorFailed, Message: string(b)}
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return nil
+}
+
+// IssueVMRequest issues a request to a shim at the given pipe. Requests
+// without a version are sent as VMRequestVersion.
 func IssueVMRequest(pipepath string, req *VMRequest) error {
 	pipe, err := winio.DialPipe(pipepath, nil)
 	if err != nil {
 		return err
 	}
 	defer pipe.Close()
-	if err := json.NewEncoder(pipe).Encode(req); err != nil {
-		return err
+	r := *req
+	if r.Version == 0 {
+		r.Version = VMRequestVersion
 	}
-	if err := GetErrorFromPipe(pipe, nil); err != nil {
+	if err := json.NewEncoder(pipe).Encode(&r); err != nil {
 		return err
 	}
-	return nil
+	return ReadVMResponse(pipe)
 }
@@ -0,0 +1,79 @@
+package runhcs
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_VMResponse(t *testing.T) {
+	for _, version := range []int{0, VMRequestVersion} {
+		req := &VMRequest{Version: version, ID: "test", Op: OpCreateContainer}
+
+		var b bytes.Buffer
+		if err := WriteVMResponse(&b, req, nil); err != nil {
+			t.Fatal(err)
+		}
+		if version == 0 && !bytes.Equal(b.Bytes(), ShimSuccess) {
+			t.Fatalf("version 0: expected ShimSuccess, got %q", b.Bytes())
+		}
+		if err := ReadVMResponse(&b); err != nil {
+			t.Fatalf("version %d: expected success, got %s", version, err)
+		}
+
+		b.Reset()
+		if err := WriteVMResponse(&b, req, errors.New("test failure")); err != nil {
+			t.Fatal(err)
+		}
+		if version == 0 && b.String() != "test failure" {
+			t.Fatalf("version 0: expected the error text, got %q", b.String())
+		}
+		err := ReadVMResponse(&b)
+		if verr, ok := err.(*VMError); !ok || verr.Code != VMErrorFailed || verr.Message != "test failure" {
+			t.Fatalf("version %d: unexpected error %#v", version, err)
+		}
+	}
+}
+
+func Test_VMResponseErrorCode(t *testing.T) {
+	req := &VMRequest{Version: VMRequestVersion, ID: "test", Op: "unknown"}
+	var b bytes.Buffer
+	if err := WriteVMResponse(&b, req, &VMError{Code: VMErrorUnknownOp, Message: "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	err := ReadVMResponse(&b)
+	if verr, ok := err.(*VMError); !ok || verr.Code != VMErrorUnknownOp {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	if err := ReadVMResponse(strings.NewReader("")); err == nil {
+		t.Fatal("expected an error for an empty response")
+	}
+}
+
+func Test_VMRequestData(t *testing.T) {
+	req, err := NewVMRequest("test", OpSyncNamespace, &SyncNamespaceRequest{NamespaceID: "ns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != VMRequestVersion {
+		t.Fatalf("expected version %d, got %d", VMRequestVersion, req.Version)
+	}
+	var data SyncNamespaceRequest
+	if err := req.DecodeData(&data); err != nil {
+		t.Fatal(err)
+	}
+	if data.NamespaceID != "ns" {
+		t.Fatalf("expected namespace ns, got %q", data.NamespaceID)
+	}
+
+	// A request from a client that predates versioning has no payload.
+	data = SyncNamespaceRequest{}
+	if err := (&VMRequest{ID: "test", Op: OpSyncNamespace}).DecodeData(&data); err != nil {
+		t.Fatal(err)
+	}
+	if data.NamespaceID != "" {
+		t.Fatalf("expected no namespace, got %q", data.NamespaceID)
+	}
+}
@@ -0,0 +1,261 @@
+package statestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	lockFileName = ".lock"
+	valueSuffix  = ".json"
+)
+
+// Dir is a StateStore that keeps each value as a JSON file named
+// <root>/<id>/<key>.json, with the ID and key escaped. Values are replaced
+// atomically, and access is serialized between processes by locking a file in
+// root. Unlike the registry, the state persists across reboots.
+type Dir struct {
+	root string
+	mu   sync.Mutex
+	lock *os.File
+}
+
+var _ StateStore = &Dir{}
+
+// OpenDir opens the state store in directory root, creating it if necessary.
+func OpenDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(root, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Dir{root: root, lock: lock}, nil
+}
+
+// reservedNames are the names, in lower case, of the DOS devices that Windows
+// will not create as files, with or without an extension.
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// escape returns name encoded as a file name that is valid on Windows and Unix
+// file systems, including case insensitive ones. Every byte other than a lower
+// case letter, a digit, '-' or '_' is percent encoded, so names that differ only
+// in case map to different files. Names of DOS devices are escaped too, and the
+// result never starts with a dot, so it cannot collide with the lock file,
+// temporary files, or the special names "." and "..".
+func escape(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	s := b.String()
+	if reservedNames[s] {
+		s = fmt.Sprintf("%%%02X", s[0]) + s[1:]
+	}
+	return s
+}
+
+func (d *Dir) idPath(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("invalid ID ''")
+	}
+	return filepath.Join(d.root, escape(id)), nil
+}
+
+func (d *Dir) locked(f func() error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lock == nil {
+		return errors.New("state store is closed")
+	}
+	if err := lockFile(d.lock); err != nil {
+		return &os.PathError{Op: "lock", Path: d.lock.Name(), Err: err}
+	}
+	defer unlockFile(d.lock)
+	return f()
+}
+
+// writeFile atomically replaces the contents of path with data.
+func writeFile(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *Dir) set(id string, create bool, key string, state interface{}) error {
+	p, err := d.idPath(id)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return d.locked(func() error {
+		if create {
+			if err := os.Mkdir(p, 0700); err != nil {
+				if os.IsExist(err) {
+					return fmt.Errorf("container %s already exists", id)
+				}
+				return err
+			}
+			if err := writeFile(filepath.Join(p, escape(key)+valueSuffix), js); err != nil {
+				os.RemoveAll(p)
+				return err
+			}
+			return nil
+		}
+		if _, err := os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return &NotFoundError{id}
+			}
+			return err
+		}
+		return writeFile(filepath.Join(p, escape(key)+valueSuffix), js)
+	})
+}
+
+// Create creates id and sets its first value.
+func (d *Dir) Create(id, key string, state interface{}) error {
+	return d.set(id, true, key, state)
+}
+
+// Set sets a value of an existing id.
+func (d *Dir) Set(id, key string, state interface{}) error {
+	return d.set(id, false, key, state)
+}
+
+// Get reads a value of id into state.
+func (d *Dir) Get(id, key string, state interface{}) error {
+	p, err := d.idPath(id)
+	if err != nil {
+		return err
+	}
+	var js []byte
+	err = d.locked(func() error {
+		if _, err := os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return &NotFoundError{id}
+			}
+			return err
+		}
+		var err error
+		js, err = ioutil.ReadFile(filepath.Join(p, escape(key)+valueSuffix))
+		if os.IsNotExist(err) {
+			return &NoStateError{id, key}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, state)
+}
+
+// Clear removes a value of id.
+func (d *Dir) Clear(id, key string) error {
+	p, err := d.idPath(id)
+	if err != nil {
+		return err
+	}
+	return d.locked(func() error {
+		if _, err := os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return &NotFoundError{id}
+			}
+			return err
+		}
+		err := os.Remove(filepath.Join(p, escape(key)+valueSuffix))
+		if os.IsNotExist(err) {
+			return &NoStateError{id, key}
+		}
+		return err
+	})
+}
+
+// Remove removes id and all of its values.
+func (d *Dir) Remove(id string) error {
+	p, err := d.idPath(id)
+	if err != nil {
+		return err
+	}
+	return d.locked(func() error {
+		if _, err := os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return &NotFoundError{id}
+			}
+			return err
+		}
+		return os.RemoveAll(p)
+	})
+}
+
+// Enumerate returns the IDs in the store.
+func (d *Dir) Enumerate() ([]string, error) {
+	var ids []string
+	err := d.locked(func() error {
+		fis, err := ioutil.ReadDir(d.root)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			id, err := url.PathUnescape(fi.Name())
+			if err == nil {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Close releases the store.
+func (d *Dir) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lock == nil {
+		return nil
+	}
+	err := d.lock.Close()
+	d.lock = nil
+	return err
+}
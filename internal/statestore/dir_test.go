@@ -0,0 +1,246 @@
+package statestore
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func openTestDir(t *testing.T) (*Dir, func()) {
+	root, err := ioutil.TempDir("", "statestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenDir(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(root)
+	}
+}
+
+func TestDirLifetime(t *testing.T) {
+	d, cleanup := openTestDir(t)
+	defer cleanup()
+	ids, err := d.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatal("wrong count", len(ids))
+	}
+
+	id := "a/b/c"
+	key := "key"
+	err = d.Set(id, key, 1)
+	if !IsNotFoundError(err) {
+		t.Fatal("expected not found error, got", err)
+	}
+
+	var i int
+	err = d.Get(id, key, &i)
+	if !IsNotFoundError(err) {
+		t.Fatal("expected not found error, got", err)
+	}
+
+	err = d.Create(id, key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Create(id, key, 2)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	ids, err = d.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatal("wrong count", len(ids))
+	}
+	if ids[0] != id {
+		t.Fatal("wrong value", ids[0])
+	}
+
+	err = d.Get(id, key, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 2 {
+		t.Fatal("got wrong value", i)
+	}
+
+	err = d.Set(id, key, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Get(id, key, &i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 3 {
+		t.Fatal("got wrong value", i)
+	}
+
+	err = d.Get(id, "other", &i)
+	if _, ok := err.(*NoStateError); !ok {
+		t.Fatal("expected no state error, got", err)
+	}
+	err = d.Clear(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Clear(id, key)
+	if _, ok := err.(*NoStateError); !ok {
+		t.Fatal("expected no state error, got", err)
+	}
+
+	err = d.Remove(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Remove(id)
+	if !IsNotFoundError(err) {
+		t.Fatal("expected not found error, got", err)
+	}
+
+	ids, err = d.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatal("wrong count", len(ids))
+	}
+}
+
+func TestDirValues(t *testing.T) {
+	d, cleanup := openTestDir(t)
+	defer cleanup()
+	id := "x"
+	err := d.Create(id, "bool", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Set(id, "string", "blah")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := struct{ X int }{5}
+	err = d.Set(id, "json", &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := false
+	err = d.Get(id, "bool", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b {
+		t.Fatal("value did not marshal correctly")
+	}
+	s := ""
+	err = d.Get(id, "string", &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "blah" {
+		t.Fatal("value did not marshal correctly")
+	}
+	v.X = 0
+	err = d.Get(id, "json", &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.X != 5 {
+		t.Fatal("value did not marshal correctly: ", v)
+	}
+}
+
+func TestDirEscaping(t *testing.T) {
+	d, cleanup := openTestDir(t)
+	defer cleanup()
+	names := []string{".", "..", ".lock", "a:b", `c\d`, "e f", "%2E", "g+h", "con", "Con", "CON", "nul", "lpt1", "A", "a"}
+	for _, name := range names {
+		if err := d.Create(name, name, name); err != nil {
+			t.Fatalf("%q: %s", name, err)
+		}
+	}
+	ids, err := d.Enumerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	sort.Strings(names)
+	if len(ids) != len(names) {
+		t.Fatalf("expected %q, got %q", names, ids)
+	}
+	for i, name := range names {
+		if ids[i] != name {
+			t.Fatalf("expected %q, got %q", names, ids)
+		}
+		var s string
+		if err := d.Get(name, name, &s); err != nil || s != name {
+			t.Fatalf("%q: got %q, %v", name, s, err)
+		}
+	}
+	if err := d.Create("", "key", 1); err == nil {
+		t.Fatal("expected error for an empty ID")
+	}
+}
+
+func TestEscapeCaseInsensitive(t *testing.T) {
+	// The escaped names must stay distinct on case insensitive file systems,
+	// and must not be DOS device names.
+	names := []string{"a", "A", "ab", "aB", "Ab", "AB", "%41", "%61", "con", "CON", "Con", "com1", "COM1", "nul", "aux"}
+	seen := make(map[string]string)
+	for _, name := range names {
+		e := strings.ToLower(escape(name))
+		if other, ok := seen[e]; ok {
+			t.Fatalf("%q and %q both escape to %q", name, other, e)
+		}
+		seen[e] = name
+		if reservedNames[e] {
+			t.Fatalf("%q escapes to the reserved name %q", name, e)
+		}
+	}
+}
+
+func TestDirConcurrentCreate(t *testing.T) {
+	d, cleanup := openTestDir(t)
+	defer cleanup()
+	const n = 10
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d2, err := OpenDir(d.root)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer d2.Close()
+			if err := d2.Create("x", "key", 1); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("expected one successful create, got %d", created)
+	}
+}
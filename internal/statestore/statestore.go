@@ -0,0 +1,52 @@
+// Package statestore defines the storage interface for runhcs state, along
+// with a backend that stores the state as JSON files in a directory.
+package statestore
+
+import (
+	"fmt"
+)
+
+// StateStore stores state values by ID and key. Each ID is a set of keys,
+// which is created with the first value and removed as a whole.
+type StateStore interface {
+	// Create creates id and sets its first value. It fails if id already
+	// exists.
+	Create(id, key string, state interface{}) error
+	// Set sets a value of an existing id.
+	Set(id, key string, state interface{}) error
+	// Get reads a value of id into state, which must be a pointer.
+	Get(id, key string, state interface{}) error
+	// Clear removes a value of id.
+	Clear(id, key string) error
+	// Remove removes id and all of its values.
+	Remove(id string) error
+	// Enumerate returns the IDs in the store.
+	Enumerate() ([]string, error)
+	// Close releases the store.
+	Close() error
+}
+
+// NotFoundError is returned when an ID is not present in the store.
+type NotFoundError struct {
+	Id string
+}
+
+func (err *NotFoundError) Error() string {
+	return fmt.Sprintf("ID '%s' was not found", err.Id)
+}
+
+// IsNotFoundError returns true if err is a *NotFoundError.
+func IsNotFoundError(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// NoStateError is returned when an ID does not have a value for a key.
+type NoStateError struct {
+	ID  string
+	Key string
+}
+
+func (err *NoStateError) Error() string {
+	return fmt.Sprintf("state '%s' is not present for ID '%s'", err.Key, err.ID)
+}
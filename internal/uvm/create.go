@@ -39,6 +39,7 @@ type UVMOptions struct {
 	OperatingSystem         string                  // "windows" or "linux".
 	Resources               *specs.WindowsResources // Optional resources for the utility VM. Supports Memory.limit and CPU.Count only currently. // TODO consider extending?
 	AdditionHCSDocumentJSON string                  // Optional additional JSON to merge into the HCS document prior
+	RestoreStatePath        string                  // Optional path to a saved state file to restore the utility VM from instead of booting it
 
 	// WCOW specific parameters
 	LayerFolders []string // Set of folders for base layers and scratch. Ordered from top most read-only through base read-only layer, followed by scratch
@@ -93,8 +94,6 @@ func Create(opts *UVMOptions) (_ *UtilityVM, err error) {
 		operatingSystem: opts.OperatingSystem,
 	}
 
-	uvmFolder := "" // Windows
-
 	if opts.OperatingSystem != "linux" && opts.OperatingSystem != "windows" {
 		logrus.Debugf("uvm::Create Unsupported OS")
 		return nil, fmt.Errorf("unsupported operating system %q", opts.OperatingSystem)
@@ -109,6 +108,45 @@ func Create(opts *UVMOptions) (_ *UtilityVM, err error) {
 		uvm.owner = filepath.Base(os.Args[0])
 	}
 
+	hcsDocument, err := uvm.makeDocument(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fullDoc, err := mergemaps.MergeJSON(hcsDocument, ([]byte)(opts.AdditionHCSDocumentJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge additional JSON '%s': %s", opts.AdditionHCSDocumentJSON, err)
+	}
+
+	hcsSystem, err := hcs.CreateComputeSystem(uvm.id, fullDoc)
+	if err != nil {
+		logrus.Debugln("failed to create UVM: ", err)
+		return nil, err
+	}
+
+	uvm.hcsSystem = hcsSystem
+	defer func() {
+		if err != nil {
+			uvm.Close()
+		}
+	}()
+
+	if uvm.operatingSystem == "linux" {
+		// Create a socket that the GCS can send logrus log data to.
+		uvm.gcslog, err = uvm.listenVsock(linuxLogVsockPort)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return uvm, nil
+}
+
+// makeDocument returns the HCS document that creates the utility VM described
+// by opts.
+func (uvm *UtilityVM) makeDocument(opts *UVMOptions) (*hcsschema.ComputeSystem, error) {
+	uvmFolder := "" // Windows
+
 	attachments := make(map[string]hcsschema.Attachment)
 	scsi := make(map[string]hcsschema.Scsi)
 	uvm.scsiControllerCount = 1
@@ -302,6 +340,12 @@ func Create(opts *UVMOptions) (_ *UtilityVM, err error) {
 		},
 	}
 
+	if opts.RestoreStatePath != "" {
+		vm.RestoreState = &hcsschema.RestoreState{
+			SaveStateFilePath: opts.RestoreStatePath,
+		}
+	}
+
 	hcsDocument := &hcsschema.ComputeSystem{
 		Owner:          uvm.owner,
 		SchemaVersion:  schemaversion.SchemaV21(),
@@ -435,34 +479,7 @@ func Create(opts *UVMOptions) (_ *UtilityVM, err error) {
 			OptionalData: kernelArgs,
 		}
 	}
-
-	fullDoc, err := mergemaps.MergeJSON(hcsDocument, ([]byte)(opts.AdditionHCSDocumentJSON))
-	if err != nil {
-		return nil, fmt.Errorf("failed to merge additional JSON '%s': %s", opts.AdditionHCSDocumentJSON, err)
-	}
-
-	hcsSystem, err := hcs.CreateComputeSystem(uvm.id, fullDoc)
-	if err != nil {
-		logrus.Debugln("failed to create UVM: ", err)
-		return nil, err
-	}
-
-	uvm.hcsSystem = hcsSystem
-	defer func() {
-		if err != nil {
-			uvm.Close()
-		}
-	}()
-
-	if uvm.operatingSystem == "linux" {
-		// Create a socket that the GCS can send logrus log data to.
-		uvm.gcslog, err = uvm.listenVsock(linuxLogVsockPort)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return uvm, nil
+	return hcsDocument, nil
 }
 
 func (uvm *UtilityVM) listenVsock(port uint32) (net.Listener, error) {
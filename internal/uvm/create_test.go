@@ -1,6 +1,9 @@
 package uvm
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -36,3 +39,37 @@ func TestCreateWCOWBadLayerFolders(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMakeDocumentRestoreState(t *testing.T) {
+	bootFiles, err := ioutil.TempDir("", "uvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bootFiles)
+	for _, name := range []string{"kernel", initrdFile} {
+		if err := ioutil.WriteFile(filepath.Join(bootFiles, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &UVMOptions{
+		OperatingSystem: "linux",
+		BootFilesPath:   bootFiles,
+	}
+	doc, err := (&UtilityVM{operatingSystem: "linux"}).makeDocument(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.VirtualMachine.RestoreState != nil {
+		t.Fatalf("unexpected restore state %+v", doc.VirtualMachine.RestoreState)
+	}
+
+	opts.RestoreStatePath = `c:\checkpoint\vm.vmrs`
+	doc, err = (&UtilityVM{operatingSystem: "linux"}).makeDocument(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := doc.VirtualMachine.RestoreState; rs == nil || rs.SaveStateFilePath != opts.RestoreStatePath {
+		t.Fatalf("expected restore state from %s, got %+v", opts.RestoreStatePath, rs)
+	}
+}
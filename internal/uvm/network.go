@@ -107,6 +107,49 @@ func (uvm *UtilityVM) RemoveNetNS(id string) error {
 	return err
 }
 
+// SyncNetNS reconciles the NICs of the network namespace id, added with
+// AddNetNS, with endpoints. NICs are removed for endpoints that are no longer
+// in the namespace, and added for new endpoints. It does nothing if the
+// namespace has not been added to the utility VM.
+func (uvm *UtilityVM) SyncNetNS(id string, endpoints []*hns.HNSEndpoint) error {
+	uvm.m.Lock()
+	defer uvm.m.Unlock()
+	ns := uvm.namespaces[id]
+	if ns == nil {
+		return nil
+	}
+
+	added := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		added[endpoint.Id] = true
+	}
+	var nics []nicInfo
+	for i, nic := range ns.nics {
+		if added[nic.Endpoint.Id] {
+			nics = append(nics, nic)
+			delete(added, nic.Endpoint.Id)
+			continue
+		}
+		if err := uvm.removeNIC(nic.ID, nic.Endpoint); err != nil {
+			ns.nics = append(nics, ns.nics[i:]...)
+			return err
+		}
+	}
+	ns.nics = nics
+	for _, endpoint := range endpoints {
+		if !added[endpoint.Id] {
+			continue
+		}
+		nicID := guid.New()
+		if err := uvm.addNIC(nicID, endpoint); err != nil {
+			return err
+		}
+		ns.nics = append(ns.nics, nicInfo{nicID, endpoint})
+		delete(added, endpoint.Id)
+	}
+	return nil
+}
+
 // IsNetworkNamespaceSupported returns bool value specifying if network namespace is supported inside the guest
 func (uvm *UtilityVM) isNetworkNamespaceSupported() bool {
 	p, err := uvm.ComputeSystem().Properties(schema1.PropertyTypeGuestConnection)
@@ -0,0 +1,17 @@
+package runhcs
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// Checkpoint stops the paused container, saves the state of its VM to
+// imagePath and deletes the container. Use Restore to create the container
+// again from the checkpoint.
+func (r *Runhcs) Checkpoint(context context.Context, id, imagePath string) error {
+	abs, err := filepath.Abs(imagePath)
+	if err != nil {
+		return err
+	}
+	return r.runOrError(r.command(context, "checkpoint", "--image-path", abs, id))
+}
@@ -0,0 +1,69 @@
+package runhcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	irunhcs "github.com/Microsoft/hcsshim/internal/runhcs"
+	"github.com/containerd/go-runc"
+)
+
+// Event is a container event such as an exit, pause or resume notification or
+// resource usage statistics.
+type Event = irunhcs.Event
+
+// Event types returned by Events.
+const (
+	EventStats  = irunhcs.EventStats
+	EventPause  = irunhcs.EventPause
+	EventResume = irunhcs.EventResume
+	EventExit   = irunhcs.EventExit
+	EventError  = irunhcs.EventError
+)
+
+// Events returns a stream of events for the container, with statistics
+// collected at the specified interval. The channel is closed after the
+// container exits or when context is canceled. An event that cannot be decoded
+// is returned with Type EventError and Err set.
+func (r *Runhcs) Events(context context.Context, id string, interval time.Duration) (chan *Event, error) {
+	cmd := r.command(context, "events", fmt.Sprintf("--interval=%s", interval), id)
+	rd, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	ec, err := runc.Monitor.Start(cmd)
+	if err != nil {
+		rd.Close()
+		return nil, err
+	}
+	var (
+		dec = json.NewDecoder(rd)
+		c   = make(chan *Event, 128)
+	)
+	go func() {
+		defer func() {
+			close(c)
+			rd.Close()
+			runc.Monitor.Wait(cmd, ec)
+		}()
+		for {
+			var e Event
+			if err := dec.Decode(&e); err != nil {
+				if err == io.EOF {
+					return
+				}
+				e = Event{
+					Type: EventError,
+					Err:  err,
+				}
+				c <- &e
+				return
+			}
+			c <- &e
+		}
+	}()
+	return c, nil
+}
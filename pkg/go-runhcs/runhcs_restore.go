@@ -0,0 +1,71 @@
+package runhcs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	runc "github.com/containerd/go-runc"
+)
+
+// RestoreOpts is set of options that can be used with the Restore command.
+type RestoreOpts struct {
+	CreateOpts
+	// ImagePath is the path to the checkpoint image written by Checkpoint.
+	ImagePath string
+	// Detach from the container's process.
+	Detach bool
+}
+
+func (opt *RestoreOpts) args() ([]string, error) {
+	abs, err := filepath.Abs(opt.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{"--image-path", abs}
+	if opt.Detach {
+		out = append(out, "--detach")
+	}
+	cargs, err := opt.CreateOpts.args()
+	if err != nil {
+		return nil, err
+	}
+	return append(out, cargs...), nil
+}
+
+// Restore creates and starts a container for bundle in a VM restored from the
+// checkpoint at opts.ImagePath.
+func (r *Runhcs) Restore(context context.Context, id, bundle string, opts *RestoreOpts) error {
+	oargs, err := opts.args()
+	if err != nil {
+		return err
+	}
+	args := append([]string{"restore", "--bundle", bundle}, oargs...)
+	cmd := r.command(context, append(args, id)...)
+	if opts.IO != nil {
+		opts.Set(cmd)
+	}
+	if cmd.Stdout == nil && cmd.Stderr == nil {
+		data, err := cmdOutput(cmd, true)
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, data)
+		}
+		return nil
+	}
+	ec, err := runc.Monitor.Start(cmd)
+	if err != nil {
+		return err
+	}
+	if opts.IO != nil {
+		if c, ok := opts.IO.(runc.StartCloser); ok {
+			if err := c.CloseAfterStart(); err != nil {
+				return err
+			}
+		}
+	}
+	status, err := runc.Monitor.Wait(cmd, ec)
+	if err == nil && status != 0 {
+		err = fmt.Errorf("%s did not terminate sucessfully", cmd.Args[0])
+	}
+	return err
+}
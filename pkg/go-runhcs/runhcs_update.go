@@ -0,0 +1,20 @@
+package runhcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+)
+
+// Update changes the resource constraints of a running container. resources
+// is a *specs.WindowsResources for a Windows container or a
+// *specs.LinuxResources for a Linux container.
+func (r *Runhcs) Update(context context.Context, id string, resources interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(resources); err != nil {
+		return err
+	}
+	cmd := r.command(context, "update", "--resources=-", id)
+	cmd.Stdin = buf
+	return r.runOrError(cmd)
+}